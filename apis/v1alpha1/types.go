@@ -0,0 +1,39 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SchemeGroupVersion is the group version of the NATS Tower custom resources.
+var SchemeGroupVersion = schema.GroupVersion{Group: "nats-tower.com", Version: "v1alpha1"}
+
+// NatsAccessGrant is a cluster-scoped resource that grants a namespace of this
+// cluster access to a NATS Tower account. The operator reconciles it into a
+// record of the k8s access list on NATS Tower.
+type NatsAccessGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NatsAccessGrantSpec `json:"spec"`
+}
+
+// NatsAccessGrantSpec describes the (namespace, account) pair to grant access for.
+type NatsAccessGrantSpec struct {
+	// Installation is the public key of the NATS installation. When empty,
+	// the default installation of the operator is used.
+	Installation string `json:"installation,omitempty"`
+	// Account is the name of the NATS Tower account.
+	Account string `json:"account"`
+	// Namespace is the namespace that is allowed to request credentials
+	// for the account.
+	Namespace string `json:"namespace"`
+}
+
+// NatsAccessGrantList is a list of NatsAccessGrant resources.
+type NatsAccessGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []NatsAccessGrant `json:"items"`
+}
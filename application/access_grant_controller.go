@@ -0,0 +1,284 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/apis/v1alpha1"
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+const (
+	// natsTowerAccessCreatedAnnotationKey records whether the access record
+	// of a grant is created by the operator, so it is revoked with the last
+	// of its grants. Records that existed before are kept.
+	natsTowerAccessCreatedAnnotationKey = "nats-tower.com/access-created"
+
+	// accessGrantRetryInterval is the delay before grants of missing
+	// accounts are reconciled again.
+	accessGrantRetryInterval = 5 * time.Minute
+)
+
+func getAccessGrantHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj v1alpha1.NatsAccessGrant) error {
+	return func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj v1alpha1.NatsAccessGrant) error {
+		klog.Infof("NatsAccessGrant[deleted=%t]: %s - %s", req.Deleted, obj.Name, req.Key)
+
+		if req.Deleted {
+			// Revoked before the finalizer was released
+			return nil
+		}
+
+		if obj.DeletionTimestamp != nil {
+			return natsTowerOperator.finalizeAccessGrant(ctx, informer, &obj)
+		}
+
+		if obj.Spec.Namespace == "" || obj.Spec.Account == "" {
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"InvalidAccessGrant",
+				"Require spec.namespace and spec.account to grant access")
+			return nil
+		}
+
+		installationPublicKey := obj.Spec.Installation
+
+		if installationPublicKey == "" && natsTowerOperator.towerOperatorConfig.DefaultInstallation == "" {
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"MissingInstallation",
+				"Require spec.installation to grant access")
+			return nil
+		}
+
+		if installationPublicKey == "" {
+			installationPublicKey = natsTowerOperator.towerOperatorConfig.DefaultInstallation
+		} else {
+			_, ok := natsTowerOperator.towerOperatorConfig.ValidInstallations[installationPublicKey]
+
+			if !ok {
+				natsTowerOperator.eventRecorder.Eventf(&obj,
+					corev1.EventTypeWarning,
+					"InvalidInstallation",
+					"Require spec.installation to be one of %+v to grant access",
+					natsTowerOperator.towerOperatorConfig.InstallationKeys())
+				return nil
+			}
+		}
+
+		_, marked := obj.Annotations[natsTowerAccessCreatedAnnotationKey]
+		finalized := slices.Contains(obj.Finalizers, natsTowerCleanupFinalizer)
+		if !finalized || !marked {
+			metadata := map[string]any{}
+			if !finalized {
+				metadata["finalizers"] = append(slices.Clone(obj.Finalizers), natsTowerCleanupFinalizer)
+			}
+			if !marked {
+				// The grant is marked before the record is created, so a
+				// record created by the operator is always revoked again
+				exists, err := natsTowerOperator.natsTowerClient.HasK8sAccess(ctx,
+					obj.Spec.Namespace,
+					installationPublicKey,
+					obj.Spec.Account)
+				if err != nil {
+					return natsTowerOperator.handleAccessGrantError(&obj, err)
+				}
+				metadata["annotations"] = map[string]string{
+					natsTowerAccessCreatedAnnotationKey: strconv.FormatBool(!exists),
+				}
+			}
+			// The update of the grant triggers a new reconcile
+			return natsTowerOperator.patchAccessGrant(ctx, &obj, metadata)
+		}
+
+		created, err := natsTowerOperator.natsTowerClient.GrantK8sAccess(ctx,
+			obj.Spec.Namespace,
+			installationPublicKey,
+			obj.Spec.Account)
+		if err != nil {
+			return natsTowerOperator.handleAccessGrantError(&obj, err)
+		}
+
+		if created {
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeNormal,
+				"AccessGranted",
+				"Granted namespace '%s' on cluster '%s' access to account '%s'",
+				obj.Spec.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, obj.Spec.Account)
+
+			if obj.Annotations[natsTowerAccessCreatedAnnotationKey] != "true" {
+				// The record was removed in the meantime and created again
+				return natsTowerOperator.patchAccessGrant(ctx, &obj, map[string]any{
+					"annotations": map[string]string{natsTowerAccessCreatedAnnotationKey: "true"},
+				})
+			}
+		}
+
+		return nil
+	}
+}
+
+// handleAccessGrantError records the error on the grant. Grants of accounts
+// that do not exist yet on NATS Tower are retried later.
+func (c *NATSTowerOperator) handleAccessGrantError(grant *v1alpha1.NatsAccessGrant, err error) error {
+	if err == natstower.ErrAccountNotFound {
+		c.eventRecorder.Eventf(grant,
+			corev1.EventTypeWarning,
+			"AccountNotFound",
+			"Account '%s' does not exist on NATS Tower, retrying in %s", grant.Spec.Account, accessGrantRetryInterval)
+		return k8s.RequeueAfter(accessGrantRetryInterval, nil)
+	}
+
+	c.eventRecorder.Eventf(grant,
+		corev1.EventTypeWarning,
+		"ErrorGrantingK8sAccess",
+		"Could not grant namespace '%s' access to account '%s': %v",
+		grant.Spec.Namespace, grant.Spec.Account, err)
+	return err
+}
+
+// finalizeAccessGrant revokes the access record created for a deleted grant
+// before releasing its finalizer. Records the operator did not create, e.g.
+// added in the NATS Tower UI, are kept. Several grants may describe the same
+// record, so it is handed over to the remaining grants instead. If NATS Tower
+// can not be reached within the finalizer timeout, the finalizer is released
+// without cleanup.
+func (c *NATSTowerOperator) finalizeAccessGrant(ctx context.Context,
+	informer cache.SharedIndexInformer,
+	grant *v1alpha1.NatsAccessGrant) error {
+	if !slices.Contains(grant.Finalizers, natsTowerCleanupFinalizer) {
+		return nil
+	}
+	if grant.Annotations[natsTowerAccessCreatedAnnotationKey] != "true" {
+		return c.removeAccessGrantFinalizer(ctx, grant)
+	}
+
+	installationPublicKey := grant.Spec.Installation
+	if installationPublicKey == "" {
+		installationPublicKey = c.towerOperatorConfig.DefaultInstallation
+	}
+
+	others := getOtherAccessGrants(informer, grant, installationPublicKey, c.towerOperatorConfig.DefaultInstallation)
+	if len(others) > 0 {
+		for i := range others {
+			if others[i].Annotations[natsTowerAccessCreatedAnnotationKey] == "true" {
+				continue
+			}
+			err := c.patchAccessGrant(ctx, &others[i], map[string]any{
+				"annotations": map[string]string{natsTowerAccessCreatedAnnotationKey: "true"},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		klog.Infof("NatsAccessGrant[%s]: access still granted by another NatsAccessGrant", grant.Name)
+		return c.removeAccessGrantFinalizer(ctx, grant)
+	}
+
+	err := c.natsTowerClient.RevokeK8sAccess(ctx,
+		grant.Spec.Namespace,
+		installationPublicKey,
+		grant.Spec.Account)
+	if err != nil {
+		timeout := time.Minute * time.Duration(c.towerOperatorConfig.FinalizerTimeout)
+		if time.Since(grant.DeletionTimestamp.Time) < timeout {
+			c.eventRecorder.Eventf(grant,
+				corev1.EventTypeWarning,
+				"ErrorRevokingK8sAccess",
+				"Could not revoke access of namespace '%s' to account '%s', retrying: %v",
+				grant.Spec.Namespace, grant.Spec.Account, err)
+			return k8s.RequeueAfter(time.Minute, err)
+		}
+
+		c.eventRecorder.Eventf(grant,
+			corev1.EventTypeWarning,
+			"CleanupTimeout",
+			"Could not revoke access of namespace '%s' to account '%s' within %s, giving up: %v",
+			grant.Spec.Namespace, grant.Spec.Account, timeout, err)
+	} else {
+		klog.Infof("NatsAccessGrant[%s]: revoked access of namespace '%s' to account '%s'",
+			grant.Name, grant.Spec.Namespace, grant.Spec.Account)
+	}
+
+	return c.removeAccessGrantFinalizer(ctx, grant)
+}
+
+func (c *NATSTowerOperator) removeAccessGrantFinalizer(ctx context.Context, grant *v1alpha1.NatsAccessGrant) error {
+	finalizers := slices.DeleteFunc(slices.Clone(grant.Finalizers), func(f string) bool {
+		return f == natsTowerCleanupFinalizer
+	})
+	if finalizers == nil {
+		finalizers = []string{}
+	}
+
+	return c.patchAccessGrant(ctx, grant, map[string]any{"finalizers": finalizers})
+}
+
+// patchAccessGrant merges the metadata into the grant. The resource version
+// is part of the patch, so concurrent changes make it fail and the grant is
+// reconciled again.
+func (c *NATSTowerOperator) patchAccessGrant(ctx context.Context, grant *v1alpha1.NatsAccessGrant, metadata map[string]any) error {
+	metadata["resourceVersion"] = grant.ResourceVersion
+	patch, err := json.Marshal(map[string]any{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.k8sClient.DynamicClient.Resource(c.accessGrantGVR).Patch(ctx,
+		grant.Name, types.MergePatchType, patch, v1.PatchOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error updating NatsAccessGrant %s: %v", grant.Name, err)
+	}
+
+	return nil
+}
+
+// getOtherAccessGrants returns the other grants in the informer cache that
+// describe the same (installation, namespace, account) access record.
+func getOtherAccessGrants(informer cache.SharedIndexInformer,
+	grant *v1alpha1.NatsAccessGrant,
+	installationPublicKey, defaultInstallation string) []v1alpha1.NatsAccessGrant {
+
+	var others []v1alpha1.NatsAccessGrant
+
+	for _, item := range informer.GetStore().List() {
+		unstructuredObj, ok := item.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		var other v1alpha1.NatsAccessGrant
+		err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredObj.Object, &other)
+		if err != nil {
+			continue
+		}
+		if other.UID == grant.UID || other.DeletionTimestamp != nil {
+			continue
+		}
+
+		otherInstallation := other.Spec.Installation
+		if otherInstallation == "" {
+			otherInstallation = defaultInstallation
+		}
+
+		if otherInstallation == installationPublicKey &&
+			other.Spec.Namespace == grant.Spec.Namespace &&
+			other.Spec.Account == grant.Spec.Account {
+			others = append(others, other)
+		}
+	}
+
+	return others
+}
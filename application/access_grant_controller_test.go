@@ -0,0 +1,198 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/nats-tower/nats-tower-operator/apis/v1alpha1"
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+func newTestAccessGrant(name, namespace string) *v1alpha1.NatsAccessGrant {
+	return &v1alpha1.NatsAccessGrant{
+		TypeMeta: v1.TypeMeta{APIVersion: "nats-tower.com/v1alpha1", Kind: "NatsAccessGrant"},
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+			UID:  types.UID(name + "-uid"),
+		},
+		Spec: v1alpha1.NatsAccessGrantSpec{
+			Account:   testAccount,
+			Namespace: namespace,
+		},
+	}
+}
+
+// createAccessGrant creates the grant on the fake API server and caches it.
+func (o *testOperator) createAccessGrant(grant *v1alpha1.NatsAccessGrant) {
+	o.t.Helper()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(grant)
+	if err != nil {
+		o.t.Fatalf("error converting grant to unstructured: %v", err)
+	}
+	_, err = o.dynamic.Resource(testAccessGrantGVR).Create(context.Background(),
+		&unstructured.Unstructured{Object: content}, v1.CreateOptions{})
+	if err != nil {
+		o.t.Fatalf("error creating grant: %v", err)
+	}
+	o.cache(testAccessGrantGVR, grant)
+}
+
+// reconcileAccessGrant runs the handler with the grant as stored on the fake
+// API server, nil if it is gone.
+func (o *testOperator) reconcileAccessGrant(name string) *v1alpha1.NatsAccessGrant {
+	o.t.Helper()
+	grant := o.getAccessGrantOrNil(name)
+	if grant == nil {
+		o.t.Fatalf("expected the grant %s to exist", name)
+	}
+	err := getAccessGrantHandler(o.NATSTowerOperator)(context.Background(),
+		o.factory.ForResource(testAccessGrantGVR).Informer(), k8s.Request{Key: name}, *grant)
+	if err != nil {
+		o.t.Fatalf("unexpected error: %v", err)
+	}
+	return o.getAccessGrantOrNil(name)
+}
+
+func (o *testOperator) getAccessGrantOrNil(name string) *v1alpha1.NatsAccessGrant {
+	o.t.Helper()
+	content, err := o.dynamic.Resource(testAccessGrantGVR).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	var grant v1alpha1.NatsAccessGrant
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(content.Object, &grant)
+	if err != nil {
+		o.t.Fatalf("error converting grant from unstructured: %v", err)
+	}
+	return &grant
+}
+
+// deleteAccessGrant marks the grant as deleted, the finalizer keeps it on
+// the fake API server.
+func (o *testOperator) deleteAccessGrant(name string) {
+	o.t.Helper()
+	grant := o.getAccessGrantOrNil(name)
+	grant.DeletionTimestamp = &v1.Time{Time: time.Now()}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(grant)
+	if err != nil {
+		o.t.Fatalf("error converting grant to unstructured: %v", err)
+	}
+	_, err = o.dynamic.Resource(testAccessGrantGVR).Update(context.Background(),
+		&unstructured.Unstructured{Object: content}, v1.UpdateOptions{})
+	if err != nil {
+		o.t.Fatalf("error deleting grant: %v", err)
+	}
+	err = o.factory.ForResource(testAccessGrantGVR).Informer().GetIndexer().Delete(&unstructured.Unstructured{Object: content})
+	if err != nil {
+		o.t.Fatalf("error removing grant from the cache: %v", err)
+	}
+}
+
+func (o *testOperator) hasK8sAccess(namespace string) bool {
+	return len(o.tower.find("nats_auth_k8s_access", map[string]string{"namespace": namespace})) > 0
+}
+
+func hasAccessGrantFinalizer(grant *v1alpha1.NatsAccessGrant) bool {
+	return grant != nil && slices.Contains(grant.Finalizers, natsTowerCleanupFinalizer)
+}
+
+func TestAccessGrantRevokedOnDeletion(t *testing.T) {
+	o := newTestOperator(t)
+	o.createAccessGrant(newTestAccessGrant("grant", "other"))
+
+	grant := o.reconcileAccessGrant("grant")
+	if !hasAccessGrantFinalizer(grant) || o.hasK8sAccess("other") {
+		t.Fatal("expected the finalizer to be added before access is granted")
+	}
+	if grant.Annotations[natsTowerAccessCreatedAnnotationKey] != "true" {
+		t.Fatal("expected the grant to be marked before the record is created")
+	}
+	grant = o.reconcileAccessGrant("grant")
+	if !o.hasK8sAccess("other") || grant.Annotations[natsTowerAccessCreatedAnnotationKey] != "true" {
+		t.Fatal("expected access to be granted and marked as created")
+	}
+
+	o.deleteAccessGrant("grant")
+	grant = o.reconcileAccessGrant("grant")
+	if o.hasK8sAccess("other") {
+		t.Error("expected access to be revoked")
+	}
+	if hasAccessGrantFinalizer(grant) {
+		t.Error("expected the finalizer to be released")
+	}
+}
+
+func TestAccessGrantKeepsManualAccess(t *testing.T) {
+	o := newTestOperator(t)
+	// The access record of the test namespace exists before the grant
+	o.createAccessGrant(newTestAccessGrant("grant", testNamespace))
+	o.reconcileAccessGrant("grant")
+	grant := o.reconcileAccessGrant("grant")
+	if grant.Annotations[natsTowerAccessCreatedAnnotationKey] != "false" {
+		t.Fatal("expected the existing access not to be marked as created")
+	}
+
+	o.deleteAccessGrant("grant")
+	grant = o.reconcileAccessGrant("grant")
+	if !o.hasK8sAccess(testNamespace) {
+		t.Error("expected access not created by the operator to be kept")
+	}
+	if hasAccessGrantFinalizer(grant) {
+		t.Error("expected the finalizer to be released")
+	}
+}
+
+func TestAccessGrantHandedOver(t *testing.T) {
+	o := newTestOperator(t)
+	for _, name := range []string{"first", "second"} {
+		o.createAccessGrant(newTestAccessGrant(name, "other"))
+		o.reconcileAccessGrant(name)
+		o.reconcileAccessGrant(name)
+	}
+	second := o.getAccessGrantOrNil("second")
+	if second.Annotations[natsTowerAccessCreatedAnnotationKey] != "false" {
+		t.Fatal("expected only the first grant to be marked as created")
+	}
+
+	o.deleteAccessGrant("first")
+	o.reconcileAccessGrant("first")
+	if !o.hasK8sAccess("other") {
+		t.Fatal("expected access to be kept for the remaining grant")
+	}
+	second = o.getAccessGrantOrNil("second")
+	if second.Annotations[natsTowerAccessCreatedAnnotationKey] != "true" {
+		t.Fatal("expected the access record to be handed over to the remaining grant")
+	}
+
+	o.deleteAccessGrant("second")
+	o.reconcileAccessGrant("second")
+	if o.hasK8sAccess("other") {
+		t.Error("expected access to be revoked with the last grant")
+	}
+}
+
+func TestAccessGrantRetriesMissingAccount(t *testing.T) {
+	o := newTestOperator(t)
+	grant := newTestAccessGrant("grant", "other")
+	grant.Spec.Account = "missing"
+	o.createAccessGrant(grant)
+
+	grant = o.getAccessGrantOrNil("grant")
+	err := getAccessGrantHandler(o.NATSTowerOperator)(context.Background(),
+		o.factory.ForResource(testAccessGrantGVR).Informer(), k8s.Request{Key: "grant"}, *grant)
+	var requeueErr *k8s.RequeueAfterError
+	if !errors.As(err, &requeueErr) || requeueErr.Err != nil || requeueErr.After != accessGrantRetryInterval {
+		t.Fatalf("expected the grant to be retried in %s, got %v", accessGrantRetryInterval, err)
+	}
+	if events := o.events(); !hasEvent(events, "AccountNotFound") {
+		t.Errorf("expected an AccountNotFound event, got %v", events)
+	}
+}
@@ -0,0 +1,179 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// getConfigMapName resolves the name of the companion ConfigMap requested by
+// the annotations of an object. An empty name disables the ConfigMap. The
+// connection info is then only kept in the secret if this is requested for
+// compatibility with workloads reading it from there.
+func getConfigMapName(annotations map[string]string) (string, bool, error) {
+	name := annotations[natsTowerConfigMapAnnotationKey]
+	keepKeys := annotations[natsTowerConfigMapKeepKeysAnnotationKey]
+	if name == "" {
+		return "", false, nil
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", false, fmt.Errorf("invalid configmap name '%s': %s", name, strings.Join(errs, ", "))
+	}
+	if keepKeys != "" && keepKeys != "true" && keepKeys != "false" {
+		return "", false, fmt.Errorf("%s must be 'true' or 'false'", natsTowerConfigMapKeepKeysAnnotationKey)
+	}
+	return name, keepKeys == "true", nil
+}
+
+// renderConfigMapData renders the connection info that is not secret for the
+// companion ConfigMap of a secret.
+func renderConfigMapData(user string, creds *natstower.ConnectionInfo, jetStreamDomain string) (map[string]string, error) {
+	context, err := json.MarshalIndent(natsContext{
+		Description:     fmt.Sprintf("NATS Tower user '%s' of account '%s'", user, creds.AccountName),
+		URL:             creds.URLs,
+		Creds:           natsContextCredsPath,
+		JetStreamDomain: jetStreamDomain,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]string{
+		"URLS":               creds.URLs,
+		"ACCOUNT_NAME":       creds.AccountName,
+		"ACCOUNT_PUBLIC_KEY": creds.AccountPublicKey,
+		"context.json":       string(context),
+	}
+	if jetStreamDomain != "" {
+		data["JETSTREAM_DOMAIN"] = jetStreamDomain
+	}
+	return data, nil
+}
+
+// UpsertConfigMap writes the companion ConfigMap of a secret. It gets the
+// owners of the secret, so it is not garbage collected while the secret is
+// still in use. Like secrets, ConfigMaps not written by the operator are only
+// taken over if they carry the adopt annotation.
+func (c *NATSTowerOperator) UpsertConfigMap(ctx context.Context,
+	source runtime.Object,
+	namespace, user string,
+	request secretRequest,
+	creds *natstower.ConnectionInfo,
+	ownerRefs []v1.OwnerReference) error {
+	data, err := renderConfigMapData(user,
+		creds,
+		c.towerOperatorConfig.ValidInstallations[request.Installation].JetStreamDomain)
+	if err != nil {
+		return err
+	}
+
+	configMap, err := c.k8sClient.ClientSet.CoreV1().ConfigMaps(namespace).Get(ctx, request.ConfigMap, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Name:            request.ConfigMap,
+				Namespace:       namespace,
+				Labels:          map[string]string{managedByLabelKey: managedByLabelValue},
+				OwnerReferences: addOwnerReferences(nil, ownerRefs),
+			},
+			Data: data,
+		}
+		_, err = c.k8sClient.ClientSet.CoreV1().ConfigMaps(namespace).Create(ctx, configMap, v1.CreateOptions{})
+		if err != nil {
+
+			c.eventRecorder.Eventf(source,
+				corev1.EventTypeWarning,
+				"ErrorUpsertingConfigMap",
+				"Could not create configmap %s/%s: %v",
+				namespace, request.ConfigMap, err)
+
+			return err
+		}
+
+		c.eventRecorder.Eventf(source,
+			corev1.EventTypeNormal,
+			"Created",
+			"Created configmap %s/%s", namespace, request.ConfigMap)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if configMap.Labels[managedByLabelKey] != managedByLabelValue &&
+		configMap.Annotations[natsTowerAdoptAnnotationKey] != "true" {
+		c.eventRecorder.Eventf(source,
+			corev1.EventTypeWarning,
+			"ConfigMapNotManaged",
+			"ConfigMap %s/%s is not managed by the operator, refusing to change it. Annotate it with %s=true to adopt it",
+			namespace, request.ConfigMap, natsTowerAdoptAnnotationKey)
+		return nil
+	}
+
+	if maps.Equal(configMap.Data, data) && hasOwnerReferences(configMap.OwnerReferences, ownerRefs) &&
+		configMap.Labels[managedByLabelKey] == managedByLabelValue {
+		return nil
+	}
+
+	if configMap.Labels == nil {
+		configMap.Labels = map[string]string{}
+	}
+	configMap.Labels[managedByLabelKey] = managedByLabelValue
+	configMap.Data = data
+	configMap.OwnerReferences = addOwnerReferences(configMap.OwnerReferences, ownerRefs)
+	_, err = c.k8sClient.ClientSet.CoreV1().ConfigMaps(namespace).Update(ctx, configMap, v1.UpdateOptions{})
+	if err != nil {
+
+		c.eventRecorder.Eventf(source,
+			corev1.EventTypeWarning,
+			"ErrorUpsertingConfigMap",
+			"Could not update configmap %s/%s: %v",
+			namespace, request.ConfigMap, err)
+
+		return err
+	}
+
+	klog.Infof("ConfigMap[%s] in namespace[%s]: updated", request.ConfigMap, namespace)
+	return nil
+}
+
+// hasConfigMap reports whether the companion ConfigMap of the secret exists
+// and is owned by all owners of the secret and the source. ConfigMaps the
+// operator may not change are left as they are.
+func (c *NATSTowerOperator) hasConfigMap(ctx context.Context,
+	source runtime.Object,
+	secret *corev1.Secret,
+	request secretRequest) (bool, error) {
+	if request.ConfigMap == "" {
+		return true, nil
+	}
+	ownerRef, err := getSecretOwnerReference(source)
+	if err != nil {
+		return false, err
+	}
+
+	configMap, err := c.k8sClient.ClientSet.CoreV1().ConfigMaps(secret.Namespace).Get(ctx, request.ConfigMap, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if configMap.Labels[managedByLabelKey] != managedByLabelValue &&
+		configMap.Annotations[natsTowerAdoptAnnotationKey] != "true" {
+		return true, nil
+	}
+	return hasOwnerReferences(configMap.OwnerReferences, secret.OwnerReferences) &&
+		hasOwnerReference(configMap.OwnerReferences, ownerRef), nil
+}
@@ -0,0 +1,125 @@
+package application
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (o *testOperator) getConfigMapOrNil(name string) *corev1.ConfigMap {
+	o.t.Helper()
+	configMap, err := o.clientset.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	return configMap
+}
+
+func TestConfigMapFollowsSecret(t *testing.T) {
+	o := newTestOperator(t)
+	annotations := map[string]string{natsTowerConfigMapAnnotationKey: "app-nats"}
+	if err := o.reconcilePod(newTestPod("frontend", nil, annotations)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if len(secret.Data) != 1 || len(secret.Data[secretCredentialsKey]) == 0 {
+		t.Errorf("expected the secret to only hold the credentials, got %v", secret.Data)
+	}
+	if configMap := o.getConfigMapOrNil("app-nats"); configMap == nil || len(configMap.OwnerReferences) != 1 {
+		t.Fatalf("expected the ConfigMap to be owned like the secret, got %+v", configMap)
+	}
+
+	// Another pod shares the secret without changing its content
+	o.cache(testSecretGVR, secret)
+	if err := o.reconcilePod(newTestPod("backend", nil, annotations)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret = o.getSecretOrNil(testNamespace, "app-creds")
+	configMap := o.getConfigMapOrNil("app-nats")
+	if len(secret.OwnerReferences) != 2 || !hasOwnerReferences(configMap.OwnerReferences, secret.OwnerReferences) {
+		t.Errorf("expected the ConfigMap to get the owners of the secret, got %v", configMap.OwnerReferences)
+	}
+
+	// The ConfigMap is deleted
+	err := o.clientset.CoreV1().ConfigMaps(testNamespace).Delete(context.Background(), "app-nats", v1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.cache(testSecretGVR, secret)
+	if err := o.reconcilePod(newTestPod("frontend", nil, annotations)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	configMap = o.getConfigMapOrNil("app-nats")
+	if configMap == nil || configMap.Data["ACCOUNT_NAME"] != testAccount {
+		t.Fatalf("expected the ConfigMap to be recreated, got %+v", configMap)
+	}
+	if !hasOwnerReferences(configMap.OwnerReferences, secret.OwnerReferences) {
+		t.Errorf("expected the recreated ConfigMap to get the owners of the secret, got %v", configMap.OwnerReferences)
+	}
+}
+
+func TestConfigMapAddedToExistingSecret(t *testing.T) {
+	o := newTestOperator(t)
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	pod := newTestPod("frontend", nil, map[string]string{natsTowerConfigMapAnnotationKey: "app-nats"})
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.getConfigMapOrNil("app-nats") == nil {
+		t.Fatal("expected the ConfigMap to be created")
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if len(secret.Data) != 1 || len(secret.Data[secretCredentialsKey]) == 0 {
+		t.Errorf("expected the connection info to be moved to the ConfigMap, got %v", secret.Data)
+	}
+}
+
+func TestConfigMapKeepsSecretKeysOnRequest(t *testing.T) {
+	o := newTestOperator(t)
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	pod := newTestPod("frontend", nil, map[string]string{
+		natsTowerConfigMapAnnotationKey:         "app-nats",
+		natsTowerConfigMapKeepKeysAnnotationKey: "true",
+	})
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.getConfigMapOrNil("app-nats") == nil {
+		t.Fatal("expected the ConfigMap to be created")
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if len(secret.Data["URLS"]) == 0 || len(secret.Data["ACCOUNT_NAME"]) == 0 {
+		t.Errorf("expected workloads reading the secret to keep their keys, got %v", secret.Data)
+	}
+	if secret.Annotations[natsTowerConfigMapKeepKeysAnnotationKey] != "true" {
+		t.Error("expected the request to keep the keys to be recorded on the secret")
+	}
+}
+
+func TestConfigMapKeepKeysRequiresBoolean(t *testing.T) {
+	o := newTestOperator(t)
+	pod := newTestPod("frontend", nil, map[string]string{
+		natsTowerConfigMapAnnotationKey:         "app-nats",
+		natsTowerConfigMapKeepKeysAnnotationKey: "yes",
+	})
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := o.events(); !hasEvent(events, "InvalidConfigMap") {
+		t.Errorf("expected an InvalidConfigMap event, got %v", events)
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected no secret for an invalid request")
+	}
+}
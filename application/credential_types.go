@@ -0,0 +1,260 @@
+package application
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// Credential types of generated secrets
+const (
+	credentialTypeUser      = "user"
+	credentialTypeLeafnode  = "leafnode"
+	credentialTypeBearer    = "bearer"
+	credentialTypeWebsocket = "websocket"
+	credentialTypeMQTT      = "mqtt"
+)
+
+// podCredentialTypes are the credential types pods can request. NACK
+// Accounts only support plain users.
+var podCredentialTypes = []string{
+	credentialTypeUser,
+	credentialTypeLeafnode,
+	credentialTypeBearer,
+	credentialTypeWebsocket,
+	credentialTypeMQTT,
+}
+
+// Secret keys of the credential types with a fixed layout
+const (
+	leafnodeConfigKey = "leafnode.conf"
+	bearerTokenKey    = "token"
+)
+
+// natsTowerExpiresAnnotationKey records on the secret when its JWT expires
+const natsTowerExpiresAnnotationKey = "nats-tower.com/nats-tower-expires"
+
+// mqttDefaultPort is the port of MQTT URLs without one.
+const mqttDefaultPort = "1883"
+
+// credentialTypeConnectionTypes restricts the users of a credential type to
+// the given NATS connection types.
+var credentialTypeConnectionTypes = map[string][]string{
+	credentialTypeLeafnode:  {"LEAFNODE"},
+	credentialTypeBearer:    {"WEBSOCKET"},
+	credentialTypeWebsocket: {"WEBSOCKET"},
+	credentialTypeMQTT:      {"MQTT"},
+}
+
+// getCredentialType resolves the credential type label of the requesting
+// object, which must be one of the allowed types.
+func getCredentialType(labels map[string]string, allowed []string) (string, error) {
+	credentialType := labels[natsTowerCredentialTypeLabelKey]
+	if credentialType == "" {
+		return credentialTypeUser, nil
+	}
+	if !slices.Contains(allowed, credentialType) {
+		return "", fmt.Errorf("credential type '%s' must be one of %s",
+			credentialType, strings.Join(allowed, ", "))
+	}
+	return credentialType, nil
+}
+
+// getCredentialTypeURLs returns the URLs the users of a credential type
+// connect to. An empty string means the client URLs of NATS Tower are used.
+func getCredentialTypeURLs(installation config.Installation, credentialType string) (string, error) {
+	switch credentialType {
+	case credentialTypeLeafnode:
+		if installation.LeafnodeURLs == "" {
+			return "", fmt.Errorf("installation has no leafnode_urls configured")
+		}
+		return installation.LeafnodeURLs, nil
+	case credentialTypeBearer, credentialTypeWebsocket:
+		if installation.WebsocketURLs == "" {
+			return "", fmt.Errorf("installation has no websocket_urls configured")
+		}
+		return installation.WebsocketURLs, nil
+	case credentialTypeMQTT:
+		if installation.MQTTURLs == "" {
+			return "", fmt.Errorf("installation has no mqtt_urls configured")
+		}
+		return installation.MQTTURLs, nil
+	default:
+		return "", nil
+	}
+}
+
+// setCredentialTypeOptions applies the restrictions of a credential type to
+// the options of its user.
+func setCredentialTypeOptions(credentialType string, opts *natstower.UserOptions) {
+	if connectionTypes := credentialTypeConnectionTypes[credentialType]; len(connectionTypes) > 0 {
+		opts.AllowedConnectionTypes = connectionTypes
+	}
+	// MQTT clients can not sign the nonce of the server, they pass the JWT as
+	// password
+	opts.BearerToken = credentialType == credentialTypeBearer || credentialType == credentialTypeMQTT
+}
+
+// setBearerTokenExpiry limits the validity of bearer tokens, which can be
+// used by anyone holding them. They are renewed after half of their TTL. An
+// earlier expiry, e.g. of a Job, is kept and not renewed.
+func setBearerTokenExpiry(credentialType string, ttl time.Duration, opts *natstower.UserOptions) {
+	if credentialType != credentialTypeBearer {
+		return
+	}
+	expires := time.Now().Add(ttl)
+	if !opts.Expires.IsZero() && opts.Expires.Before(expires) {
+		return
+	}
+	opts.Expires = expires
+	opts.RenewBefore = ttl / 2
+}
+
+// getCredsExpiry returns when the JWT of the creds expires, zero if it does
+// not expire.
+func getCredsExpiry(creds string) time.Time {
+	jwt, _ := parseCreds(creds)
+	_, payload, ok := strings.Cut(jwt, ".")
+	if !ok {
+		return time.Time{}
+	}
+	payload, _, _ = strings.Cut(payload, ".")
+	content, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Expires int64 `json:"exp"`
+	}
+	if json.Unmarshal(content, &claims) != nil || claims.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Expires, 0)
+}
+
+// formatExpiry records the expiry of credentials on their secret.
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return expires.UTC().Format(time.RFC3339)
+}
+
+// secretNeedsRenewal reports whether the credentials of the secret expire
+// within renewBefore. Secrets without a recorded expiry need one.
+func secretNeedsRenewal(secret *corev1.Secret, renewBefore time.Duration) bool {
+	if renewBefore <= 0 {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, secret.Annotations[natsTowerExpiresAnnotationKey])
+	return err != nil || time.Until(expires) < renewBefore
+}
+
+// requeueForRenewal schedules the next reconcile once expiring credentials
+// must be renewed.
+func requeueForRenewal(err error, expires time.Time, renewBefore time.Duration) error {
+	if err != nil || renewBefore <= 0 || expires.IsZero() {
+		return err
+	}
+	return k8s.RequeueAfter(max(time.Until(expires.Add(-renewBefore)), time.Second), nil)
+}
+
+// checkCredentialTypeOutputFormat validates that the output format can be
+// used with the credential type. Credential types other than user have a
+// fixed layout, which can only be replaced by a template.
+func checkCredentialTypeOutputFormat(credentialType, outputFormat string) error {
+	if credentialType == credentialTypeUser {
+		return nil
+	}
+	switch outputFormat {
+	case outputFormatCreds, outputFormatTemplate:
+		return nil
+	default:
+		return fmt.Errorf("output format '%s' is not supported for credential type '%s', must be one of %s",
+			outputFormat, credentialType, strings.Join([]string{outputFormatCreds, outputFormatTemplate}, ", "))
+	}
+}
+
+// renderCredentialTypeData renders the fixed layout of credential types other
+// than user. It returns false for credential types without one.
+func renderCredentialTypeData(credentialType, user string, creds *natstower.ConnectionInfo, jwt string) (map[string][]byte, bool) {
+	switch credentialType {
+	case credentialTypeLeafnode:
+		return map[string][]byte{
+			secretCredentialsKey: []byte(creds.Creds),
+			"LEAFNODE_URLS":      []byte(creds.URLs),
+			leafnodeConfigKey:    []byte(renderLeafnodeConfig(creds)),
+		}, true
+	case credentialTypeBearer:
+		// Bearer tokens are handed to browsers, the seed stays out of the secret
+		return map[string][]byte{
+			bearerTokenKey:   []byte(jwt),
+			"WEBSOCKET_URLS": []byte(creds.URLs),
+			"ACCOUNT_NAME":   []byte(creds.AccountName),
+		}, true
+	case credentialTypeWebsocket:
+		return map[string][]byte{
+			secretCredentialsKey: []byte(creds.Creds),
+			"WEBSOCKET_URLS":     []byte(creds.URLs),
+			"ACCOUNT_NAME":       []byte(creds.AccountName),
+		}, true
+	case credentialTypeMQTT:
+		host, port := getMQTTHostPort(creds.URLs)
+		return map[string][]byte{
+			"MQTT_URLS":     []byte(creds.URLs),
+			"MQTT_HOST":     []byte(host),
+			"MQTT_PORT":     []byte(port),
+			"MQTT_USERNAME": []byte(user),
+			"MQTT_PASSWORD": []byte(jwt),
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// renderLeafnodeConfig renders a nats-server leafnode remote referencing the
+// creds mounted from the secret.
+func renderLeafnodeConfig(creds *natstower.ConnectionInfo) string {
+	urls := []string{}
+	for _, url := range strings.Split(creds.URLs, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, fmt.Sprintf("%q", url))
+		}
+	}
+
+	var conf strings.Builder
+	conf.WriteString("leafnodes {\n")
+	conf.WriteString("  remotes = [\n")
+	conf.WriteString("    {\n")
+	fmt.Fprintf(&conf, "      urls: [%s]\n", strings.Join(urls, ", "))
+	fmt.Fprintf(&conf, "      credentials: %q\n", natsContextCredsPath)
+	conf.WriteString("    }\n")
+	conf.WriteString("  ]\n")
+	conf.WriteString("}\n")
+	return conf.String()
+}
+
+// getMQTTHostPort returns the host and port of the first MQTT URL, which
+// many MQTT clients expect instead of a URL.
+func getMQTTHostPort(urls string) (string, string) {
+	first, _, _ := strings.Cut(urls, ",")
+	first = strings.TrimSpace(first)
+	if _, address, ok := strings.Cut(first, "://"); ok {
+		first = address
+	}
+	host, port, err := net.SplitHostPort(first)
+	if err != nil {
+		return first, mqttDefaultPort
+	}
+	return host, port
+}
@@ -0,0 +1,226 @@
+package application
+
+import (
+	"context"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// getJobHandler revokes the users of the pods of finished Jobs with the pod
+// user scope after the configured TTL. Users shared by the runs of a Job,
+// e.g. of a CronJob, are revoked with their secret once all Jobs owning it
+// finished at least the TTL ago.
+func getJobHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj batchv1.Job) error {
+	return func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj batchv1.Job) error {
+		secretName := obj.Spec.Template.Labels[natsTowerSecretLabelKey]
+		if secretName == "" {
+			return nil
+		}
+
+		klog.Infof("Job[deleted=%t]: %s - %s", req.Deleted, obj.Name, req.Key)
+
+		if req.Deleted {
+			// The users are revoked with the pods of the Job, or with the
+			// secret once the garbage collector removed it
+			return nil
+		}
+
+		finishedAt, finished := getJobFinishTime(&obj)
+		if !finished {
+			return nil
+		}
+
+		ttl := time.Minute * time.Duration(natsTowerOperator.towerOperatorConfig.JobCredentialsTTL)
+		if remaining := time.Until(finishedAt.Add(ttl)); remaining > 0 {
+			return k8s.RequeueAfter(remaining, nil)
+		}
+
+		if obj.Spec.Template.Annotations[natsTowerUserScopeAnnotationKey] != userScopePod {
+			return natsTowerOperator.revokeSharedJobCredentials(ctx, &obj, secretName)
+		}
+		return natsTowerOperator.revokeJobCredentials(ctx, &obj, secretName)
+	}
+}
+
+// getJobFinishTime returns when the Job completed or failed.
+func getJobFinishTime(job *batchv1.Job) (time.Time, bool) {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) &&
+			condition.Status == corev1.ConditionTrue {
+			return condition.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// getJobCredentialsExpiry returns the end of the active deadline of the Job
+// of a pod, or of the pod itself, which is when the user of the pod can
+// expire.
+func (c *NATSTowerOperator) getJobCredentialsExpiry(pod *corev1.Pod) time.Time {
+	if controllerRef := v1.GetControllerOf(pod); controllerRef != nil && controllerRef.Kind == "Job" {
+		job, err := c.jobController.Get(pod.Namespace, controllerRef.Name)
+		if err == nil && job.Spec.ActiveDeadlineSeconds != nil {
+			start := job.CreationTimestamp.Time
+			if job.Status.StartTime != nil {
+				start = job.Status.StartTime.Time
+			}
+			return start.Add(time.Duration(*job.Spec.ActiveDeadlineSeconds) * time.Second)
+		}
+	}
+
+	if pod.Spec.ActiveDeadlineSeconds != nil {
+		return pod.CreationTimestamp.Add(time.Duration(*pod.Spec.ActiveDeadlineSeconds) * time.Second)
+	}
+
+	return time.Time{}
+}
+
+// revokeJobCredentials removes the users of the pods of a finished Job from
+// NATS Tower and their keys from the secret.
+func (c *NATSTowerOperator) revokeJobCredentials(ctx context.Context, job *batchv1.Job, secretName string) error {
+	secret, err := c.secretController.Get(job.Namespace, secretName)
+	if errors.IsNotFound(err) {
+		// Deleted with the Job, the users are revoked with its pods
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pods, err := c.podController.List(job.Namespace, labels.SelectorFromSet(labels.Set{natsTowerSecretLabelKey: secretName}))
+	if err != nil {
+		return err
+	}
+
+	revoked := 0
+	for i := range pods {
+		pod := &pods[i]
+		controllerRef := v1.GetControllerOf(pod)
+		if controllerRef == nil || controllerRef.UID != job.UID {
+			continue
+		}
+		if _, ok := secret.Data[getPodCredentialsKey(pod.Name)]; !ok {
+			// Already revoked
+			continue
+		}
+		request, ok := c.getPodSecretRequest(pod)
+		if !ok || request.UserScope != userScopePod {
+			continue
+		}
+
+		err = c.revokePodUser(ctx, pod, request.Installation, request.Account, secretName)
+		if err != nil {
+
+			c.eventRecorder.Eventf(job,
+				corev1.EventTypeWarning,
+				"ErrorRemovingUserAuth",
+				"Could not remove the user of pod %s/%s from NATS Tower: %v",
+				job.Namespace, pod.Name, err)
+
+			return err
+		}
+		revoked++
+	}
+	if revoked == 0 {
+		return nil
+	}
+
+	c.eventRecorder.Eventf(job,
+		corev1.EventTypeNormal,
+		"CredentialsRevoked",
+		"Revoked the credentials of %d pods in secret %s/%s after the Job finished", revoked, job.Namespace, secretName)
+	return nil
+}
+
+// revokeSharedJobCredentials removes the user shared by the runs of a Job from
+// NATS Tower and deletes its secret once every Job owning the secret finished
+// at least the TTL ago. Secrets also owned by other workloads are kept.
+func (c *NATSTowerOperator) revokeSharedJobCredentials(ctx context.Context, job *batchv1.Job, secretName string) error {
+	// Runs started in the meantime may be missing from the cached owners
+	secret, err := c.k8sClient.ClientSet.CoreV1().Secrets(job.Namespace).Get(ctx, secretName, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isManagedSecret(secret) || secret.Annotations[natsTowerUserScopeAnnotationKey] == userScopePod ||
+		!hasOwnerReference(secret.OwnerReferences, v1.OwnerReference{UID: job.UID}) {
+		return nil
+	}
+
+	ttl := time.Minute * time.Duration(c.towerOperatorConfig.JobCredentialsTTL)
+	var remaining time.Duration
+	for _, owner := range secret.OwnerReferences {
+		if owner.Kind != "Job" {
+			return nil
+		}
+		other, err := c.jobController.Get(job.Namespace, owner.Name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if other.UID != owner.UID {
+			continue
+		}
+		finishedAt, finished := getJobFinishTime(other)
+		if !finished {
+			// Revoked once the last run finished
+			return nil
+		}
+		remaining = max(remaining, time.Until(finishedAt.Add(ttl)))
+	}
+	if remaining > 0 {
+		return k8s.RequeueAfter(remaining, nil)
+	}
+
+	// A new run adding itself as owner in the meantime keeps the secret
+	err = c.k8sClient.ClientSet.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, v1.DeleteOptions{
+		Preconditions: &v1.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion},
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	c.forgetRefreshed(secret.Namespace, secret.Name)
+
+	if !hasSecretDrifted(secret) {
+		err = c.natsTowerClient.RemoveUserAuth(ctx,
+			secret.Namespace,
+			secret.Annotations[natsTowerInstallationLabelKey],
+			secret.Annotations[natsTowerAccountLabelKey],
+			secret.Annotations[natsTowerUserAnnotationKey])
+		if err != nil && err != natstower.ErrUserNotOwned {
+
+			c.eventRecorder.Eventf(job,
+				corev1.EventTypeWarning,
+				"ErrorRemovingUserAuth",
+				"Could not remove the user of secret %s/%s from NATS Tower: %v",
+				job.Namespace, secretName, err)
+
+			// The secret is gone, its deletion retries the removal
+			return nil
+		}
+		err = c.removeGeneratedRole(ctx, secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.eventRecorder.Eventf(job,
+		corev1.EventTypeNormal,
+		"CredentialsRevoked",
+		"Revoked the shared credentials of secret %s/%s after its Jobs finished", job.Namespace, secretName)
+	return nil
+}
@@ -0,0 +1,192 @@
+package application
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+func newTestJob(name string, annotations map[string]string) *batchv1.Job {
+	deadline := int64(600)
+	return &batchv1.Job{
+		TypeMeta: v1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			UID:       types.UID(name + "-uid"),
+			Labels:    map[string]string{natsTowerSecretLabelKey: "app-creds"},
+		},
+		Spec: batchv1.JobSpec{
+			ActiveDeadlineSeconds: &deadline,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{
+					Labels:      map[string]string{natsTowerSecretLabelKey: "app-creds"},
+					Annotations: annotations,
+				},
+			},
+		},
+	}
+}
+
+// newTestJobPod returns a pod of the Job.
+func newTestJobPod(job *batchv1.Job, name string) *corev1.Pod {
+	controller := true
+	pod := newTestPod(name, nil, job.Spec.Template.Annotations)
+	pod.OwnerReferences = []v1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job",
+		Name: job.Name, UID: job.UID, Controller: &controller}}
+	return pod
+}
+
+// finishTestJob marks the Job as completed at the given time and runs the
+// Job handler.
+func (o *testOperator) finishTestJob(job *batchv1.Job, finishedAt time.Time) error {
+	job.Status.Conditions = []batchv1.JobCondition{{
+		Type:               batchv1.JobComplete,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: v1.Time{Time: finishedAt},
+	}}
+	o.cache(testJobGVR, job)
+	return getJobHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: job.Namespace + "/" + job.Name}, *job)
+}
+
+func TestJobPodUsersExpireAndAreRevoked(t *testing.T) {
+	o := newTestOperator(t)
+	job := newTestJob("report", map[string]string{natsTowerUserScopeAnnotationKey: userScopePod})
+	o.cache(testJobGVR, job)
+	pod := newTestJobPod(job, "report-x7k2p")
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	users := o.tower.find("nats_auth_users", map[string]string{"name": "app-creds-report-x7k2p"})
+	if len(users) != 1 || users[0]["expires"] == nil {
+		t.Fatalf("expected the user of the pod to expire with the Job, got %+v", users)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	// Within the TTL the credentials are kept
+	err := o.finishTestJob(job, time.Now())
+	if requeuedAfter(err) == 0 || !o.hasTowerUser("app-creds-report-x7k2p") {
+		t.Fatalf("expected the revocation to be scheduled, got %v", err)
+	}
+
+	pod.Status.Phase = corev1.PodSucceeded
+	o.cache(testPodGVR, pod)
+	if err := o.finishTestJob(job, time.Now().Add(-6*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.hasTowerUser("app-creds-report-x7k2p") {
+		t.Error("expected the user of the pod to be revoked")
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if _, ok := secret.Data["report-x7k2p.creds"]; ok {
+		t.Error("expected the key of the pod to be removed")
+	}
+	if !hasEvent(o.events(), "CredentialsRevoked") {
+		t.Error("expected a CredentialsRevoked event")
+	}
+
+	// Revoking again is a no-op
+	o.cache(testSecretGVR, secret)
+	if err := o.finishTestJob(job, time.Now().Add(-6*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hasEvent(o.events(), "CredentialsRevoked") {
+		t.Error("expected the credentials to be revoked only once")
+	}
+}
+
+func TestJobSharedUserOutlivesRuns(t *testing.T) {
+	o := newTestOperator(t)
+	first := newTestJob("report-28371", nil)
+	second := newTestJob("report-28372", nil)
+	o.cache(testJobGVR, first)
+	o.cache(testJobGVR, second)
+
+	if err := o.reconcilePod(newTestJobPod(first, "report-28371-abcde")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	if err := o.reconcilePod(newTestJobPod(second, "report-28372-fghij")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	users := o.tower.find("nats_auth_users", map[string]string{"name": "app-creds"})
+	if len(users) != 1 || users[0]["expires"] != nil {
+		t.Fatalf("expected the shared user not to expire with a run, got %+v", users)
+	}
+
+	// The first run finished long ago, the second one still uses the user
+	if err := o.finishTestJob(first, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !o.hasTowerUser("app-creds") || o.getSecretOrNil(testNamespace, "app-creds") == nil {
+		t.Error("expected the shared user and secret to be kept")
+	}
+}
+
+func TestJobSharedUserRevokedAfterLastRun(t *testing.T) {
+	o := newTestOperator(t)
+	first := newTestJob("report-28371", nil)
+	second := newTestJob("report-28372", nil)
+	o.cache(testJobGVR, first)
+	o.cache(testJobGVR, second)
+
+	if err := o.reconcilePod(newTestJobPod(first, "report-28371-abcde")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	if err := o.reconcilePod(newTestJobPod(second, "report-28372-fghij")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	if err := o.finishTestJob(first, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The last run finished, the credentials are kept for the TTL
+	err := o.finishTestJob(second, time.Now())
+	if requeuedAfter(err) == 0 || !o.hasTowerUser("app-creds") {
+		t.Fatalf("expected the revocation to be scheduled, got %v", err)
+	}
+
+	if err := o.finishTestJob(second, time.Now().Add(-6*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.hasTowerUser("app-creds") {
+		t.Error("expected the shared user to be revoked")
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected the secret to be deleted")
+	}
+	if !hasEvent(o.events(), "CredentialsRevoked") {
+		t.Error("expected a CredentialsRevoked event")
+	}
+}
+
+func TestJobSharedUserKeptForOtherWorkloads(t *testing.T) {
+	o := newTestOperator(t)
+	job := newTestJob("migrate", nil)
+	o.cache(testJobGVR, job)
+	if err := o.reconcilePod(newTestJobPod(job, "migrate-abcde")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	if err := o.finishTestJob(job, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !o.hasTowerUser("app-creds") || o.getSecretOrNil(testNamespace, "app-creds") == nil {
+		t.Error("expected the user and secret shared with a pod to be kept")
+	}
+}
@@ -2,12 +2,17 @@ package application
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"slices"
+	"time"
 
 	nackapi "github.com/nats-io/nack/pkg/jetstream/apis/jetstream/v1beta2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
@@ -15,172 +20,449 @@ import (
 	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
 )
 
-func getNACKAccountHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, ev k8s.EventItem, obj nackapi.Account) error {
-	return func(ctx context.Context, informer cache.SharedIndexInformer, ev k8s.EventItem, obj nackapi.Account) error {
-		klog.Infof("NACK Account[%s]: %s - %s", ev.ActionType, obj.Name, ev.Key)
+func getNACKAccountHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj nackapi.Account) error {
+	return func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj nackapi.Account) error {
+		klog.Infof("NACK Account[deleted=%t]: %s - %s", req.Deleted, obj.Name, req.Key)
 
-		// 1. check if annotated with nats.tower/secret
-		// 2. check if a secret is defined in the annotation nats.tower/secret
-		if obj.Labels == nil {
-			return nil
-		}
-		if obj.Labels[natsTowerSecretLabelKey] == "" {
-			return nil
+		if req.Deleted {
+			// The watch only sees accounts with the secret label, so an
+			// account whose label was removed looks deleted. Its finalizer
+			// must be released while it is still known what to clean up.
+			return natsTowerOperator.releaseUnlabelledNACKAccount(ctx, &obj)
 		}
 
-		installationPublicKey := obj.Labels[natsTowerInstallationLabelKey]
-
-		if installationPublicKey == "" && natsTowerOperator.towerOperatorConfig.DefaultInstallation == "" {
-			// Record event as we require the label
-			natsTowerOperator.eventRecorder.Eventf(&obj,
-				corev1.EventTypeWarning,
-				"MissingInstallationLabel",
-				"Require label %s to generate secret", natsTowerInstallationLabelKey)
-			return nil
+		if obj.DeletionTimestamp != nil {
+			return natsTowerOperator.finalizeNACKAccount(ctx, &obj)
 		}
 
-		if installationPublicKey == "" {
-			installationPublicKey = natsTowerOperator.towerOperatorConfig.DefaultInstallation
-			natsTowerOperator.eventRecorder.Eventf(&obj,
-				corev1.EventTypeNormal,
-				"DefaultInstallation",
-				"Will use default installation %s to generate secret",
-				natsTowerOperator.towerOperatorConfig.DefaultInstallation)
-		} else {
-			_, ok := natsTowerOperator.towerOperatorConfig.ValidInstallations[installationPublicKey]
-
-			if !ok {
-				// Record event as we require valid label value
-				natsTowerOperator.eventRecorder.Eventf(&obj,
-					corev1.EventTypeWarning,
-					"InvalidInstallationLabel",
-					"Require label %s to be one of %+v to generate secret",
-					natsTowerInstallationLabelKey,
-					natsTowerOperator.towerOperatorConfig.ValidInstallations)
-				return nil
-			}
+		// 1. check if annotated with nats.tower/secret
+		// 2. check if a secret is defined in the annotation nats.tower/secret
+		if obj.Labels == nil || obj.Labels[natsTowerSecretLabelKey] == "" {
+			// No longer managed, release the finalizer if it was added before
+			return natsTowerOperator.removeNACKAccountFinalizer(ctx, &obj)
 		}
 
-		if ev.ActionType == k8s.DeleteAction {
-			// Do nothing on account deletes
+		request, ok := natsTowerOperator.getNACKAccountSecretRequest(&obj)
+		if !ok {
 			return nil
 		}
 
-		// 3. check which type of credentials is required
-		credentialType := "user"
-		if obj.Labels[natsTowerCredentialTypeLabelKey] != "" {
-			credentialType = obj.Labels[natsTowerCredentialTypeLabelKey]
-		}
-
-		switch credentialType {
-		case "user":
-		default:
-			credentialType = "user"
+		if !slices.Contains(obj.Finalizers, natsTowerCleanupFinalizer) {
+			// The update of the account triggers a new reconcile
+			return natsTowerOperator.patchNACKAccountFinalizers(ctx, &obj,
+				append(slices.Clone(obj.Finalizers), natsTowerCleanupFinalizer))
 		}
 
 		var creds *natstower.ConnectionInfo
 
 		// 4. check if secret is defined in the same namespace as the pod
-		secret, err := natsTowerOperator.k8sClient.ClientSet.CoreV1().Secrets(obj.Namespace).Get(ctx,
-			obj.Labels[natsTowerSecretLabelKey], v1.GetOptions{})
+		secret, err := natsTowerOperator.getSecret(ctx, obj.Namespace, obj.Labels[natsTowerSecretLabelKey])
 		if err != nil {
 			if errors.IsNotFound(err) {
 				klog.Infof("Secret[%s] not found in namespace[%s]",
 					obj.Labels[natsTowerSecretLabelKey], obj.Namespace)
 
-				switch credentialType {
-				case "user":
-					creds, err = natsTowerOperator.natsTowerClient.CreateOrGetUserAuth(ctx,
-						obj.Namespace,
-						installationPublicKey,
-						obj.Name, // account name is the same as the NACK account name
-						obj.Labels[natsTowerSecretLabelKey],
-						getNACKAccountUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
-						natstower.UserOptions{})
-
-					if err == natstower.ErrK8sAccessNotAllowed {
-
-						natsTowerOperator.eventRecorder.Eventf(&obj,
-							corev1.EventTypeWarning,
-							"ErrorK8sAccessNotAllowed",
-							"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
-							obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, obj.Name)
-
-						return err
-					}
-
-					if err != nil {
-
-						natsTowerOperator.eventRecorder.Eventf(&obj,
-							corev1.EventTypeWarning,
-							"ErrorCreatingUserAuth",
-							"Could not CreateOrGetUserAuth to create new secret:%v", err)
-
-						return err
-					}
-				default:
-					return fmt.Errorf("invalid credential type: %s - must be 'user'", credentialType)
+				creds, err = natsTowerOperator.getUserAuth(ctx,
+					obj.Namespace,
+					obj.Labels[natsTowerSecretLabelKey],
+					obj.Labels[natsTowerSecretLabelKey],
+					getNACKAccountUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
+					request,
+					natstower.UserOptions{})
+
+				if err == natstower.ErrK8sAccessNotAllowed {
+
+					natsTowerOperator.eventRecorder.Eventf(&obj,
+						corev1.EventTypeWarning,
+						"ErrorK8sAccessNotAllowed",
+						"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
+						obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, obj.Name)
+
+					return err
+				}
+				if err == natstower.ErrUserNotOwned {
+
+					natsTowerOperator.eventRecorder.Eventf(&obj,
+						corev1.EventTypeWarning,
+						"UserNotOwned",
+						"The user of secret %s/%s belongs to another namespace on NATS Tower, pick another secret name",
+						obj.Namespace, obj.Labels[natsTowerSecretLabelKey])
+
+					return nil
 				}
 
-				return natsTowerOperator.UpsertSecret(ctx,
+				if err != nil {
+
+					natsTowerOperator.eventRecorder.Eventf(&obj,
+						corev1.EventTypeWarning,
+						"ErrorCreatingUserAuth",
+						"Could not CreateOrGetUserAuth to create new secret:%v", err)
+
+					return err
+				}
+
+				err = natsTowerOperator.UpsertSecret(ctx,
 					&obj,
 					obj.Namespace,
 					obj.Labels[natsTowerSecretLabelKey],
-					credentialType,
+					request,
 					creds,
 					nil)
+				return natsTowerOperator.requeueForRefresh(err, obj.Annotations, obj.Namespace, obj.Labels[natsTowerSecretLabelKey])
 			}
 			klog.Errorf("Secret[%s] not found in namespace[%s]:%T - %v",
 				obj.Labels[natsTowerSecretLabelKey], obj.Namespace, err, err)
 			return err
 		}
 
-		switch credentialType {
-		case "user":
-			// 4a. check if secret has a key named {secretCredentialsKey}
-			if secret.Data[secretCredentialsKey] != nil && string(secret.Data[secretCredentialsKey]) != "" {
-				return nil
-			}
-			creds, err = natsTowerOperator.natsTowerClient.CreateOrGetUserAuth(ctx,
+		if !natsTowerOperator.canManageSecret(&obj, secret) ||
+			natsTowerOperator.hasSecretConflict(ctx, &obj, secret, request) {
+			return nil
+		}
+
+		hasConfigMap, err := natsTowerOperator.hasConfigMap(ctx, &obj, secret, request)
+		if err != nil {
+			return err
+		}
+
+		// 4a. check if secret already has credentials in the requested format
+		// Only refresh the connection info from NATS Tower if changes should restart the workloads
+		// and it was not refreshed recently, or the ConfigMap is missing
+		if hasConfigMap && len(secret.Data) > 0 && isManagedSecret(secret) && secretHasOutputFormat(secret, request) &&
+			(obj.Annotations[natsTowerRestartOnChangeAnnotationKey] != "true" || !natsTowerOperator.refreshDue(secret)) {
+			return natsTowerOperator.requeueForRefresh(natsTowerOperator.EnsureSecretOwner(ctx, &obj, secret),
+				obj.Annotations, obj.Namespace, obj.Labels[natsTowerSecretLabelKey])
+		}
+		creds, err = natsTowerOperator.getUserAuth(ctx,
+			obj.Namespace,
+			obj.Labels[natsTowerSecretLabelKey],
+			obj.Labels[natsTowerSecretLabelKey],
+			getNACKAccountUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
+			request,
+			natstower.UserOptions{})
+
+		if err == natstower.ErrK8sAccessNotAllowed {
+
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"ErrorK8sAccessNotAllowed",
+				"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
+				obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, obj.Name)
+
+			return err
+		}
+		if err == natstower.ErrUserNotOwned {
+
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"UserNotOwned",
+				"The user of secret %s/%s belongs to another namespace on NATS Tower, pick another secret name",
+				obj.Namespace, obj.Labels[natsTowerSecretLabelKey])
+
+			return nil
+		}
+
+		if err != nil {
+
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"ErrorCreatingUserAuth",
+				"Could not CreateOrGetUserAuth to update secret:%v", err)
+
+			return err
+		}
+
+		if secretHasContent(secret, &obj, obj.Labels[natsTowerSecretLabelKey], request, creds) {
+			err = natsTowerOperator.EnsureSecretAndConfigMapOwner(ctx, &obj, secret, request, creds)
+		} else {
+			err = natsTowerOperator.UpsertSecret(ctx,
+				&obj,
 				obj.Namespace,
-				installationPublicKey,
-				obj.Name, // account name is the same as the NACK account name
 				obj.Labels[natsTowerSecretLabelKey],
-				getNACKAccountUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
-				natstower.UserOptions{})
+				request,
+				creds,
+				secret)
+		}
+		return natsTowerOperator.requeueForRefresh(err, obj.Annotations, obj.Namespace, obj.Labels[natsTowerSecretLabelKey])
+	}
+}
 
-			if err == natstower.ErrK8sAccessNotAllowed {
+// getNACKAccountSecretRequest resolves the request of the secret of a NACK
+// Account from its labels and annotations. Missing or invalid values are
+// recorded as events on the account.
+func (c *NATSTowerOperator) getNACKAccountSecretRequest(acc *nackapi.Account) (secretRequest, bool) {
+	installationPublicKey := acc.Labels[natsTowerInstallationLabelKey]
 
-				natsTowerOperator.eventRecorder.Eventf(&obj,
-					corev1.EventTypeWarning,
-					"ErrorK8sAccessNotAllowed",
-					"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
-					obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, obj.Name)
+	if installationPublicKey == "" && c.towerOperatorConfig.DefaultInstallation == "" {
+		// Record event as we require the label
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeWarning,
+			"MissingInstallationLabel",
+			"Require label %s to generate secret", natsTowerInstallationLabelKey)
+		return secretRequest{}, false
+	}
+
+	if installationPublicKey == "" {
+		installationPublicKey = c.towerOperatorConfig.DefaultInstallation
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeNormal,
+			"DefaultInstallation",
+			"Will use default installation %s to generate secret",
+			c.towerOperatorConfig.DefaultInstallation)
+	} else {
+		_, ok := c.towerOperatorConfig.ValidInstallations[installationPublicKey]
+
+		if !ok {
+			// Record event as we require valid label value
+			c.eventRecorder.Eventf(acc,
+				corev1.EventTypeWarning,
+				"InvalidInstallationLabel",
+				"Require label %s to be one of %+v to generate secret",
+				natsTowerInstallationLabelKey,
+				c.towerOperatorConfig.InstallationKeys())
+			return secretRequest{}, false
+		}
+	}
+
+	// 3. check which type of credentials is required
+	credentialType, err := getCredentialType(acc.Labels, []string{credentialTypeUser})
+	if err != nil {
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeWarning,
+			"InvalidCredentialType",
+			"Invalid label %s: %v", natsTowerCredentialTypeLabelKey, err)
+		return secretRequest{}, false
+	}
+
+	// 3a. check in which format the credentials are written
+	outputFormat, outputTemplate, err := getOutputFormat(acc.Annotations)
+	if err != nil {
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeWarning,
+			"InvalidOutputFormat",
+			"Invalid annotation %s: %v", natsTowerOutputFormatAnnotationKey, err)
+		return secretRequest{}, false
+	}
+
+	configMap, configMapKeepKeys, err := getConfigMapName(acc.Annotations)
+	if err != nil {
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeWarning,
+			"InvalidConfigMap",
+			"Invalid annotation %s: %v", natsTowerConfigMapAnnotationKey, err)
+		return secretRequest{}, false
+	}
+
+	// 3b. check the request against the local policy before asking NATS Tower
+	err = checkPolicy(c.towerOperatorConfig.Policy,
+		acc.Namespace,
+		acc.Name,
+		"",
+		natstower.UserOptions{},
+		c.towerOperatorConfig.ClusterID)
+	if err != nil {
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeWarning,
+			"PolicyDenied",
+			"Denied by policy: %v", err)
+		return secretRequest{}, false
+	}
+
+	return secretRequest{
+		Installation:      installationPublicKey,
+		Account:           acc.Name, // account name is the same as the NACK account name
+		Role:              "",
+		CredentialType:    credentialType,
+		OutputFormat:      outputFormat,
+		OutputTemplate:    outputTemplate,
+		ConfigMap:         configMap,
+		ConfigMapKeepKeys: configMapKeepKeys,
+	}, true
+}
 
-				return err
+// releaseUnlabelledNACKAccount cleans up after an account that is no longer
+// watched. Accounts that are really gone were cleaned up by the finalizer, an
+// account that still exists lost its secret label and is cleaned up with the
+// labels it was last seen with.
+func (c *NATSTowerOperator) releaseUnlabelledNACKAccount(ctx context.Context, last *nackapi.Account) error {
+	content, err := c.k8sClient.DynamicClient.Resource(c.nackAccountGVR).Namespace(last.Namespace).Get(ctx,
+		last.Name, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var current nackapi.Account
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(content.Object, &current)
+	if err != nil {
+		return fmt.Errorf("error converting NACK account %s/%s from unstructured: %v", last.Namespace, last.Name, err)
+	}
+	if current.UID != last.UID || current.Labels[natsTowerSecretLabelKey] != "" {
+		// Replaced by a new account or labelled again, which is reconciled on its own
+		return nil
+	}
+
+	klog.Infof("NACK Account[%s]: secret label removed in namespace[%s], cleaning up", last.Name, last.Namespace)
+	current.Labels = last.Labels
+	return c.finalizeNACKAccount(ctx, &current)
+}
+
+// finalizeNACKAccount removes the user of a deleted or unlabelled NACK
+// account from NATS Tower and deletes its secret before releasing the
+// finalizer. Secrets shared with other owners only lose the owner reference
+// of the account and keep their user. If NATS Tower can not be reached within
+// the finalizer timeout, or the account carries the skip-cleanup annotation,
+// the finalizer is released without cleanup.
+func (c *NATSTowerOperator) finalizeNACKAccount(ctx context.Context, acc *nackapi.Account) error {
+	if !slices.Contains(acc.Finalizers, natsTowerCleanupFinalizer) {
+		return nil
+	}
+
+	secretName := acc.Labels[natsTowerSecretLabelKey]
+
+	if acc.Annotations[natsTowerSkipCleanupAnnotation] == "true" {
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeWarning,
+			"CleanupSkipped",
+			"Skipped removing the user of secret %s/%s from NATS Tower as requested by annotation %s",
+			acc.Namespace, secretName, natsTowerSkipCleanupAnnotation)
+		return c.removeNACKAccountFinalizer(ctx, acc)
+	}
+
+	installationPublicKey := acc.Labels[natsTowerInstallationLabelKey]
+	if installationPublicKey == "" {
+		installationPublicKey = c.towerOperatorConfig.DefaultInstallation
+	}
+
+	if secretName != "" && installationPublicKey != "" {
+		secret, err := c.k8sClient.ClientSet.CoreV1().Secrets(acc.Namespace).Get(ctx, secretName, v1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if !isManagedSecret(secret) {
+				// Not written by the operator, there is no user to remove
+				return c.removeNACKAccountFinalizer(ctx, acc)
 			}
 
-			if err != nil {
+			owners := slices.DeleteFunc(slices.Clone(secret.OwnerReferences), func(ref v1.OwnerReference) bool {
+				return ref.UID == acc.UID
+			})
+			if len(owners) > 0 {
+				// Still used by other owners, only the account lets go of it
+				err = c.removeSecretOwners(ctx, secret, owners)
+				if err != nil {
+					return err
+				}
 
-				natsTowerOperator.eventRecorder.Eventf(&obj,
-					corev1.EventTypeWarning,
-					"ErrorCreatingUserAuth",
-					"Could not CreateOrGetUserAuth to update secret:%v", err)
+				c.eventRecorder.Eventf(acc,
+					corev1.EventTypeNormal,
+					"CleanedUp",
+					"Removed the account from the owners of secret %s/%s, which keeps its user for its other owners",
+					acc.Namespace, secretName)
+				return c.removeNACKAccountFinalizer(ctx, acc)
+			}
+		}
 
-				return err
+		err = c.natsTowerClient.RemoveUserAuth(ctx,
+			acc.Namespace,
+			installationPublicKey,
+			acc.Name, // account name is the same as the NACK account name
+			secretName)
+		if err == natstower.ErrUserNotOwned {
+			klog.Infof("NACK Account[%s]: user of secret %s belongs to another namespace, skip removing it",
+				acc.Name, secretName)
+			err = nil
+		}
+		if err != nil && acc.DeletionTimestamp == nil {
+			// The account was unlabelled, there is no deletion to give up on
+			return err
+		}
+		if err != nil {
+			timeout := time.Minute * time.Duration(c.towerOperatorConfig.FinalizerTimeout)
+			if time.Since(acc.DeletionTimestamp.Time) < timeout {
+				c.eventRecorder.Eventf(acc,
+					corev1.EventTypeWarning,
+					"ErrorRemovingUserAuth",
+					"Could not remove the user of secret %s/%s from NATS Tower, retrying: %v",
+					acc.Namespace, secretName, err)
+				return k8s.RequeueAfter(time.Minute, err)
 			}
-		default:
-			return fmt.Errorf("invalid credential type: %s - must be 'user'", credentialType)
+
+			c.eventRecorder.Eventf(acc,
+				corev1.EventTypeWarning,
+				"CleanupTimeout",
+				"Could not remove the user of secret %s/%s from NATS Tower within %s, giving up: %v",
+				acc.Namespace, secretName, timeout, err)
+		}
+
+		err = c.k8sClient.ClientSet.CoreV1().Secrets(acc.Namespace).Delete(ctx, secretName, v1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
 		}
 
-		// TODO check URLS and restart pod?
+		c.eventRecorder.Eventf(acc,
+			corev1.EventTypeNormal,
+			"CleanedUp",
+			"Removed the user of secret %s/%s from NATS Tower and deleted the secret",
+			acc.Namespace, secretName)
+	}
 
-		return natsTowerOperator.UpsertSecret(ctx,
-			&obj,
-			obj.Namespace,
-			obj.Labels[natsTowerSecretLabelKey],
-			credentialType,
-			creds,
-			secret)
+	return c.removeNACKAccountFinalizer(ctx, acc)
+}
+
+// removeSecretOwners replaces the owner references of the secret with the
+// remaining owners.
+func (c *NATSTowerOperator) removeSecretOwners(ctx context.Context, secret *corev1.Secret, owners []v1.OwnerReference) error {
+	if len(owners) == len(secret.OwnerReferences) {
+		return nil
 	}
+
+	secret.OwnerReferences = owners
+	_, err := c.k8sClient.ClientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, v1.UpdateOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *NATSTowerOperator) removeNACKAccountFinalizer(ctx context.Context, acc *nackapi.Account) error {
+	if !slices.Contains(acc.Finalizers, natsTowerCleanupFinalizer) {
+		return nil
+	}
+
+	finalizers := slices.DeleteFunc(slices.Clone(acc.Finalizers), func(f string) bool {
+		return f == natsTowerCleanupFinalizer
+	})
+
+	return c.patchNACKAccountFinalizers(ctx, acc, finalizers)
+}
+
+// patchNACKAccountFinalizers replaces the finalizers of the account. The
+// resource version is part of the patch, so concurrent changes make it fail
+// and the account is reconciled again.
+func (c *NATSTowerOperator) patchNACKAccountFinalizers(ctx context.Context, acc *nackapi.Account, finalizers []string) error {
+	if finalizers == nil {
+		finalizers = []string{}
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"finalizers":      finalizers,
+			"resourceVersion": acc.ResourceVersion,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.k8sClient.DynamicClient.Resource(c.nackAccountGVR).Namespace(acc.Namespace).Patch(ctx,
+		acc.Name, types.MergePatchType, patch, v1.PatchOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error updating finalizers of NACK account %s/%s: %v", acc.Namespace, acc.Name, err)
+	}
+
+	return nil
 }
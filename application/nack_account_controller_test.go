@@ -0,0 +1,245 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	nackapi "github.com/nats-io/nack/pkg/jetstream/apis/jetstream/v1beta2"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+func newTestNACKAccount() *nackapi.Account {
+	return &nackapi.Account{
+		ObjectMeta: v1.ObjectMeta{
+			Name:       testAccount,
+			Namespace:  testNamespace,
+			UID:        "account-uid",
+			Labels:     map[string]string{natsTowerSecretLabelKey: "app-creds"},
+			Finalizers: []string{natsTowerCleanupFinalizer},
+		},
+	}
+}
+
+func newTestNACKAccountSecret(owners ...v1.OwnerReference) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "app-creds",
+			Namespace: testNamespace,
+			UID:       "secret-uid",
+			Labels: map[string]string{
+				natsTowerSecretLabelKey: "true",
+				managedByLabelKey:       managedByLabelValue,
+			},
+			Annotations: map[string]string{
+				natsTowerInstallationLabelKey: testInstallation,
+				natsTowerAccountLabelKey:      testAccount,
+				natsTowerUserAnnotationKey:    "app-creds",
+			},
+			OwnerReferences: owners,
+		},
+	}
+}
+
+func TestNACKAccountUnlabelledReleasesFinalizer(t *testing.T) {
+	o := newTestOperator(t)
+	last := newTestNACKAccount()
+
+	// The label was removed, the watch delivers the last labelled state as delete
+	current := last.DeepCopy()
+	current.Labels = nil
+	o.createNACKAccount(current)
+	o.createSecret(newTestNACKAccountSecret(v1.OwnerReference{Kind: "Account", Name: testAccount, UID: last.UID}))
+	o.towerUser("app-creds")
+
+	err := getNACKAccountHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/" + testAccount, Deleted: true}, *last)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	acc := o.getNACKAccountOrNil(testNamespace, testAccount)
+	if acc == nil {
+		t.Fatal("expected the account to still exist")
+	}
+	if slices.Contains(acc.Finalizers, natsTowerCleanupFinalizer) {
+		t.Errorf("expected the finalizer to be released, got %v", acc.Finalizers)
+	}
+	if o.hasTowerUser("app-creds") {
+		t.Error("expected the user to be removed from NATS Tower")
+	}
+}
+
+func TestNACKAccountDeletedIsIgnored(t *testing.T) {
+	o := newTestOperator(t)
+	o.towerUser("app-creds")
+
+	err := getNACKAccountHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/" + testAccount, Deleted: true}, *newTestNACKAccount())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Accounts that are really gone were cleaned up by their finalizer
+	if !o.hasTowerUser("app-creds") {
+		t.Error("expected the user to be left alone")
+	}
+}
+
+func TestNACKAccountPolicyDenied(t *testing.T) {
+	o := newTestOperator(t)
+	o.towerOperatorConfig.Policy = &config.Policy{Rules: []config.PolicyRule{{
+		Namespaces: []string{testNamespace},
+		Accounts:   []string{"orders"},
+	}}}
+
+	err := getNACKAccountHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/" + testAccount}, *newTestNACKAccount())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if events := o.events(); !hasEvent(events, "PolicyDenied") {
+		t.Errorf("expected a PolicyDenied event, got %v", events)
+	}
+	if o.hasTowerUser("app-creds") || o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected no credentials for a denied account")
+	}
+}
+
+// finalizeTestNACKAccount creates the deleted account and runs the handler.
+func (o *testOperator) finalizeTestNACKAccount(acc *nackapi.Account) error {
+	o.t.Helper()
+	o.createNACKAccount(acc)
+	return getNACKAccountHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/" + testAccount}, *acc)
+}
+
+func hasNACKAccountFinalizer(acc *nackapi.Account) bool {
+	return acc != nil && slices.Contains(acc.Finalizers, natsTowerCleanupFinalizer)
+}
+
+func TestNACKAccountFinalized(t *testing.T) {
+	o := newTestOperator(t)
+	acc := newTestNACKAccount()
+	acc.DeletionTimestamp = &v1.Time{Time: time.Now()}
+	o.createSecret(newTestNACKAccountSecret(v1.OwnerReference{Kind: "Account", Name: testAccount, UID: acc.UID}))
+	o.towerUser("app-creds")
+
+	if err := o.finalizeTestNACKAccount(acc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.hasTowerUser("app-creds") || o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected the user and the secret of the account to be removed")
+	}
+	if hasNACKAccountFinalizer(o.getNACKAccountOrNil(testNamespace, testAccount)) {
+		t.Error("expected the finalizer to be released")
+	}
+}
+
+func TestNACKAccountFinalizedKeepsSharedSecret(t *testing.T) {
+	o := newTestOperator(t)
+	acc := newTestNACKAccount()
+	acc.DeletionTimestamp = &v1.Time{Time: time.Now()}
+	pod := v1.OwnerReference{Kind: "Pod", Name: "frontend", UID: "frontend-uid"}
+	o.createSecret(newTestNACKAccountSecret(v1.OwnerReference{Kind: "Account", Name: testAccount, UID: acc.UID}, pod))
+	o.towerUser("app-creds")
+
+	if err := o.finalizeTestNACKAccount(acc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if secret == nil || len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != pod.UID {
+		t.Fatalf("expected the secret to only lose the account as owner, got %+v", secret)
+	}
+	if !o.hasTowerUser("app-creds") {
+		t.Error("expected the user of the other owners to be kept")
+	}
+	if hasNACKAccountFinalizer(o.getNACKAccountOrNil(testNamespace, testAccount)) {
+		t.Error("expected the finalizer to be released")
+	}
+}
+
+func TestNACKAccountFinalizeTimeout(t *testing.T) {
+	o := newTestOperator(t)
+	acc := newTestNACKAccount()
+	acc.DeletionTimestamp = &v1.Time{Time: time.Now()}
+	o.createSecret(newTestNACKAccountSecret(v1.OwnerReference{Kind: "Account", Name: testAccount, UID: acc.UID}))
+	o.createNACKAccount(acc)
+	o.tower.server.Close()
+	handler := getNACKAccountHandler(o.NATSTowerOperator)
+
+	// NATS Tower can not be reached, the cleanup is retried
+	err := handler(context.Background(), nil, k8s.Request{Key: testNamespace + "/" + testAccount}, *acc)
+	var requeueErr *k8s.RequeueAfterError
+	if !errors.As(err, &requeueErr) || requeueErr.After != time.Minute {
+		t.Fatalf("expected the cleanup to be retried, got %v", err)
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") == nil || !hasNACKAccountFinalizer(o.getNACKAccountOrNil(testNamespace, testAccount)) {
+		t.Fatal("expected the secret and the finalizer to be kept while retrying")
+	}
+
+	// The finalizer timeout passed
+	acc.DeletionTimestamp = &v1.Time{Time: time.Now().Add(-11 * time.Minute)}
+	err = handler(context.Background(), nil, k8s.Request{Key: testNamespace + "/" + testAccount}, *acc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasEvent(o.events(), "CleanupTimeout") {
+		t.Error("expected a CleanupTimeout event")
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil || hasNACKAccountFinalizer(o.getNACKAccountOrNil(testNamespace, testAccount)) {
+		t.Error("expected the secret to be deleted and the finalizer to be released")
+	}
+}
+
+func TestNACKAccountSkipCleanup(t *testing.T) {
+	o := newTestOperator(t)
+	acc := newTestNACKAccount()
+	acc.DeletionTimestamp = &v1.Time{Time: time.Now()}
+	acc.Annotations = map[string]string{natsTowerSkipCleanupAnnotation: "true"}
+	o.createSecret(newTestNACKAccountSecret(v1.OwnerReference{Kind: "Account", Name: testAccount, UID: acc.UID}))
+	o.towerUser("app-creds")
+
+	if err := o.finalizeTestNACKAccount(acc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasEvent(o.events(), "CleanupSkipped") {
+		t.Error("expected a CleanupSkipped event")
+	}
+	if !o.hasTowerUser("app-creds") || o.getSecretOrNil(testNamespace, "app-creds") == nil {
+		t.Error("expected the user and the secret to be kept")
+	}
+	if hasNACKAccountFinalizer(o.getNACKAccountOrNil(testNamespace, testAccount)) {
+		t.Error("expected the finalizer to be released")
+	}
+}
+
+func TestNACKAccountRefusesUserOfOtherNamespace(t *testing.T) {
+	o := newTestOperator(t)
+	user := o.otherNamespaceUser("app-creds")
+	acc := newTestNACKAccount()
+	o.createNACKAccount(acc)
+
+	err := getNACKAccountHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/" + testAccount}, *acc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := o.events(); !hasEvent(events, "UserNotOwned") {
+		t.Errorf("expected a UserNotOwned event, got %v", events)
+	}
+	// The account requests no role, which would lift the role of the user
+	if user["signing_key"] != "other-role" {
+		t.Errorf("expected the role of the other namespace's user to be kept, got %v", user["signing_key"])
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected the credentials of the other namespace not to be handed out")
+	}
+}
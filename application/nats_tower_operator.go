@@ -1,49 +1,85 @@
 package application
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	nackapi "github.com/nats-io/nack/pkg/jetstream/apis/jetstream/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
+	"github.com/nats-tower/nats-tower-operator/apis/v1alpha1"
 	"github.com/nats-tower/nats-tower-operator/config"
 	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
 	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+	"github.com/nats-tower/nats-tower-operator/utils/singleflight"
 )
 
 type NATSTowerOperator struct {
 	secretController      *k8s.Controller[corev1.Secret]
 	podController         *k8s.Controller[corev1.Pod]
 	nackAccountController *k8s.Controller[nackapi.Account]
+	accessGrantController *k8s.Controller[v1alpha1.NatsAccessGrant]
+	jobController         *k8s.Controller[batchv1.Job]
 	informersFactory      dynamicinformer.DynamicSharedInformerFactory
+	unfilteredFactory     dynamicinformer.DynamicSharedInformerFactory
 	towerOperatorConfig   *config.Config
 	k8sClient             *k8s.Client
 	eventRecorder         record.EventRecorder
 	natsTowerClient       *natstower.NATSTowerClient
+	nackAccountGVR        schema.GroupVersionResource
+	accessGrantGVR        schema.GroupVersionResource
+	provisioning          singleflight.Group[*natstower.ConnectionInfo]
+	refreshedMu           sync.Mutex
+	refreshed             map[string]time.Time
 }
 
 const (
-	groupVersionResourcePod         = "v1/pods"
-	groupVersionResourceSecrets     = "v1/secrets"
-	groupVersionResourceNackAccount = "jetstream.nats.io/v1beta2/accounts"
-	natsTowerSecretLabelKey         = "nats-tower.com/nats-tower-secret"
-	natsTowerInstallationLabelKey   = "nats-tower.com/nats-tower-installation"
-	natsTowerAccountLabelKey        = "nats-tower.com/nats-tower-account"
-	natsTowerAccountTierLabelKey    = "nats-tower.com/nats-tower-account-tier"
-	natsTowerCredentialTypeLabelKey = "nats-tower.com/nats-tower-credential-type"
-	natsTowerRoleLabelKey           = "nats-tower.com/nats-tower-role"
-	natsTowerPublishAnnotationKey   = "nats-tower.com/nats-tower-publish"
-	natsTowerSubscribeAnnotationKey = "nats-tower.com/nats-tower-subscribe"
-	secretCredentialsKey            = "nats.creds"
+	groupVersionResourcePod                 = "v1/pods"
+	groupVersionResourceSecrets             = "v1/secrets"
+	groupVersionResourceNackAccount         = "jetstream.nats.io/v1beta2/accounts"
+	groupVersionResourceAccessGrant         = "nats-tower.com/v1alpha1/natsaccessgrants"
+	groupVersionResourceJob                 = "batch/v1/jobs"
+	natsTowerSecretLabelKey                 = "nats-tower.com/nats-tower-secret"
+	natsTowerInstallationLabelKey           = "nats-tower.com/nats-tower-installation"
+	natsTowerAccountLabelKey                = "nats-tower.com/nats-tower-account"
+	natsTowerAccountTierLabelKey            = "nats-tower.com/nats-tower-account-tier"
+	natsTowerCredentialTypeLabelKey         = "nats-tower.com/nats-tower-credential-type"
+	natsTowerRoleLabelKey                   = "nats-tower.com/nats-tower-role"
+	natsTowerPublishAnnotationKey           = "nats-tower.com/nats-tower-publish"
+	natsTowerSubscribeAnnotationKey         = "nats-tower.com/nats-tower-subscribe"
+	natsTowerUserAnnotationKey              = "nats-tower.com/nats-tower-user"
+	natsTowerUserScopeAnnotationKey         = "nats-tower.com/nats-tower-user-scope"
+	natsTowerOutputFormatAnnotationKey      = "nats-tower.com/nats-tower-output-format"
+	natsTowerOutputTemplateAnnotationKey    = "nats-tower.com/nats-tower-output-template"
+	natsTowerConfigMapAnnotationKey         = "nats-tower.com/nats-tower-configmap"
+	natsTowerConfigMapKeepKeysAnnotationKey = "nats-tower.com/nats-tower-configmap-keep-secret-keys"
+	natsTowerContentHashAnnotationKey       = "nats-tower.com/content-hash"
+	natsTowerRestartOnChangeAnnotationKey   = "nats-tower.com/restart-on-change"
+	natsTowerSecretChecksumAnnotationKey    = "nats-tower.com/secret-checksum"
+	natsTowerSkipCleanupAnnotation          = "nats-tower.com/skip-cleanup"
+	natsTowerAdoptAnnotationKey             = "nats-tower.com/adopt"
+	natsTowerCleanupFinalizer               = "nats-tower.com/cleanup"
+	managedByLabelKey                       = "app.kubernetes.io/managed-by"
+	managedByLabelValue                     = "nats-tower-operator"
+	secretCredentialsKey                    = "nats.creds"
+	userScopeSecret                         = "secret"
+	userScopePod                            = "pod"
 )
 
 func getPodUserDescription(clusterID string, pod *corev1.Pod) string {
@@ -80,17 +116,24 @@ func CreateNATSTowerOperator(towerOperatorConfig *config.Config,
 	}
 
 	resync := time.Minute * time.Duration(towerOperatorConfig.ResyncInterval)
-	var informersFactory dynamicinformer.DynamicSharedInformerFactory
+	deadLetterRetry := time.Minute * time.Duration(towerOperatorConfig.DeadLetterRetry)
+	namespace := v1.NamespaceAll
 	if towerOperatorConfig.Namespace != "" { // namespaced install
-		informersFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(k8sClient.DynamicClient,
-			resync,
-			towerOperatorConfig.Namespace,
-			func(lo *v1.ListOptions) {
-
-			})
-	} else {
-		informersFactory = dynamicinformer.NewDynamicSharedInformerFactory(k8sClient.DynamicClient, resync)
+		namespace = towerOperatorConfig.Namespace
 	}
+	// Only objects referencing a secret are of interest, so let the API server
+	// filter pods, secrets, NACK accounts and Jobs instead of caching all of them
+	informersFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(k8sClient.DynamicClient,
+		resync,
+		namespace,
+		func(lo *v1.ListOptions) {
+			lo.LabelSelector = natsTowerSecretLabelKey
+		})
+	// NatsAccessGrants do not carry the secret label
+	unfilteredFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(k8sClient.DynamicClient,
+		resync,
+		namespace,
+		nil)
 
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartLogging(klog.Infof)
@@ -101,6 +144,7 @@ func CreateNATSTowerOperator(towerOperatorConfig *config.Config,
 	natsTowerOperator := &NATSTowerOperator{
 		k8sClient:           k8sClient,
 		informersFactory:    informersFactory,
+		unfilteredFactory:   unfilteredFactory,
 		towerOperatorConfig: towerOperatorConfig,
 		eventRecorder:       eventRecorder,
 		natsTowerClient:     natsTowerClient,
@@ -117,7 +161,13 @@ func CreateNATSTowerOperator(towerOperatorConfig *config.Config,
 		towerOperatorConfig.PodConfig.Kind = groupVersionResourcePod
 		natsTowerOperator.podController = k8s.NewController(towerOperatorConfig.PodConfig,
 			getPodHandler(natsTowerOperator),
-			informersFactory.ForResource(gvr))
+			informersFactory.ForResource(gvr),
+			k8s.ControllerOptions[corev1.Pod]{
+				DeadLetterRetryInterval: deadLetterRetry,
+				NamespaceQPS:            towerOperatorConfig.NamespaceQPS,
+				NamespaceBurst:          int(towerOperatorConfig.NamespaceBurst),
+				OnDeadLetter:            getDeadLetterHandler[corev1.Pod](natsTowerOperator, deadLetterRetry),
+			})
 	}
 	// --------------- HANDLING SECRETS -------------------
 	{
@@ -130,7 +180,13 @@ func CreateNATSTowerOperator(towerOperatorConfig *config.Config,
 		towerOperatorConfig.SecretConfig.Kind = groupVersionResourceSecrets
 		natsTowerOperator.secretController = k8s.NewController(towerOperatorConfig.SecretConfig,
 			getSecretHandler(natsTowerOperator),
-			informersFactory.ForResource(gvr))
+			informersFactory.ForResource(gvr),
+			k8s.ControllerOptions[corev1.Secret]{
+				DeadLetterRetryInterval: deadLetterRetry,
+				NamespaceQPS:            towerOperatorConfig.NamespaceQPS,
+				NamespaceBurst:          int(towerOperatorConfig.NamespaceBurst),
+				OnDeadLetter:            getDeadLetterHandler[corev1.Secret](natsTowerOperator, deadLetterRetry),
+			})
 
 	}
 	// --------------- HANDLING NACK ACCOUNTS -------------------
@@ -141,18 +197,99 @@ func CreateNATSTowerOperator(towerOperatorConfig *config.Config,
 			return nil, err
 		}
 
+		natsTowerOperator.nackAccountGVR = gvr
 		towerOperatorConfig.NACKAccountConfig.Kind = groupVersionResourceNackAccount
 		natsTowerOperator.nackAccountController = k8s.NewController(towerOperatorConfig.NACKAccountConfig,
 			getNACKAccountHandler(natsTowerOperator),
-			informersFactory.ForResource(gvr))
+			informersFactory.ForResource(gvr),
+			k8s.ControllerOptions[nackapi.Account]{
+				DeadLetterRetryInterval: deadLetterRetry,
+				NamespaceQPS:            towerOperatorConfig.NamespaceQPS,
+				NamespaceBurst:          int(towerOperatorConfig.NamespaceBurst),
+				OnDeadLetter:            getDeadLetterHandler[nackapi.Account](natsTowerOperator, deadLetterRetry),
+			})
+	}
+	// --------------- HANDLING JOBS -------------------
+	{
+		gvr, err := k8s.GetGVRFromResource(k8sClient.DiscoveryMapper, groupVersionResourceJob)
+		if err != nil {
+			klog.Errorf("Error getting GVR, skip handling for resource '%s': %s.", groupVersionResourceJob, err.Error())
+			return nil, err
+		}
+
+		towerOperatorConfig.JobConfig.Kind = groupVersionResourceJob
+		natsTowerOperator.jobController = k8s.NewController(towerOperatorConfig.JobConfig,
+			getJobHandler(natsTowerOperator),
+			informersFactory.ForResource(gvr),
+			k8s.ControllerOptions[batchv1.Job]{
+				DeadLetterRetryInterval: deadLetterRetry,
+				NamespaceQPS:            towerOperatorConfig.NamespaceQPS,
+				NamespaceBurst:          int(towerOperatorConfig.NamespaceBurst),
+				OnDeadLetter:            getDeadLetterHandler[batchv1.Job](natsTowerOperator, deadLetterRetry),
+			})
+	}
+	// --------------- HANDLING NATS ACCESS GRANTS -------------------
+	if towerOperatorConfig.AccessGrantsEnabled {
+		if towerOperatorConfig.Namespace != "" {
+			return nil, fmt.Errorf("NatsAccessGrants are cluster-scoped and require a cluster-wide install")
+		}
+
+		gvr, err := k8s.GetGVRFromResource(k8sClient.DiscoveryMapper, groupVersionResourceAccessGrant)
+		if err != nil {
+			klog.Errorf("Error getting GVR, skip handling for resource '%s': %s.", groupVersionResourceAccessGrant, err.Error())
+			return nil, err
+		}
+
+		natsTowerOperator.accessGrantGVR = gvr
+		towerOperatorConfig.AccessGrantConfig.Kind = groupVersionResourceAccessGrant
+		natsTowerOperator.accessGrantController = k8s.NewController(towerOperatorConfig.AccessGrantConfig,
+			getAccessGrantHandler(natsTowerOperator),
+			unfilteredFactory.ForResource(gvr),
+			k8s.ControllerOptions[v1alpha1.NatsAccessGrant]{
+				DeadLetterRetryInterval: deadLetterRetry,
+				NamespaceQPS:            towerOperatorConfig.NamespaceQPS,
+				NamespaceBurst:          int(towerOperatorConfig.NamespaceBurst),
+				OnDeadLetter:            getDeadLetterHandler[v1alpha1.NatsAccessGrant](natsTowerOperator, deadLetterRetry),
+			})
 	}
 
 	return natsTowerOperator, nil
 }
 
+// getDeadLetterHandler records a warning event on objects whose
+// reconciliation is paused.
+func getDeadLetterHandler[T k8s.K8sAPIObject](natsTowerOperator *NATSTowerOperator, retry time.Duration) func(obj T, err error) {
+	return func(obj T, err error) {
+		source, ok := any(&obj).(runtime.Object)
+		if !ok {
+			return
+		}
+		natsTowerOperator.eventRecorder.Eventf(source,
+			corev1.EventTypeWarning,
+			"ReconciliationPaused",
+			"Reconciliation paused after %d failed attempts, retrying every %s: %v",
+			k8s.MaxNumRequeues+1, retry, err)
+	}
+}
+
+// DeadLetterSources returns the controllers of the operator for the admin server.
+func (c *NATSTowerOperator) DeadLetterSources() []k8s.DeadLetterSource {
+	sources := []k8s.DeadLetterSource{
+		c.podController,
+		c.secretController,
+		c.nackAccountController,
+		c.jobController,
+	}
+	if c.accessGrantController != nil {
+		sources = append(sources, c.accessGrantController)
+	}
+	return sources
+}
+
 func (c *NATSTowerOperator) Handle(stopCh <-chan struct{}) {
 	klog.Info("Starting informers")
 	c.informersFactory.Start(stopCh)
+	c.unfilteredFactory.Start(stopCh)
 	klog.Info("Waiting for informers cache sync")
 
 	if err := c.podController.WaitForCacheSync(stopCh); err != nil {
@@ -164,14 +301,28 @@ func (c *NATSTowerOperator) Handle(stopCh <-chan struct{}) {
 	if err := c.nackAccountController.WaitForCacheSync(stopCh); err != nil {
 		klog.Fatalf("Error while waiting for informer cache sync: %s", err.Error())
 	}
+	if err := c.jobController.WaitForCacheSync(stopCh); err != nil {
+		klog.Fatalf("Error while waiting for informer cache sync: %s", err.Error())
+	}
+	if c.accessGrantController != nil {
+		if err := c.accessGrantController.WaitForCacheSync(stopCh); err != nil {
+			klog.Fatalf("Error while waiting for informer cache sync: %s", err.Error())
+		}
+	}
 
 	klog.Info("Starting controllers")
 
-	c.podController.Run(1, stopCh)
+	c.podController.Run(int(c.towerOperatorConfig.PodConfig.Workers), stopCh)
+
+	c.secretController.Run(int(c.towerOperatorConfig.SecretConfig.Workers), stopCh)
 
-	c.secretController.Run(1, stopCh)
+	c.nackAccountController.Run(int(c.towerOperatorConfig.NACKAccountConfig.Workers), stopCh)
 
-	c.nackAccountController.Run(1, stopCh)
+	c.jobController.Run(int(c.towerOperatorConfig.JobConfig.Workers), stopCh)
+
+	if c.accessGrantController != nil {
+		c.accessGrantController.Run(int(c.towerOperatorConfig.AccessGrantConfig.Workers), stopCh)
+	}
 
 	<-stopCh
 	klog.Info("Shutting down controllers")
@@ -182,28 +333,56 @@ func (c *NATSTowerOperator) Handle(stopCh <-chan struct{}) {
 
 	c.nackAccountController.Shutdown()
 
+	c.jobController.Shutdown()
+
+	if c.accessGrantController != nil {
+		c.accessGrantController.Shutdown()
+	}
+
 	klog.Info("Exporter exiting")
 }
 
 func (c *NATSTowerOperator) UpsertSecret(ctx context.Context,
 	source runtime.Object,
-	namespace, name, credType string,
+	namespace, name string,
+	request secretRequest,
 	creds *natstower.ConnectionInfo,
 	lastRevision *corev1.Secret) error {
+	ownerRef, err := getSecretOwnerReference(source)
+	if err != nil {
+		return err
+	}
+
+	if request.ConfigMap != "" {
+		ownerRefs := []v1.OwnerReference{ownerRef}
+		if lastRevision != nil {
+			ownerRefs = addOwnerReference(slices.Clone(lastRevision.OwnerReferences), ownerRef)
+		}
+		err = c.UpsertConfigMap(ctx, source, namespace, name, request, creds, ownerRefs)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Check if is an update
 	if lastRevision != nil {
-		if lastRevision.Data == nil {
-			lastRevision.Data = map[string][]byte{}
+		if !secretHasRole(lastRevision, request) {
+			// The user was bound to the new role, the previous one may be unused now
+			err := c.removeGeneratedRole(ctx, lastRevision)
+			if err != nil {
+				return err
+			}
 		}
-		if lastRevision.Labels == nil {
-			lastRevision.Labels = map[string]string{}
+
+		// Workloads only need a restart if they could have used the previous credentials
+		previousData := lastRevision.Data
+
+		err := setSecretContent(lastRevision, source, name, request, creds)
+		if err != nil {
+			return c.recordOutputFormatError(source, namespace, name, err)
 		}
-		lastRevision.Data[secretCredentialsKey] = []byte(creds.Creds)
-		lastRevision.Data["URLS"] = []byte(creds.URLs)
-		lastRevision.Data["ACCOUNT_NAME"] = []byte(creds.AccountName)
-		lastRevision.Labels[natsTowerSecretLabelKey] = "true"
-		lastRevision.Labels[natsTowerCredentialTypeLabelKey] = credType
-		_, err := c.k8sClient.ClientSet.CoreV1().Secrets(namespace).Update(ctx, lastRevision, v1.UpdateOptions{})
+		lastRevision.OwnerReferences = addOwnerReference(lastRevision.OwnerReferences, ownerRef)
+		_, err = c.k8sClient.ClientSet.CoreV1().Secrets(namespace).Update(ctx, lastRevision, v1.UpdateOptions{})
 		if err != nil {
 
 			c.eventRecorder.Eventf(source,
@@ -220,24 +399,41 @@ func (c *NATSTowerOperator) UpsertSecret(ctx context.Context,
 			"Updated",
 			"Updated secret %s/%s", namespace, name)
 
+		if needsRestart(previousData, lastRevision) {
+			return c.RestartWorkloads(ctx, lastRevision, "the NATS connection info changed")
+		}
+
 		return nil
 	}
-	_, err := c.k8sClient.ClientSet.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+
+	secret := &corev1.Secret{
 		ObjectMeta: v1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
-			Labels: map[string]string{
-				natsTowerSecretLabelKey:         "true",
-				natsTowerCredentialTypeLabelKey: credType,
-			},
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: addOwnerReference(nil, ownerRef),
 		},
 		Type: corev1.SecretTypeOpaque,
-		Data: map[string][]byte{
-			secretCredentialsKey: []byte(creds.Creds),
-			"URLS":               []byte(creds.URLs),
-			"ACCOUNT_NAME":       []byte(creds.AccountName),
-		},
-	}, v1.CreateOptions{})
+	}
+	err = setSecretContent(secret, source, name, request, creds)
+	if err != nil {
+		return c.recordOutputFormatError(source, namespace, name, err)
+	}
+
+	_, err = c.k8sClient.ClientSet.CoreV1().Secrets(namespace).Create(ctx, secret, v1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		// Created by a concurrent reconcile or not yet in the cache, update it instead
+		existing, err := c.k8sClient.ClientSet.CoreV1().Secrets(namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !c.canManageSecret(source, existing) || c.hasSecretConflict(ctx, source, existing, request) {
+			return nil
+		}
+		if secretHasContent(existing, source, name, request, creds) {
+			return c.EnsureSecretAndConfigMapOwner(ctx, source, existing, request, creds)
+		}
+		return c.UpsertSecret(ctx, source, namespace, name, request, creds, existing)
+	}
 	if err != nil {
 
 		c.eventRecorder.Eventf(source,
@@ -255,3 +451,224 @@ func (c *NATSTowerOperator) UpsertSecret(ctx context.Context,
 		"Created secret %s/%s", namespace, name)
 	return nil
 }
+
+// getSecret reads a secret from the informer cache. Secrets without the
+// secret label are not watched, so a miss is confirmed with the API server
+// before credentials are provisioned for it.
+func (c *NATSTowerOperator) getSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	secret, err := c.secretController.Get(namespace, name)
+	if !errors.IsNotFound(err) {
+		return secret, err
+	}
+	return c.k8sClient.ClientSet.CoreV1().Secrets(namespace).Get(ctx, name, v1.GetOptions{})
+}
+
+// getUserAuth fetches the connection info of the user of a secret from NATS
+// Tower. Concurrent calls for the same secret, e.g. by all replicas of a
+// Deployment, are coalesced into a single call whose result is shared.
+// Credential types connecting to other endpoints get their URLs from the
+// installation config.
+func (c *NATSTowerOperator) getUserAuth(ctx context.Context,
+	namespace, secretName, user, description string,
+	request secretRequest,
+	opts natstower.UserOptions) (*natstower.ConnectionInfo, error) {
+	urls, err := getCredentialTypeURLs(c.towerOperatorConfig.ValidInstallations[request.Installation],
+		request.CredentialType)
+	if err != nil {
+		return nil, err
+	}
+	setCredentialTypeOptions(request.CredentialType, &opts)
+	setBearerTokenExpiry(request.CredentialType, c.bearerTokenTTL(), &opts)
+
+	// Only identical requests share a result, conflicting ones are refused
+	// once the secret exists
+	key := strings.Join([]string{namespace, secretName, user, request.Installation, request.Account, opts.Role, request.CredentialType}, "/")
+	creds, err, shared := c.provisioning.Do(key, func() (*natstower.ConnectionInfo, error) {
+		return c.natsTowerClient.CreateOrGetUserAuth(ctx,
+			namespace,
+			request.Installation,
+			request.Account,
+			user,
+			description,
+			opts)
+	})
+	if shared {
+		klog.Infof("Secret[%s] in namespace[%s]: shared user auth of a concurrent reconcile",
+			secretName, namespace)
+	}
+	if err == nil {
+		c.markRefreshed(namespace, secretName)
+	}
+	if err != nil || urls == "" {
+		return creds, err
+	}
+
+	// The result may be shared, so it is copied before changing it
+	typeCreds := *creds
+	typeCreds.URLs = urls
+	return &typeCreds, nil
+}
+
+// bearerTokenTTL returns how long bearer tokens are valid.
+func (c *NATSTowerOperator) bearerTokenTTL() time.Duration {
+	return time.Minute * time.Duration(c.towerOperatorConfig.BearerTokenTTL)
+}
+
+// setSecretContent writes the credentials in the requested output format,
+// the operator labels and the annotations describing the NATS Tower user into
+// the secret. The content hash annotation is computed last, so it covers
+// everything written here.
+func setSecretContent(secret *corev1.Secret,
+	source runtime.Object,
+	user string,
+	request secretRequest,
+	creds *natstower.ConnectionInfo) error {
+	data, err := renderSourceData(secret, source, user, request, creds)
+	if err != nil {
+		return err
+	}
+
+	expires := formatExpiry(getCredsExpiry(creds.Creds))
+	if request.UserScope == userScopePod {
+		// Every pod has a user of its own, which is revoked together with the pod
+		user = ""
+		expires = ""
+	}
+
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	// Keys of other output formats must not linger
+	secret.Data = data
+	secret.Labels[natsTowerSecretLabelKey] = "true"
+	secret.Labels[managedByLabelKey] = managedByLabelValue
+	secret.Labels[natsTowerCredentialTypeLabelKey] = request.CredentialType
+	secret.Annotations[natsTowerInstallationLabelKey] = request.Installation
+	secret.Annotations[natsTowerAccountLabelKey] = request.Account
+	secret.Annotations[natsTowerRoleLabelKey] = request.Role
+	setOptionalAnnotation(secret, natsTowerUserAnnotationKey, user)
+	setOptionalAnnotation(secret, natsTowerUserScopeAnnotationKey, request.UserScope)
+	secret.Annotations[natsTowerOutputFormatAnnotationKey] = request.OutputFormat
+	setOptionalAnnotation(secret, natsTowerOutputTemplateAnnotationKey, request.OutputTemplate)
+	setOptionalAnnotation(secret, natsTowerConfigMapAnnotationKey, request.ConfigMap)
+	delete(secret.Annotations, natsTowerConfigMapKeepKeysAnnotationKey)
+	if request.ConfigMapKeepKeys {
+		secret.Annotations[natsTowerConfigMapKeepKeysAnnotationKey] = "true"
+	}
+	setOptionalAnnotation(secret, natsTowerUserLimitsAnnotationKey, request.Limits)
+	setOptionalAnnotation(secret, natsTowerExpiresAnnotationKey, expires)
+	delete(secret.Annotations, natsTowerGeneratedRoleAnnotationKey)
+	if request.GeneratedRole {
+		secret.Annotations[natsTowerGeneratedRoleAnnotationKey] = "true"
+	}
+	secret.Annotations[natsTowerContentHashAnnotationKey] = getSecretContentHash(secret)
+	return nil
+}
+
+// setOptionalAnnotation sets the annotation, or removes it for empty values.
+func setOptionalAnnotation(secret *corev1.Secret, key, value string) {
+	if value != "" {
+		secret.Annotations[key] = value
+	} else {
+		delete(secret.Annotations, key)
+	}
+}
+
+// secretHasContent reports whether the secret already contains the given
+// connection info in the requested output format.
+func secretHasContent(secret *corev1.Secret,
+	source runtime.Object,
+	user string,
+	request secretRequest,
+	creds *natstower.ConnectionInfo) bool {
+	if !secretHasOutputFormat(secret, request) || !secretHasLimits(secret, request) || !secretHasRole(secret, request) {
+		return false
+	}
+	data, err := renderSourceData(secret, source, user, request, creds)
+	if err != nil {
+		return false
+	}
+	return maps.EqualFunc(secret.Data, data, bytes.Equal)
+}
+
+// secretHasOutputFormat reports whether the secret was rendered in the
+// requested output format. Secrets of older operator versions are in the
+// creds format.
+func secretHasOutputFormat(secret *corev1.Secret, request secretRequest) bool {
+	format := secret.Annotations[natsTowerOutputFormatAnnotationKey]
+	if format == "" {
+		format = outputFormatCreds
+	}
+	return format == request.OutputFormat &&
+		secret.Annotations[natsTowerOutputTemplateAnnotationKey] == request.OutputTemplate &&
+		secret.Annotations[natsTowerConfigMapAnnotationKey] == request.ConfigMap &&
+		secretHasConfigMapKeys(secret, request)
+}
+
+// secretHasConfigMapKeys reports whether the secret keeps the connection info
+// written to the companion ConfigMap as requested.
+func secretHasConfigMapKeys(secret *corev1.Secret, request secretRequest) bool {
+	return (secret.Annotations[natsTowerConfigMapKeepKeysAnnotationKey] == "true") == request.ConfigMapKeepKeys
+}
+
+// recordOutputFormatError records a warning event for a secret that can not
+// be rendered in the requested output format. Retrying does not help, so
+// no error is returned.
+func (c *NATSTowerOperator) recordOutputFormatError(source runtime.Object, namespace, name string, err error) error {
+	c.eventRecorder.Eventf(source,
+		corev1.EventTypeWarning,
+		"InvalidOutputFormat",
+		"Could not render secret %s/%s: %v",
+		namespace, name, err)
+	return nil
+}
+
+// EnsureSecretOwner adds the owner reference of the source to an existing
+// secret, so that secrets shared by several workloads are kept until the last
+// of them is gone.
+func (c *NATSTowerOperator) EnsureSecretOwner(ctx context.Context,
+	source runtime.Object,
+	secret *corev1.Secret) error {
+	ownerRef, err := getSecretOwnerReference(source)
+	if err != nil {
+		return err
+	}
+	if hasOwnerReference(secret.OwnerReferences, ownerRef) {
+		return nil
+	}
+
+	secret.OwnerReferences = addOwnerReference(secret.OwnerReferences, ownerRef)
+	_, err = c.k8sClient.ClientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, v1.UpdateOptions{})
+	if err != nil {
+
+		c.eventRecorder.Eventf(source,
+			corev1.EventTypeWarning,
+			"ErrorUpsertingSecret",
+			"Could not add owner to secret %s/%s: %v",
+			secret.Namespace, secret.Name, err)
+
+		return err
+	}
+
+	klog.Infof("Secret[%s] in namespace[%s]: added owner %s/%s",
+		secret.Name, secret.Namespace, ownerRef.Kind, ownerRef.Name)
+	return nil
+}
+
+// EnsureSecretAndConfigMapOwner adds the owner reference of the source to a
+// secret with current content and mirrors its owners onto the companion
+// ConfigMap, which is recreated if it was deleted.
+func (c *NATSTowerOperator) EnsureSecretAndConfigMapOwner(ctx context.Context,
+	source runtime.Object,
+	secret *corev1.Secret,
+	request secretRequest,
+	creds *natstower.ConnectionInfo) error {
+	err := c.EnsureSecretOwner(ctx, source, secret)
+	if err != nil || request.ConfigMap == "" {
+		return err
+	}
+	return c.UpsertConfigMap(ctx, source, secret.Namespace, secret.Name, request, creds, secret.OwnerReferences)
+}
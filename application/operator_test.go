@@ -0,0 +1,417 @@
+package application
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nackapi "github.com/nats-io/nack/pkg/jetstream/apis/jetstream/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/nats-tower/nats-tower-operator/apis/v1alpha1"
+	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+const (
+	testInstallation = "installation"
+	testClusterID    = "test"
+	testNamespace    = "default"
+	testAccount      = "app"
+)
+
+var (
+	testPodGVR         = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	testSecretGVR      = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	testJobGVR         = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	testNACKAccountGVR = schema.GroupVersionResource{Group: "jetstream.nats.io", Version: "v1beta2", Resource: "accounts"}
+	testAccessGrantGVR = schema.GroupVersionResource{Group: "nats-tower.com", Version: "v1alpha1", Resource: "natsaccessgrants"}
+)
+
+// fakeTower is an in-memory NATS Tower API. Records are stored per
+// collection and list requests are filtered by the fields compared in the
+// filter query.
+type fakeTower struct {
+	mu       sync.Mutex
+	records  map[string]map[string]map[string]any
+	nextID   int
+	requests []string
+	server   *httptest.Server
+}
+
+var filterFieldPattern = regexp.MustCompile(`(\w+)\s*=\s*'([^']*)'`)
+
+func newFakeTower(t *testing.T) *fakeTower {
+	tower := &fakeTower{records: map[string]map[string]map[string]any{}}
+	tower.server = httptest.NewServer(http.HandlerFunc(tower.handle))
+	t.Cleanup(tower.server.Close)
+
+	operatorID := tower.add("nats_auth_operators", map[string]any{
+		"public_key": testInstallation,
+		"url":        "nats://nats:4222",
+	})
+	accountID := tower.add("nats_auth_accounts", map[string]any{
+		"operator":   operatorID,
+		"name":       testAccount,
+		"public_key": "ACCOUNT",
+	})
+	tower.add("nats_auth_k8s_access", map[string]any{
+		"cluster":   testClusterID,
+		"namespace": testNamespace,
+		"account":   accountID,
+	})
+	return tower
+}
+
+// add stores a record and returns its id.
+func (f *fakeTower) add(collection string, record map[string]any) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addLocked(collection, record)
+}
+
+func (f *fakeTower) addLocked(collection string, record map[string]any) string {
+	f.nextID++
+	id := fmt.Sprintf("id%d", f.nextID)
+	record["id"] = id
+	if collection == "nats_auth_users" {
+		record["creds"] = f.issueCreds(record)
+	}
+	if f.records[collection] == nil {
+		f.records[collection] = map[string]map[string]any{}
+	}
+	f.records[collection][id] = record
+	return id
+}
+
+// issueCreds renders a creds file for the user record. The JWT is not
+// signed, but carries the expiry of the user.
+func (f *fakeTower) issueCreds(record map[string]any) string {
+	claims := map[string]any{"name": record["name"], "jti": f.nextID}
+	if expires, ok := record["expires"].(string); ok && expires != "" {
+		parsed, err := time.Parse("2006-01-02 15:04:05.000Z", expires)
+		if err == nil {
+			claims["exp"] = parsed.Unix()
+		}
+	}
+	payload, _ := json.Marshal(claims)
+	jwt := "eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+	return "-----BEGIN NATS USER JWT-----\n" + jwt + "\n------END NATS USER JWT------\n\n" +
+		"-----BEGIN USER NKEY SEED-----\nSUAEXAMPLESEED\n------END USER NKEY SEED------\n"
+}
+
+// find returns the records of the collection with the given field values.
+func (f *fakeTower) find(collection string, fields map[string]string) []map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.findLocked(collection, fields)
+}
+
+func (f *fakeTower) findLocked(collection string, fields map[string]string) []map[string]any {
+	var found []map[string]any
+	for _, record := range f.records[collection] {
+		matches := true
+		for field, value := range fields {
+			if fmt.Sprint(record[field]) != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// countRequests returns the number of requests with the method to the
+// collection.
+func (f *fakeTower) countRequests(method, collection string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, request := range f.requests {
+		if request == method+" "+collection {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeTower) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "api" || parts[1] != "collections" || parts[3] != "records" {
+		http.NotFound(w, r)
+		return
+	}
+	collection := parts[2]
+	f.requests = append(f.requests, r.Method+" "+collection)
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 4:
+		fields := map[string]string{}
+		for _, match := range filterFieldPattern.FindAllStringSubmatch(r.URL.Query().Get("filter"), -1) {
+			fields[match[1]] = match[2]
+		}
+		items := f.findLocked(collection, fields)
+		if items == nil {
+			items = []map[string]any{}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+	case r.Method == http.MethodPost && len(parts) == 4:
+		record := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.addLocked(collection, record)
+		_ = json.NewEncoder(w).Encode(record)
+	case r.Method == http.MethodPatch && len(parts) == 5:
+		record, ok := f.records[collection][parts[4]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if collection == "nats_auth_users" {
+			// The JWT is re-issued on every change
+			f.nextID++
+			record["creds"] = f.issueCreds(record)
+		}
+		_ = json.NewEncoder(w).Encode(record)
+	case r.Method == http.MethodDelete && len(parts) == 5:
+		if _, ok := f.records[collection][parts[4]]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.records[collection], parts[4])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusMethodNotAllowed)
+	}
+}
+
+// testOperator is an operator talking to fake clients and a fake NATS Tower.
+// The informer caches are filled by the tests instead of a watch.
+type testOperator struct {
+	*NATSTowerOperator
+	t         *testing.T
+	clientset *fake.Clientset
+	dynamic   *dynamicfake.FakeDynamicClient
+	factory   dynamicinformer.DynamicSharedInformerFactory
+	recorder  *record.FakeRecorder
+	tower     *fakeTower
+}
+
+func newTestOperator(t *testing.T) *testOperator {
+	tower := newFakeTower(t)
+	towerClient, err := natstower.CreateNATSTowerClient(context.Background(), natstower.NATSTowerClientConfig{
+		ClusterID:    testClusterID,
+		NATSTowerURL: tower.server.URL,
+	})
+	if err != nil {
+		t.Fatalf("error creating NATS Tower client: %v", err)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			testPodGVR:         "PodList",
+			testSecretGVR:      "SecretList",
+			testJobGVR:         "JobList",
+			testNACKAccountGVR: "AccountList",
+			testAccessGrantGVR: "NatsAccessGrantList",
+		})
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	recorder := record.NewFakeRecorder(1000)
+
+	operator := &NATSTowerOperator{
+		k8sClient: &k8s.Client{
+			ClientSet:     clientset,
+			DynamicClient: dynamicClient,
+		},
+		informersFactory:  factory,
+		unfilteredFactory: factory,
+		towerOperatorConfig: &config.Config{
+			ClusterID:            testClusterID,
+			FinalizerTimeout:     10,
+			JobCredentialsTTL:    5,
+			RestartCheckInterval: 5,
+			DefaultInstallation:  testInstallation,
+			ValidInstallations:   map[string]config.Installation{testInstallation: {}},
+		},
+		eventRecorder:   recorder,
+		natsTowerClient: towerClient,
+		nackAccountGVR:  testNACKAccountGVR,
+		accessGrantGVR:  testAccessGrantGVR,
+	}
+	operator.podController = k8s.NewController(config.Resource{Kind: "v1/pods"},
+		getPodHandler(operator), factory.ForResource(testPodGVR), k8s.ControllerOptions[corev1.Pod]{})
+	operator.secretController = k8s.NewController(config.Resource{Kind: "v1/secrets"},
+		getSecretHandler(operator), factory.ForResource(testSecretGVR), k8s.ControllerOptions[corev1.Secret]{})
+	operator.jobController = k8s.NewController(config.Resource{Kind: "batch/v1/jobs"},
+		getJobHandler(operator), factory.ForResource(testJobGVR), k8s.ControllerOptions[batchv1.Job]{})
+	operator.nackAccountController = k8s.NewController(config.Resource{Kind: "jetstream.nats.io/v1beta2/accounts"},
+		getNACKAccountHandler(operator), factory.ForResource(testNACKAccountGVR), k8s.ControllerOptions[nackapi.Account]{})
+	operator.accessGrantController = k8s.NewController(config.Resource{Kind: "nats-tower.com/v1alpha1/natsaccessgrants"},
+		getAccessGrantHandler(operator), factory.ForResource(testAccessGrantGVR), k8s.ControllerOptions[v1alpha1.NatsAccessGrant]{})
+
+	return &testOperator{
+		NATSTowerOperator: operator,
+		t:                 t,
+		clientset:         clientset,
+		dynamic:           dynamicClient,
+		factory:           factory,
+		recorder:          recorder,
+		tower:             tower,
+	}
+}
+
+// cache adds the object to the informer cache of the resource.
+func (o *testOperator) cache(gvr schema.GroupVersionResource, obj any) {
+	o.t.Helper()
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		o.t.Fatalf("error converting %T to unstructured: %v", obj, err)
+	}
+	err = o.factory.ForResource(gvr).Informer().GetIndexer().Add(&unstructured.Unstructured{Object: content})
+	if err != nil {
+		o.t.Fatalf("error caching %T: %v", obj, err)
+	}
+}
+
+// createSecret creates the secret on the fake API server and caches it.
+func (o *testOperator) createSecret(secret *corev1.Secret) {
+	o.t.Helper()
+	_, err := o.clientset.CoreV1().Secrets(secret.Namespace).Create(context.Background(), secret, v1.CreateOptions{})
+	if err != nil {
+		o.t.Fatalf("error creating secret: %v", err)
+	}
+	o.cache(testSecretGVR, secret)
+}
+
+// getSecretOrNil reads the secret from the fake API server, nil if it is gone.
+func (o *testOperator) getSecretOrNil(namespace, name string) *corev1.Secret {
+	secret, err := o.clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	return secret
+}
+
+// createNACKAccount creates the account on the fake API server.
+func (o *testOperator) createNACKAccount(acc *nackapi.Account) {
+	o.t.Helper()
+	acc.APIVersion = "jetstream.nats.io/v1beta2"
+	acc.Kind = "Account"
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(acc)
+	if err != nil {
+		o.t.Fatalf("error converting account to unstructured: %v", err)
+	}
+	_, err = o.dynamic.Resource(testNACKAccountGVR).Namespace(acc.Namespace).Create(context.Background(),
+		&unstructured.Unstructured{Object: content}, v1.CreateOptions{})
+	if err != nil {
+		o.t.Fatalf("error creating account: %v", err)
+	}
+}
+
+// getNACKAccountOrNil reads the account from the fake API server, nil if it
+// is gone.
+func (o *testOperator) getNACKAccountOrNil(namespace, name string) *nackapi.Account {
+	o.t.Helper()
+	content, err := o.dynamic.Resource(testNACKAccountGVR).Namespace(namespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	var acc nackapi.Account
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(content.Object, &acc)
+	if err != nil {
+		o.t.Fatalf("error converting account from unstructured: %v", err)
+	}
+	return &acc
+}
+
+// events returns the events recorded since the last call.
+func (o *testOperator) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-o.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// hasEvent reports whether one of the events has the reason.
+func hasEvent(events []string, reason string) bool {
+	for _, event := range events {
+		if strings.Contains(event, " "+reason+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// towerUser adds a user to the fake NATS Tower and returns its id.
+func (o *testOperator) towerUser(name string) string {
+	accounts := o.tower.find("nats_auth_accounts", map[string]string{"name": testAccount})
+	return o.tower.add("nats_auth_users", map[string]any{
+		"account":     accounts[0]["id"],
+		"name":        name,
+		"description": "Generated User in namespace '" + testNamespace + "' on cluster '" + testClusterID + "'",
+	})
+}
+
+// otherNamespaceUser adds a user created for the namespace other to the fake
+// NATS Tower and returns it.
+func (o *testOperator) otherNamespaceUser(name string) map[string]any {
+	accounts := o.tower.find("nats_auth_accounts", map[string]string{"name": testAccount})
+	o.tower.add("nats_auth_users", map[string]any{
+		"account":     accounts[0]["id"],
+		"name":        name,
+		"description": "Generated User in namespace 'other' on cluster '" + testClusterID + "'",
+		"signing_key": "other-role",
+	})
+	return o.tower.find("nats_auth_users", map[string]string{"name": name})[0]
+}
+
+// grantOtherNamespace gives the namespace other access to the test account.
+func (o *testOperator) grantOtherNamespace() {
+	accounts := o.tower.find("nats_auth_accounts", map[string]string{"name": testAccount})
+	o.tower.add("nats_auth_k8s_access", map[string]any{
+		"cluster":   testClusterID,
+		"namespace": "other",
+		"account":   accounts[0]["id"],
+	})
+}
+
+// hasTowerUser reports whether the user exists on the fake NATS Tower.
+func (o *testOperator) hasTowerUser(name string) bool {
+	return len(o.tower.find("nats_auth_users", map[string]string{"name": name})) > 0
+}
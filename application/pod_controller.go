@@ -4,10 +4,11 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"text/template"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
@@ -15,9 +16,9 @@ import (
 	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
 )
 
-func getPodHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, ev k8s.EventItem, obj corev1.Pod) error {
-	return func(ctx context.Context, informer cache.SharedIndexInformer, ev k8s.EventItem, obj corev1.Pod) error {
-		klog.Infof("pod[%s]: %s - %s", ev.ActionType, obj.Name, ev.Key)
+func getPodHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj corev1.Pod) error {
+	return func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj corev1.Pod) error {
+		klog.Infof("pod[deleted=%t]: %s - %s", req.Deleted, obj.Name, req.Key)
 
 		// 1. check if pod is annotated with nats.tower/secret
 		// 2. check if pod has a secret defined in the annotation nats.tower/secret
@@ -28,199 +29,425 @@ func getPodHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Contex
 			return nil
 		}
 
-		installationPublicKey := obj.Labels[natsTowerInstallationLabelKey]
-
-		if installationPublicKey == "" && natsTowerOperator.towerOperatorConfig.DefaultInstallation == "" {
-			// Record event as we require the label
-			natsTowerOperator.eventRecorder.Eventf(&obj,
-				corev1.EventTypeWarning,
-				"MissingInstallationLabel",
-				"Require label %s to generate secret", natsTowerInstallationLabelKey)
+		secretName := obj.Labels[natsTowerSecretLabelKey]
+		request, ok := natsTowerOperator.getPodSecretRequest(&obj)
+		if !ok {
 			return nil
 		}
 
-		if installationPublicKey == "" {
-			installationPublicKey = natsTowerOperator.towerOperatorConfig.DefaultInstallation
-			natsTowerOperator.eventRecorder.Eventf(&obj,
-				corev1.EventTypeNormal,
-				"DefaultInstallation",
-				"Will use default installation %s to generate secret",
-				natsTowerOperator.towerOperatorConfig.DefaultInstallation)
-		} else {
-			_, ok := natsTowerOperator.towerOperatorConfig.ValidInstallations[installationPublicKey]
-
-			if !ok {
-				// Record event as we require valid label value
-				natsTowerOperator.eventRecorder.Eventf(&obj,
-					corev1.EventTypeWarning,
-					"InvalidInstallationLabel",
-					"Require label %s to be one of %+v to generate secret",
-					natsTowerInstallationLabelKey,
-					natsTowerOperator.towerOperatorConfig.ValidInstallations)
+		if req.Deleted {
+			if request.UserScope != userScopePod {
+				// Shared secrets are owned by the workload and cleaned up with it
 				return nil
 			}
+			return natsTowerOperator.revokePodUser(ctx, &obj, request.Installation, request.Account, secretName)
 		}
 
-		account, ok := obj.Labels[natsTowerAccountLabelKey]
-
-		if !ok || account == "" {
-			// Record event as we require the label
-			natsTowerOperator.eventRecorder.Eventf(&obj,
-				corev1.EventTypeWarning,
-				"MissingAccountLabel",
-				"Require label %s to generate secret", natsTowerAccountLabelKey)
-			return nil
-		}
-
-		if ev.ActionType == k8s.DeleteAction {
-			// Do nothing on pod deletes
-			// TODO: We will check in a worker if a secret is no longer needed
-			// The worker will query all pods and check if the secret is still needed
+		if obj.Status.Phase == corev1.PodSucceeded || obj.Status.Phase == corev1.PodFailed {
+			// Finished pods, e.g. of Jobs, need no credentials anymore
 			return nil
 		}
 
-		// 2a. resolve the optional user role from the role label & permission annotations
-		userOptions := natstower.UserOptions{
-			Role:      obj.Labels[natsTowerRoleLabelKey],
-			Publish:   parseSubjects(obj.Annotations[natsTowerPublishAnnotationKey]),
-			Subscribe: parseSubjects(obj.Annotations[natsTowerSubscribeAnnotationKey]),
-		}
-
-		if userOptions.Role == "" && (len(userOptions.Publish) > 0 || len(userOptions.Subscribe) > 0) {
-			// Permission annotations are only meaningful together with a role label
-			natsTowerOperator.eventRecorder.Eventf(&obj,
-				corev1.EventTypeWarning,
-				"MissingRoleLabel",
-				"Require label %s when annotations %s or %s are set",
-				natsTowerRoleLabelKey,
-				natsTowerPublishAnnotationKey,
-				natsTowerSubscribeAnnotationKey)
+		userOptions, ok := natsTowerOperator.completePodSecretRequest(&obj, &request)
+		if !ok {
 			return nil
 		}
 
-		// 3. check which type of credentials is required
-		credentialType := "user"
-		if obj.Labels[natsTowerCredentialTypeLabelKey] != "" {
-			credentialType = obj.Labels[natsTowerCredentialTypeLabelKey]
-		}
-
-		switch credentialType {
-		case "user":
-		default:
-			credentialType = "user"
+		user := secretName
+		if request.UserScope == userScopePod {
+			user = getPodUserName(secretName, &obj)
 		}
 
-		var creds *natstower.ConnectionInfo
-
 		// 4. check if secret is defined in the same namespace as the pod
-		secret, err := natsTowerOperator.k8sClient.ClientSet.CoreV1().Secrets(obj.Namespace).Get(ctx,
-			obj.Labels[natsTowerSecretLabelKey], v1.GetOptions{})
+		secret, err := natsTowerOperator.getSecret(ctx, obj.Namespace, secretName)
 		if err != nil {
 			if errors.IsNotFound(err) {
 				klog.Infof("Secret[%s] not found in namespace[%s]",
-					obj.Labels[natsTowerSecretLabelKey], obj.Namespace)
-
-				switch credentialType {
-				case "user":
-					creds, err = natsTowerOperator.natsTowerClient.CreateOrGetUserAuth(ctx,
-						obj.Namespace,
-						installationPublicKey,
-						account,
-						obj.Labels[natsTowerSecretLabelKey],
-						getPodUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
-						userOptions)
-
-					if err == natstower.ErrK8sAccessNotAllowed {
-
-						natsTowerOperator.eventRecorder.Eventf(&obj,
-							corev1.EventTypeWarning,
-							"ErrorK8sAccessNotAllowed",
-							"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
-							obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, account)
-
-						return err
-					}
-					if err != nil {
-
-						natsTowerOperator.eventRecorder.Eventf(&obj,
-							corev1.EventTypeWarning,
-							"ErrorCreatingUserAuth",
-							"Could not CreateOrGetUserAuth to create new secret:%v", err)
-
-						return err
-					}
-				default:
-					return fmt.Errorf("invalid credential type: %s - must be 'user'", credentialType)
+					secretName, obj.Namespace)
+
+				creds, err := natsTowerOperator.getUserAuth(ctx,
+					obj.Namespace,
+					secretName,
+					user,
+					getPodUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
+					request,
+					userOptions)
+
+				if err == natstower.ErrK8sAccessNotAllowed {
+
+					natsTowerOperator.eventRecorder.Eventf(&obj,
+						corev1.EventTypeWarning,
+						"ErrorK8sAccessNotAllowed",
+						"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
+						obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, request.Account)
+
+					return err
 				}
+				if err == natstower.ErrUserNotOwned {
 
-				return natsTowerOperator.UpsertSecret(ctx,
+					natsTowerOperator.eventRecorder.Eventf(&obj,
+						corev1.EventTypeWarning,
+						"UserNotOwned",
+						"The user of secret %s/%s belongs to another namespace on NATS Tower, pick another secret name",
+						obj.Namespace, secretName)
+
+					return nil
+				}
+				if err != nil {
+
+					natsTowerOperator.eventRecorder.Eventf(&obj,
+						corev1.EventTypeWarning,
+						"ErrorCreatingUserAuth",
+						"Could not CreateOrGetUserAuth to create new secret:%v", err)
+
+					return err
+				}
+
+				err = natsTowerOperator.UpsertSecret(ctx,
 					&obj,
 					obj.Namespace,
-					obj.Labels[natsTowerSecretLabelKey],
-					credentialType,
+					secretName,
+					request,
 					creds,
 					nil)
+				return natsTowerOperator.requeueForRefresh(requeueForRenewal(err, getCredsExpiry(creds.Creds), userOptions.RenewBefore),
+					obj.Annotations, obj.Namespace, secretName)
 			}
 			klog.Errorf("Secret[%s] not found in namespace[%s]:%T - %v",
-				obj.Labels[natsTowerSecretLabelKey], obj.Namespace, err, err)
+				secretName, obj.Namespace, err, err)
 			return err
 		}
 
-		switch credentialType {
-		case "user":
-			// 4a. check if secret has a key named {secretCredentialsKey}
-			if secret.Data[secretCredentialsKey] != nil && string(secret.Data[secretCredentialsKey]) != "" {
-				return nil
+		if !natsTowerOperator.canManageSecret(&obj, secret) ||
+			natsTowerOperator.hasSecretConflict(ctx, &obj, secret, request) {
+			return nil
+		}
+
+		hasConfigMap, err := natsTowerOperator.hasConfigMap(ctx, &obj, secret, request)
+		if err != nil {
+			return err
+		}
+
+		// 4a. check if secret already has credentials in the requested format
+		// Only refresh the connection info from NATS Tower if changes should restart the workloads
+		// and it was not refreshed recently, the credentials expire soon or the ConfigMap is missing
+		if hasConfigMap && secretHasPodCredentials(secret, &obj, request) && isManagedSecret(secret) && secretHasOutputFormat(secret, request) &&
+			secretHasLimits(secret, request) && secretHasRole(secret, request) && !secretNeedsRenewal(secret, userOptions.RenewBefore) &&
+			(obj.Annotations[natsTowerRestartOnChangeAnnotationKey] != "true" || !natsTowerOperator.refreshDue(secret)) {
+			err = natsTowerOperator.EnsureSecretOwner(ctx, &obj, secret)
+			expires, _ := time.Parse(time.RFC3339, secret.Annotations[natsTowerExpiresAnnotationKey])
+			return natsTowerOperator.requeueForRefresh(requeueForRenewal(err, expires, userOptions.RenewBefore),
+				obj.Annotations, obj.Namespace, secretName)
+		}
+		if userOptions.Limits == nil && secret.Annotations[natsTowerUserLimitsAnnotationKey] != "" {
+			// The limit annotations were removed, lift the limits of the user
+			userOptions.Limits = &natstower.UserLimits{
+				MaxSubscriptions: natstower.NoLimit,
+				MaxPayload:       natstower.NoLimit,
+				MaxData:          natstower.NoLimit,
 			}
-			creds, err = natsTowerOperator.natsTowerClient.CreateOrGetUserAuth(ctx,
+		}
+		creds, err := natsTowerOperator.getUserAuth(ctx,
+			obj.Namespace,
+			secretName,
+			user,
+			getPodUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
+			request,
+			userOptions)
+
+		if err == natstower.ErrK8sAccessNotAllowed {
+
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"ErrorK8sAccessNotAllowed",
+				"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
+				obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, request.Account)
+
+			return err
+		}
+		if err == natstower.ErrUserNotOwned {
+
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"UserNotOwned",
+				"The user of secret %s/%s belongs to another namespace on NATS Tower, pick another secret name",
+				obj.Namespace, secretName)
+
+			return nil
+		}
+		if err != nil {
+
+			natsTowerOperator.eventRecorder.Eventf(&obj,
+				corev1.EventTypeWarning,
+				"ErrorCreatingUserAuth",
+				"Could not CreateOrGetUserAuth to update secret:%v", err)
+
+			return err
+		}
+
+		if secretHasContent(secret, &obj, secretName, request, creds) {
+			err = natsTowerOperator.EnsureSecretAndConfigMapOwner(ctx, &obj, secret, request, creds)
+		} else {
+			err = natsTowerOperator.UpsertSecret(ctx,
+				&obj,
 				obj.Namespace,
-				installationPublicKey,
-				account,
-				obj.Labels[natsTowerSecretLabelKey],
-				getPodUserDescription(natsTowerOperator.towerOperatorConfig.ClusterID, &obj),
-				userOptions)
+				secretName,
+				request,
+				creds,
+				secret)
+		}
+		return natsTowerOperator.requeueForRefresh(requeueForRenewal(err, getCredsExpiry(creds.Creds), userOptions.RenewBefore),
+			obj.Annotations, obj.Namespace, secretName)
+	}
+}
+
+// getPodSecretRequest resolves the installation, account and user scope of the
+// secret a pod requests. Missing or invalid labels are recorded as events on
+// the pod.
+func (c *NATSTowerOperator) getPodSecretRequest(pod *corev1.Pod) (secretRequest, bool) {
+	installationPublicKey := pod.Labels[natsTowerInstallationLabelKey]
+
+	if installationPublicKey == "" && c.towerOperatorConfig.DefaultInstallation == "" {
+		// Record event as we require the label
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"MissingInstallationLabel",
+			"Require label %s to generate secret", natsTowerInstallationLabelKey)
+		return secretRequest{}, false
+	}
+
+	if installationPublicKey == "" {
+		installationPublicKey = c.towerOperatorConfig.DefaultInstallation
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeNormal,
+			"DefaultInstallation",
+			"Will use default installation %s to generate secret",
+			c.towerOperatorConfig.DefaultInstallation)
+	} else {
+		_, ok := c.towerOperatorConfig.ValidInstallations[installationPublicKey]
+
+		if !ok {
+			// Record event as we require valid label value
+			c.eventRecorder.Eventf(pod,
+				corev1.EventTypeWarning,
+				"InvalidInstallationLabel",
+				"Require label %s to be one of %+v to generate secret",
+				natsTowerInstallationLabelKey,
+				c.towerOperatorConfig.InstallationKeys())
+			return secretRequest{}, false
+		}
+	}
 
-			if err == natstower.ErrK8sAccessNotAllowed {
+	account, ok := pod.Labels[natsTowerAccountLabelKey]
 
-				natsTowerOperator.eventRecorder.Eventf(&obj,
-					corev1.EventTypeWarning,
-					"ErrorK8sAccessNotAllowed",
-					"Please add the namespace '%s' & cluster '%s' for account '%s' to the k8s access list on NATS Tower",
-					obj.Namespace, natsTowerOperator.towerOperatorConfig.ClusterID, account)
+	if !ok || account == "" {
+		// Record event as we require the label
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"MissingAccountLabel",
+			"Require label %s to generate secret", natsTowerAccountLabelKey)
+		return secretRequest{}, false
+	}
 
-				return err
-			}
-			if err != nil {
+	// 1a. resolve whether the pod shares the user of the secret or gets its own
+	userScope := pod.Annotations[natsTowerUserScopeAnnotationKey]
+	switch userScope {
+	case "", userScopeSecret:
+		// Only pods with their own user are recorded on the secret
+		userScope = ""
+	case userScopePod:
+	default:
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidUserScope",
+			"Require annotation %s to be '%s' or '%s' to generate secret",
+			natsTowerUserScopeAnnotationKey, userScopeSecret, userScopePod)
+		return secretRequest{}, false
+	}
 
-				natsTowerOperator.eventRecorder.Eventf(&obj,
-					corev1.EventTypeWarning,
-					"ErrorCreatingUserAuth",
-					"Could not CreateOrGetUserAuth to update secret:%v", err)
+	return secretRequest{
+		Installation: installationPublicKey,
+		Account:      account,
+		UserScope:    userScope,
+	}, true
+}
 
-				return err
-			}
-		default:
-			return fmt.Errorf("invalid credential type: %s - must be 'user'", credentialType)
+// completePodSecretRequest completes the request of a pod with its role,
+// credential type, output format and limits, and resolves the options of its
+// user. Invalid annotations and denials of the policy are recorded as events
+// on the pod.
+func (c *NATSTowerOperator) completePodSecretRequest(pod *corev1.Pod, request *secretRequest) (natstower.UserOptions, bool) {
+	// 2a. resolve the optional user role from the role label & permission annotations
+	userOptions := natstower.UserOptions{
+		Role: pod.Labels[natsTowerRoleLabelKey],
+	}
+	if request.UserScope == userScopePod {
+		// Only users of single pods end with the deadline, shared users outlive it
+		userOptions.Expires = c.getJobCredentialsExpiry(pod)
+	}
+
+	subjectData := getSubjectTemplateData(pod, c.towerOperatorConfig.ClusterID, request.UserScope)
+	if err := getRolePermissions(pod.Annotations, subjectData, &userOptions); err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidRolePermissions",
+			"Invalid permission annotations: %v", err)
+		return natstower.UserOptions{}, false
+	}
+
+	if invalid := validateRoleSubjects(userOptions); len(invalid) > 0 {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidSubject",
+			"Invalid subjects: %s", strings.Join(invalid, "; "))
+		return natstower.UserOptions{}, false
+	}
+
+	if userOptions.Role == "" && hasRolePermissions(userOptions) {
+		// Permission annotations are only meaningful together with a role label
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"MissingRoleLabel",
+			"Require label %s when permission annotations like %s or %s are set",
+			natsTowerRoleLabelKey,
+			natsTowerPublishAnnotationKey,
+			natsTowerSubscribeAnnotationKey)
+		return natstower.UserOptions{}, false
+	}
+
+	// 2b. check the request against the local policy before asking NATS Tower
+	if err := checkPolicy(c.towerOperatorConfig.Policy,
+		pod.Namespace,
+		request.Account,
+		userOptions.Role,
+		userOptions,
+		c.towerOperatorConfig.ClusterID); err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"PolicyDenied",
+			"Denied by policy: %v", err)
+		return natstower.UserOptions{}, false
+	}
+
+	// Roles of differing permissions, e.g. of other namespaces, must not share a name
+	userOptions.Role = getRoleName(userOptions)
+
+	// 3. check which type of credentials is required
+	credentialType, err := getCredentialType(pod.Labels, podCredentialTypes)
+	if err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidCredentialType",
+			"Invalid label %s: %v", natsTowerCredentialTypeLabelKey, err)
+		return natstower.UserOptions{}, false
+	}
+
+	_, err = getCredentialTypeURLs(c.towerOperatorConfig.ValidInstallations[request.Installation],
+		credentialType)
+	if err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"MissingInstallationURLs",
+			"Can not issue %s credentials for installation '%s': %v",
+			credentialType, request.Installation, err)
+		return natstower.UserOptions{}, false
+	}
+
+	// 3a. check in which format the credentials are written
+	outputFormat, outputTemplate, err := getOutputFormat(pod.Annotations)
+	if err == nil {
+		err = checkCredentialTypeOutputFormat(credentialType, outputFormat)
+	}
+	if err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidOutputFormat",
+			"Invalid annotation %s: %v", natsTowerOutputFormatAnnotationKey, err)
+		return natstower.UserOptions{}, false
+	}
+
+	err = checkUserScope(request.UserScope, credentialType, outputFormat)
+	if err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidUserScope",
+			"Invalid annotation %s: %v", natsTowerUserScopeAnnotationKey, err)
+		return natstower.UserOptions{}, false
+	}
+	if request.UserScope == userScopePod {
+		if exposing := getExposingContainers(pod, pod.Labels[natsTowerSecretLabelKey]); len(exposing) > 0 {
+			// The pod is still provisioned, its own key is not at risk
+			c.eventRecorder.Eventf(pod,
+				corev1.EventTypeWarning,
+				"PodCredentialsExposed",
+				"Containers %s can read the credentials of all pods of secret %s, mount only the key of the pod with subPathExpr: $(POD_NAME)%s",
+				strings.Join(exposing, ", "), pod.Labels[natsTowerSecretLabelKey], podCredentialsKeySuffix)
 		}
+	}
 
-		// TODO check URLS and restart pod?
+	configMap, configMapKeepKeys, err := getConfigMapName(pod.Annotations)
+	if err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidConfigMap",
+			"Invalid annotation %s: %v", natsTowerConfigMapAnnotationKey, err)
+		return natstower.UserOptions{}, false
+	}
 
-		return natsTowerOperator.UpsertSecret(ctx,
-			&obj,
-			obj.Namespace,
-			obj.Labels[natsTowerSecretLabelKey],
-			credentialType,
-			creds,
-			secret)
+	// 3b. check the limits of the user
+	userOptions.Limits, userOptions.AllowedConnectionTypes, err = getUserLimits(pod.Annotations)
+	if err == nil && len(userOptions.AllowedConnectionTypes) > 0 && credentialType != credentialTypeUser {
+		err = fmt.Errorf("%s can not be used with credential type '%s'",
+			natsTowerAllowedConnectionTypesAnnotationKey, credentialType)
 	}
+	if err != nil {
+		c.eventRecorder.Eventf(pod,
+			corev1.EventTypeWarning,
+			"InvalidUserLimits",
+			"Invalid limits: %v", err)
+		return natstower.UserOptions{}, false
+	}
+
+	request.Role = userOptions.Role
+	request.GeneratedRole = hasRolePermissions(userOptions)
+	if request.UserScope == userScopePod {
+		// Pods with their own user may differ in their role
+		request.Role = pod.Labels[natsTowerRoleLabelKey]
+		request.GeneratedRole = false
+	}
+	request.CredentialType = credentialType
+	request.OutputFormat = outputFormat
+	request.OutputTemplate = outputTemplate
+	request.ConfigMap = configMap
+	request.ConfigMapKeepKeys = configMapKeepKeys
+	request.Limits = formatUserLimits(userOptions.Limits, userOptions.AllowedConnectionTypes)
+
+	// 3c. bearer tokens expire and are renewed before they run out
+	setBearerTokenExpiry(credentialType, c.bearerTokenTTL(), &userOptions)
+
+	return userOptions, true
 }
 
 // parseSubjects splits a role permission annotation value into a list of NATS
 // subjects. Values may be separated by newlines or commas; empty entries and
-// surrounding whitespace are dropped.
-func parseSubjects(value string) []string {
+// surrounding whitespace are dropped. Go templates in the value are expanded
+// with the data first.
+func parseSubjects(value string, data any) ([]string, error) {
 	if value == "" {
-		return nil
+		return nil, nil
+	}
+
+	if strings.Contains(value, "{{") {
+		tmpl, err := template.New("subjects").Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject template '%s': %v", value, err)
+		}
+		var expanded strings.Builder
+		err = tmpl.Execute(&expanded, data)
+		if err != nil {
+			return nil, fmt.Errorf("error expanding subject template '%s': %v", value, err)
+		}
+		value = expanded.String()
 	}
 
 	fields := strings.FieldsFunc(value, func(r rune) bool {
@@ -236,8 +463,8 @@ func parseSubjects(value string) []string {
 	}
 
 	if len(subjects) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	return subjects
+	return subjects, nil
 }
@@ -0,0 +1,463 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+func newTestPod(name string, labels, annotations map[string]string) *corev1.Pod {
+	podLabels := map[string]string{
+		natsTowerSecretLabelKey:  "app-creds",
+		natsTowerAccountLabelKey: testAccount,
+	}
+	for key, value := range labels {
+		podLabels[key] = value
+	}
+	return &corev1.Pod{
+		TypeMeta: v1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   testNamespace,
+			UID:         types.UID(name + "-uid"),
+			Labels:      podLabels,
+			Annotations: annotations,
+		},
+	}
+}
+
+// reconcilePod runs the pod handler and returns its error.
+func (o *testOperator) reconcilePod(pod *corev1.Pod) error {
+	o.cache(testPodGVR, pod)
+	return getPodHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: pod.Namespace + "/" + pod.Name}, *pod)
+}
+
+// requeuedAfter returns the delay of a scheduled reconcile, zero if none.
+func requeuedAfter(err error) time.Duration {
+	var requeueErr *k8s.RequeueAfterError
+	if errors.As(err, &requeueErr) && requeueErr.Err == nil {
+		return requeueErr.After
+	}
+	return 0
+}
+
+func TestPodBearerTokenExpiresAndIsRenewed(t *testing.T) {
+	o := newTestOperator(t)
+	o.towerOperatorConfig.BearerTokenTTL = 60
+	o.towerOperatorConfig.ValidInstallations[testInstallation] = config.Installation{WebsocketURLs: "wss://nats:443"}
+	pod := newTestPod("frontend", map[string]string{natsTowerCredentialTypeLabelKey: credentialTypeBearer}, nil)
+
+	err := o.reconcilePod(pod)
+	if after := requeuedAfter(err); after < 29*time.Minute || after > 30*time.Minute {
+		t.Fatalf("expected renewal to be scheduled after half the TTL, got %v", err)
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if secret == nil || secret.Annotations[natsTowerExpiresAnnotationKey] == "" {
+		t.Fatalf("expected the secret to record the expiry, got %+v", secret)
+	}
+	users := o.tower.find("nats_auth_users", map[string]string{"name": "app-creds"})
+	if len(users) != 1 || users[0]["expires"] == nil {
+		t.Fatalf("expected the bearer user to expire, got %+v", users)
+	}
+
+	// Renewal is not due yet
+	o.cache(testSecretGVR, secret)
+	err = o.reconcilePod(pod)
+	if requeuedAfter(err) == 0 || o.tower.countRequests("PATCH", "nats_auth_users") != 0 {
+		t.Fatalf("expected no renewal before half the TTL, got %v", err)
+	}
+
+	// Time passed, the token expires within half its TTL
+	expires := time.Now().Add(10 * time.Minute).UTC()
+	users[0]["expires"] = expires.Format("2006-01-02 15:04:05.000Z")
+	secret.Annotations[natsTowerExpiresAnnotationKey] = expires.Format(time.RFC3339)
+	secret.Annotations[natsTowerContentHashAnnotationKey] = getSecretContentHash(secret)
+	_, _ = o.clientset.CoreV1().Secrets(testNamespace).Update(context.Background(), secret, v1.UpdateOptions{})
+	o.cache(testSecretGVR, secret)
+
+	err = o.reconcilePod(pod)
+	if requeuedAfter(err) < 29*time.Minute {
+		t.Fatalf("expected the next renewal to be scheduled, got %v", err)
+	}
+	if o.tower.countRequests("PATCH", "nats_auth_users") != 1 {
+		t.Errorf("expected the token to be renewed on NATS Tower")
+	}
+	renewed := o.getSecretOrNil(testNamespace, "app-creds")
+	if renewed.Annotations[natsTowerExpiresAnnotationKey] == secret.Annotations[natsTowerExpiresAnnotationKey] {
+		t.Errorf("expected the secret to get the renewed token")
+	}
+}
+
+// newTestDeploymentPods creates a Deployment with a ReplicaSet and returns
+// pods of it with the given names.
+func (o *testOperator) newTestDeploymentPods(annotations map[string]string, names ...string) []*corev1.Pod {
+	ctx := context.Background()
+	deployment, err := o.clientset.AppsV1().Deployments(testNamespace).Create(ctx, &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "frontend", Namespace: testNamespace, UID: "deployment-uid"},
+	}, v1.CreateOptions{})
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	controller := true
+	replicaSet, err := o.clientset.AppsV1().ReplicaSets(testNamespace).Create(ctx, &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "frontend-5d4f", Namespace: testNamespace, UID: "replicaset-uid",
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment",
+				Name: deployment.Name, UID: deployment.UID, Controller: &controller}}},
+	}, v1.CreateOptions{})
+	if err != nil {
+		o.t.Fatal(err)
+	}
+
+	pods := make([]*corev1.Pod, 0, len(names))
+	for _, name := range names {
+		pod := newTestPod(name, nil, annotations)
+		pod.OwnerReferences = []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet",
+			Name: replicaSet.Name, UID: replicaSet.UID, Controller: &controller}}
+		pods = append(pods, pod)
+	}
+	return pods
+}
+
+func TestPodScopeSharesSecretWithPodKeys(t *testing.T) {
+	o := newTestOperator(t)
+	pods := o.newTestDeploymentPods(map[string]string{
+		natsTowerUserScopeAnnotationKey:       userScopePod,
+		natsTowerRestartOnChangeAnnotationKey: "true",
+	}, "frontend-a", "frontend-b")
+
+	for _, pod := range pods {
+		if err := o.reconcilePod(pod); err != nil && requeuedAfter(err) == 0 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if secret == nil {
+		t.Fatal("expected the secret of the label to be created")
+	}
+	for _, key := range []string{"frontend-a.creds", "frontend-b.creds", "URLS", "ACCOUNT_NAME"} {
+		if len(secret.Data[key]) == 0 {
+			t.Errorf("expected key %s in secret, got %v", key, slices.Collect(maps.Keys(secret.Data)))
+		}
+	}
+	if secret.Annotations[natsTowerUserScopeAnnotationKey] != userScopePod || secret.Annotations[natsTowerUserAnnotationKey] != "" {
+		t.Errorf("expected the secret to record the pod scope without a user, got %v", secret.Annotations)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Kind != "ReplicaSet" {
+		t.Errorf("expected the workload to own the secret, got %v", secret.OwnerReferences)
+	}
+	if !o.hasTowerUser("app-creds-frontend-a") || !o.hasTowerUser("app-creds-frontend-b") {
+		t.Fatal("expected a user per pod on NATS Tower")
+	}
+	deployment, _ := o.clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "frontend", v1.GetOptions{})
+	if deployment.Spec.Template.Annotations[natsTowerSecretChecksumAnnotationKey] != "" {
+		t.Error("expected new pods not to restart the workload")
+	}
+
+	// The first pod is deleted
+	err := getPodHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/frontend-a", Deleted: true}, *pods[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.hasTowerUser("app-creds-frontend-a") || !o.hasTowerUser("app-creds-frontend-b") {
+		t.Error("expected only the user of the deleted pod to be removed")
+	}
+	secret = o.getSecretOrNil(testNamespace, "app-creds")
+	if _, ok := secret.Data["frontend-a.creds"]; ok || len(secret.Data["frontend-b.creds"]) == 0 {
+		t.Errorf("expected only the key of the deleted pod to be removed, got %v", slices.Collect(maps.Keys(secret.Data)))
+	}
+	if hasSecretDrifted(secret) {
+		t.Error("expected the content hash to cover the removed key")
+	}
+
+	// The secret is deleted with the workload, its users are revoked with their pods
+	err = getSecretHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/app-creds", Deleted: true}, *secret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !o.hasTowerUser("app-creds-frontend-b") {
+		t.Error("expected the secret handler to leave the users of pods alone")
+	}
+}
+
+func TestPodScopeRestartsWorkloadOnChange(t *testing.T) {
+	o := newTestOperator(t)
+	pods := o.newTestDeploymentPods(map[string]string{
+		natsTowerUserScopeAnnotationKey:       userScopePod,
+		natsTowerRestartOnChangeAnnotationKey: "true",
+	}, "frontend-a")
+	if err := o.reconcilePod(pods[0]); err != nil && requeuedAfter(err) == 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if err := o.RestartWorkloads(context.Background(), secret, "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deployment, _ := o.clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "frontend", v1.GetOptions{})
+	if deployment.Spec.Template.Annotations[natsTowerSecretChecksumAnnotationKey] != secret.Annotations[natsTowerContentHashAnnotationKey] {
+		t.Errorf("expected the pods of the secret label to restart their workload, got %v", deployment.Spec.Template.Annotations)
+	}
+}
+
+func TestPodScopeRequiresCredsFormat(t *testing.T) {
+	o := newTestOperator(t)
+	pod := newTestPod("frontend", nil, map[string]string{
+		natsTowerUserScopeAnnotationKey:    userScopePod,
+		natsTowerOutputFormatAnnotationKey: outputFormatEnv,
+	})
+
+	if err := o.reconcilePod(pod); err != nil && requeuedAfter(err) == 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasEvent(o.events(), "InvalidUserScope") {
+		t.Errorf("expected an InvalidUserScope event, got %v", o.events())
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected no secret to be created")
+	}
+}
+
+func TestPodPermissionChangeRebindsUser(t *testing.T) {
+	o := newTestOperator(t)
+	labels := map[string]string{natsTowerRoleLabelKey: "orders"}
+	pod := newTestPod("frontend", labels, map[string]string{natsTowerPublishAnnotationKey: "orders.created"})
+	if err := o.reconcilePod(pod); err != nil && requeuedAfter(err) == 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	oldRole := secret.Annotations[natsTowerRoleLabelKey]
+	if oldRole == "" || secret.Annotations[natsTowerGeneratedRoleAnnotationKey] != "true" {
+		t.Fatalf("expected the secret to record the generated role, got %v", secret.Annotations)
+	}
+
+	// The permissions of the workload change
+	o.cache(testSecretGVR, secret)
+	pod = newTestPod("frontend", labels, map[string]string{natsTowerPublishAnnotationKey: "orders.updated"})
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if o.tower.countRequests("PATCH", "nats_auth_users") != 1 {
+		t.Error("expected the user to be bound to the new role")
+	}
+	secret = o.getSecretOrNil(testNamespace, "app-creds")
+	newRole := secret.Annotations[natsTowerRoleLabelKey]
+	if newRole == oldRole {
+		t.Errorf("expected the secret to record the new role, got %s", newRole)
+	}
+	if len(o.tower.find("nats_auth_signing_keys", map[string]string{"role": oldRole})) != 0 {
+		t.Error("expected the unused role to be removed")
+	}
+	if len(o.tower.find("nats_auth_signing_keys", map[string]string{"role": newRole})) != 1 {
+		t.Error("expected the new role to be kept")
+	}
+
+	// The role is removed with the last user bound to it
+	_ = o.clientset.CoreV1().Secrets(testNamespace).Delete(context.Background(), "app-creds", v1.DeleteOptions{})
+	err := getSecretHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/app-creds", Deleted: true}, *secret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(o.tower.find("nats_auth_signing_keys", map[string]string{"role": newRole})) != 0 {
+		t.Error("expected the role to be removed with its user")
+	}
+}
+
+func TestPodNameTemplateRequiresPodScope(t *testing.T) {
+	o := newTestOperator(t)
+	pod := newTestPod("frontend", map[string]string{natsTowerRoleLabelKey: "orders"},
+		map[string]string{natsTowerPublishAnnotationKey: "orders.{{ .PodName }}"})
+
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasEvent(o.events(), "InvalidRolePermissions") {
+		t.Error("expected an InvalidRolePermissions event")
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected no secret to be created")
+	}
+}
+
+func TestPodPermissionConflict(t *testing.T) {
+	o := newTestOperator(t)
+	labels := map[string]string{natsTowerRoleLabelKey: "orders"}
+	if err := o.reconcilePod(newTestPod("frontend", labels, map[string]string{natsTowerPublishAnnotationKey: "orders.created"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	// Another workload asks for the same role label with other permissions
+	pod := newTestPod("backend", labels, map[string]string{natsTowerPublishAnnotationKey: "orders.>"})
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !hasEvent(o.events(), "SecretConflict") {
+		t.Error("expected a SecretConflict event for the other permissions")
+	}
+	if o.tower.countRequests("PATCH", "nats_auth_users") != 0 {
+		t.Error("expected the user not to be re-bound")
+	}
+}
+
+func TestPodRolloutKeepsSoleOwner(t *testing.T) {
+	o := newTestOperator(t)
+	pods := o.newTestDeploymentPods(nil, "frontend-a")
+	if err := o.reconcilePod(pods[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A rollout creates a second ReplicaSet of the Deployment
+	controller := true
+	replicaSet, err := o.clientset.AppsV1().ReplicaSets(testNamespace).Create(context.Background(), &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "frontend-7c9e", Namespace: testNamespace, UID: "replicaset-2-uid",
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment",
+				Name: "frontend", UID: "deployment-uid", Controller: &controller}}},
+	}, v1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := newTestPod("frontend-b", nil, nil)
+	pod.OwnerReferences = []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet",
+		Name: replicaSet.Name, UID: replicaSet.UID, Controller: &controller}}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	o.clientset.ClearActions()
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range o.clientset.Actions() {
+		if action.GetResource().Resource == "replicasets" {
+			t.Errorf("expected no ReplicaSet lookup without a differing parameter, got %s", action.GetVerb())
+		}
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if len(secret.OwnerReferences) != 2 {
+		t.Fatalf("expected both ReplicaSets to own the secret, got %v", secret.OwnerReferences)
+	}
+
+	// The new pods of the Deployment change the output format
+	o.cache(testSecretGVR, secret)
+	pod.Annotations = map[string]string{natsTowerOutputFormatAnnotationKey: outputFormatEnv}
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hasEvent(o.events(), "SecretConflict") {
+		t.Error("expected the ReplicaSets of one Deployment to count as one owner")
+	}
+	secret = o.getSecretOrNil(testNamespace, "app-creds")
+	if secret.Annotations[natsTowerOutputFormatAnnotationKey] != outputFormatEnv {
+		t.Errorf("expected the output format to change, got %v", secret.Annotations)
+	}
+}
+
+func TestLeafnodeRestrictsExistingUser(t *testing.T) {
+	o := newTestOperator(t)
+	o.towerOperatorConfig.ValidInstallations[testInstallation] = config.Installation{
+		LeafnodeURLs: "nats-leaf://hub:7422",
+	}
+	// The user exists unrestricted under the secret name
+	o.towerUser("app-creds")
+
+	pod := newTestPod("edge", map[string]string{natsTowerCredentialTypeLabelKey: credentialTypeLeafnode}, nil)
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	users := o.tower.find("nats_auth_users", map[string]string{"name": "app-creds"})
+	if len(users) != 1 {
+		t.Fatalf("expected the existing user to be reused, got %d users", len(users))
+	}
+	connectionTypes, _ := users[0]["allowed_connection_types"].([]any)
+	if len(connectionTypes) != 1 || connectionTypes[0] != "LEAFNODE" {
+		t.Errorf("expected the existing user to be restricted to LEAFNODE, got %v", users[0]["allowed_connection_types"])
+	}
+}
+
+func TestPodTemplateRequiresValidKeys(t *testing.T) {
+	o := newTestOperator(t)
+	pod := newTestPod("frontend", nil, map[string]string{
+		natsTowerOutputFormatAnnotationKey:   outputFormatTemplate,
+		natsTowerOutputTemplateAnnotationKey: "'my key': '{{ .URLs }}'",
+	})
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("expected no retry, got %v", err)
+	}
+	if events := o.events(); !hasEvent(events, "InvalidOutputFormat") {
+		t.Errorf("expected an InvalidOutputFormat event, got %v", events)
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected no secret to be created")
+	}
+}
+
+func TestPodRefusesUserOfOtherNamespace(t *testing.T) {
+	o := newTestOperator(t)
+	user := o.otherNamespaceUser("app-creds")
+	creds := user["creds"]
+	pod := newTestPod("frontend", nil, map[string]string{natsTowerMaxPayloadAnnotationKey: "1024"})
+
+	if err := o.reconcilePod(pod); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := o.events(); !hasEvent(events, "UserNotOwned") {
+		t.Errorf("expected a UserNotOwned event, got %v", events)
+	}
+	if o.tower.countRequests("PATCH", "nats_auth_users") != 0 || user["signing_key"] != "other-role" || user["creds"] != creds {
+		t.Errorf("expected the user of the other namespace to be left unchanged, got %v", user)
+	}
+	if o.getSecretOrNil(testNamespace, "app-creds") != nil {
+		t.Error("expected the credentials of the other namespace not to be handed out")
+	}
+}
+
+func TestPodScopeWarnsAboutExposedCredentials(t *testing.T) {
+	o := newTestOperator(t)
+	annotations := map[string]string{natsTowerUserScopeAnnotationKey: userScopePod}
+	withMount := func(pod *corev1.Pod, mount corev1.VolumeMount) *corev1.Pod {
+		pod.Spec.Volumes = []corev1.Volume{{Name: "nats-creds", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "app-creds"}}}}
+		pod.Spec.Containers = []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{mount}}}
+		return pod
+	}
+
+	// Only the key of the pod is mounted
+	own := withMount(newTestPod("frontend-a", nil, annotations),
+		corev1.VolumeMount{Name: "nats-creds", MountPath: "/etc/nats/nats.creds", SubPathExpr: "$(POD_NAME).creds"})
+	if err := o.reconcilePod(own); err != nil && requeuedAfter(err) == 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := o.events(); hasEvent(events, "PodCredentialsExposed") {
+		t.Errorf("expected no PodCredentialsExposed event, got %v", events)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	// The whole secret is mounted
+	all := withMount(newTestPod("frontend-b", nil, annotations),
+		corev1.VolumeMount{Name: "nats-creds", MountPath: "/etc/nats"})
+	if err := o.reconcilePod(all); err != nil && requeuedAfter(err) == 0 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := o.events(); !hasEvent(events, "PodCredentialsExposed") {
+		t.Errorf("expected a PodCredentialsExposed event, got %v", events)
+	}
+	if len(o.getSecretOrNil(testNamespace, "app-creds").Data["frontend-b.creds"]) == 0 {
+		t.Error("expected the pod to be provisioned anyway")
+	}
+}
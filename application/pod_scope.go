@@ -0,0 +1,206 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// podCredentialsKeySuffix is appended to the pod name to get the key of the
+// credentials of a pod with its own user. Pods mount it with
+// subPathExpr: $(POD_NAME).creds
+const podCredentialsKeySuffix = ".creds"
+
+func getPodCredentialsKey(podName string) string {
+	return podName + podCredentialsKeySuffix
+}
+
+// getPodUserName returns the name of the NATS Tower user of a pod with its
+// own user.
+func getPodUserName(secretName string, pod *corev1.Pod) string {
+	return secretName + "-" + pod.Name
+}
+
+// checkUserScope checks that the credentials of the user scope can be
+// written. Pods with their own user share the secret of their workload, each
+// of them with a key holding its creds file.
+func checkUserScope(userScope, credentialType, outputFormat string) error {
+	if userScope != userScopePod {
+		return nil
+	}
+	if credentialType != credentialTypeUser {
+		return fmt.Errorf("the user scope '%s' only supports the credential type '%s'", userScopePod, credentialTypeUser)
+	}
+	if outputFormat != outputFormatCreds {
+		return fmt.Errorf("the user scope '%s' only supports the output format '%s'", userScopePod, outputFormatCreds)
+	}
+	return nil
+}
+
+// getExposingContainers returns the containers of a pod with its own user that
+// can read the credentials of the other pods of the secret: they mount the
+// whole secret instead of only the key of the pod, or load it into their
+// environment. The keys of all pods share one secret, so only the mount
+// keeps the pods apart.
+func getExposingContainers(pod *corev1.Pod, secretName string) []string {
+	volumes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == secretName {
+			volumes[volume.Name] = exposesPodKeys(volume.Secret.Items, pod)
+		}
+		if volume.Projected == nil {
+			continue
+		}
+		for _, source := range volume.Projected.Sources {
+			if source.Secret != nil && source.Secret.Name == secretName {
+				volumes[volume.Name] = volumes[volume.Name] || exposesPodKeys(source.Secret.Items, pod)
+			}
+		}
+	}
+
+	var exposing []string
+	for _, container := range append(slices.Clone(pod.Spec.InitContainers), pod.Spec.Containers...) {
+		exposed := slices.ContainsFunc(container.VolumeMounts, func(mount corev1.VolumeMount) bool {
+			return volumes[mount.Name] && mount.SubPath == "" && mount.SubPathExpr == ""
+		}) || slices.ContainsFunc(container.EnvFrom, func(env corev1.EnvFromSource) bool {
+			return env.SecretRef != nil && env.SecretRef.Name == secretName
+		})
+		if exposed {
+			exposing = append(exposing, container.Name)
+		}
+	}
+	return exposing
+}
+
+// exposesPodKeys reports whether the items of a secret volume include the keys
+// of other pods. Without items all keys are projected.
+func exposesPodKeys(items []corev1.KeyToPath, pod *corev1.Pod) bool {
+	if len(items) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(items, func(item corev1.KeyToPath) bool {
+		return strings.HasSuffix(item.Key, podCredentialsKeySuffix) && item.Key != getPodCredentialsKey(pod.Name)
+	})
+}
+
+// secretHasPodCredentials reports whether the secret holds credentials the
+// pod can use. Pods with their own user need a key of their own.
+func secretHasPodCredentials(secret *corev1.Secret, pod *corev1.Pod, request secretRequest) bool {
+	if request.UserScope == userScopePod {
+		return len(secret.Data[getPodCredentialsKey(pod.Name)]) > 0
+	}
+	return len(secret.Data) > 0
+}
+
+// renderSourceData renders the secret data with the credentials requested by
+// the source. Pods with their own user keep the keys of the other pods, which
+// they must not mount, see getExposingContainers.
+func renderSourceData(secret *corev1.Secret,
+	source runtime.Object,
+	user string,
+	request secretRequest,
+	creds *natstower.ConnectionInfo) (map[string][]byte, error) {
+	pod, ok := source.(*corev1.Pod)
+	if !ok || request.UserScope != userScopePod {
+		return renderSecretData(user, request, creds)
+	}
+
+	data := map[string][]byte{}
+	for key, value := range secret.Data {
+		if strings.HasSuffix(key, podCredentialsKeySuffix) {
+			data[key] = value
+		}
+	}
+	data[getPodCredentialsKey(pod.Name)] = []byte(creds.Creds)
+	if request.ConfigMap == "" || request.ConfigMapKeepKeys {
+		data["URLS"] = []byte(creds.URLs)
+		data["ACCOUNT_NAME"] = []byte(creds.AccountName)
+	}
+	return data, nil
+}
+
+// needsRestart reports whether pods could have used data of the secret that
+// changed. Pods with their own user only read the shared keys and their own
+// key, so the keys of new pods do not restart the workload.
+func needsRestart(previousData map[string][]byte, secret *corev1.Secret) bool {
+	if len(previousData) == 0 {
+		return false
+	}
+	if secret.Annotations[natsTowerUserScopeAnnotationKey] != userScopePod {
+		return !maps.EqualFunc(previousData, secret.Data, bytes.Equal)
+	}
+	for key, value := range previousData {
+		if !bytes.Equal(value, secret.Data[key]) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokePodUser removes the user of a deleted pod from NATS Tower and its key
+// from the secret. This is the only place users of pods are revoked, the
+// secret handler leaves them alone.
+func (c *NATSTowerOperator) revokePodUser(ctx context.Context,
+	pod *corev1.Pod,
+	installationPublicKey, account, secretName string) error {
+	user := getPodUserName(secretName, pod)
+	err := c.natsTowerClient.RemoveUserAuth(ctx,
+		pod.Namespace,
+		installationPublicKey,
+		account,
+		user)
+	if err == natstower.ErrUserNotOwned {
+		klog.Infof("pod[%s]: user '%s' of account '%s' belongs to another namespace, skip removing it",
+			pod.Name, user, account)
+		err = nil
+	}
+	if err != nil {
+		klog.Errorf("pod[%s]: could not remove user '%s' of account '%s' in namespace[%s]: %v",
+			pod.Name, user, account, pod.Namespace, err)
+		return err
+	}
+
+	klog.Infof("pod[%s]: removed user '%s' of account '%s' in namespace[%s]",
+		pod.Name, user, account, pod.Namespace)
+
+	err = c.removePodRole(ctx, pod, installationPublicKey, account)
+	if err != nil {
+		return err
+	}
+
+	secret, err := c.k8sClient.ClientSet.CoreV1().Secrets(pod.Namespace).Get(ctx, secretName, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// Removed together with the workload
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !isManagedSecret(secret) || secret.Annotations[natsTowerUserScopeAnnotationKey] != userScopePod {
+		return nil
+	}
+	key := getPodCredentialsKey(pod.Name)
+	if _, ok := secret.Data[key]; !ok {
+		return nil
+	}
+
+	delete(secret.Data, key)
+	secret.Annotations[natsTowerContentHashAnnotationKey] = getSecretContentHash(secret)
+	_, err = c.k8sClient.ClientSet.CoreV1().Secrets(pod.Namespace).Update(ctx, secret, v1.UpdateOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
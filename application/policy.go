@@ -0,0 +1,110 @@
+package application
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+	"github.com/nats-tower/nats-tower-operator/utils/subject"
+)
+
+// checkPolicy evaluates the policy for the request of a pod or NACK Account.
+// Without a policy, everything is allowed. The error explains why a request
+// was denied.
+func checkPolicy(policy *config.Policy,
+	namespace, account, role string,
+	opts natstower.UserOptions,
+	clusterID string) error {
+	if policy == nil {
+		return nil
+	}
+
+	var denied error
+	for _, rule := range policy.Rules {
+		if !matchesAny(rule.Namespaces, namespace) || !matchesAny(rule.Accounts, account) {
+			continue
+		}
+		err := checkPolicyRule(rule, role, opts, config.PolicySubjectData{
+			Namespace: namespace,
+			ClusterID: clusterID,
+		})
+		if err == nil {
+			return nil
+		}
+		if denied == nil {
+			denied = err
+		}
+	}
+
+	if denied == nil {
+		return fmt.Errorf("namespace '%s' may not use account '%s'", namespace, account)
+	}
+	return denied
+}
+
+// checkPolicyRule checks the role and subjects of a request against a rule
+// matching its namespace and account.
+func checkPolicyRule(rule config.PolicyRule,
+	role string,
+	opts natstower.UserOptions,
+	data config.PolicySubjectData) error {
+	if len(rule.Roles) > 0 {
+		if role == "" {
+			return fmt.Errorf("a role of %s is required", strings.Join(rule.Roles, ", "))
+		}
+		if !matchesAny(rule.Roles, role) {
+			return fmt.Errorf("role '%s' is not one of %s", role, strings.Join(rule.Roles, ", "))
+		}
+	}
+
+	if len(rule.Subjects) == 0 {
+		return nil
+	}
+	if role == "" {
+		// Users without a role get the full permissions of the account
+		return fmt.Errorf("a role is required to limit the subjects to %s", strings.Join(rule.Subjects, ", "))
+	}
+	if !hasRolePermissions(opts) {
+		// The permissions of roles managed on NATS Tower are not known, they
+		// are only allowed if the rule lists them
+		if len(rule.Roles) == 0 {
+			return fmt.Errorf("role '%s' has no permission annotations to check against %s",
+				role, strings.Join(rule.Subjects, ", "))
+		}
+		return nil
+	}
+
+	var patterns []string
+	for _, pattern := range rule.Subjects {
+		expanded, err := parseSubjects(pattern, data)
+		if err != nil {
+			return fmt.Errorf("invalid policy subject: %v", err)
+		}
+		patterns = append(patterns, expanded...)
+	}
+
+	requested := slices.Concat(opts.Publish, opts.Subscribe)
+	for _, queueSubscription := range opts.QueueSubscribe {
+		requested = append(requested, queueSubscription.Subject)
+	}
+	for _, requestedSubject := range requested {
+		covered := slices.ContainsFunc(patterns, func(pattern string) bool {
+			return subject.IsSubsetOf(requestedSubject, pattern)
+		})
+		if !covered {
+			return fmt.Errorf("subject '%s' is not within %s", requestedSubject, strings.Join(patterns, ", "))
+		}
+	}
+	return nil
+}
+
+// matchesAny reports whether the value matches one of the glob patterns.
+func matchesAny(patterns []string, value string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, value)
+		return matched
+	})
+}
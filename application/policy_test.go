@@ -0,0 +1,66 @@
+package application
+
+import (
+	"testing"
+
+	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+func TestCheckPolicy(t *testing.T) {
+	policy := &config.Policy{Rules: []config.PolicyRule{{
+		Namespaces: []string{"team-*"},
+		Accounts:   []string{"orders"},
+		Roles:      []string{"orders-*"},
+		Subjects:   []string{"orders.{{ .Namespace }}.>"},
+	}}}
+	tests := []struct {
+		name      string
+		namespace string
+		account   string
+		opts      natstower.UserOptions
+		allowed   bool
+	}{
+		{"allowed", "team-a", "orders", natstower.UserOptions{Role: "orders-writer", Publish: []string{"orders.team-a.created"}}, true},
+		{"other namespace", "billing", "orders", natstower.UserOptions{Role: "orders-writer"}, false},
+		{"other account", "team-a", "billing", natstower.UserOptions{Role: "orders-writer"}, false},
+		{"no role", "team-a", "orders", natstower.UserOptions{}, false},
+		{"other role", "team-a", "orders", natstower.UserOptions{Role: "admin"}, false},
+		{"foreign subject", "team-a", "orders", natstower.UserOptions{Role: "orders-reader", Subscribe: []string{"orders.team-b.>"}}, false},
+		{"wildcard", "team-a", "orders", natstower.UserOptions{Role: "orders-reader", Subscribe: []string{">"}}, false},
+		{"listed managed role", "team-a", "orders", natstower.UserOptions{Role: "orders-reader"}, true},
+	}
+
+	for _, test := range tests {
+		err := checkPolicy(policy, test.namespace, test.account, test.opts.Role, test.opts, "test")
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed=%t, got %v", test.name, test.allowed, err)
+		}
+	}
+
+	if err := checkPolicy(nil, "any", "any", "", natstower.UserOptions{}, "test"); err != nil {
+		t.Errorf("expected no policy to allow everything, got %v", err)
+	}
+}
+
+func TestCheckPolicyManagedRoles(t *testing.T) {
+	policy := &config.Policy{Rules: []config.PolicyRule{{
+		Namespaces: []string{"team-a"},
+		Accounts:   []string{"orders"},
+		Subjects:   []string{"orders.{{ .Namespace }}.>"},
+	}}}
+
+	// The permissions of a role managed on NATS Tower can not be checked
+	err := checkPolicy(policy, "team-a", "orders", "admin", natstower.UserOptions{Role: "admin"}, "test")
+	if err == nil {
+		t.Error("expected a role without permission annotations to be denied")
+	}
+
+	err = checkPolicy(policy, "team-a", "orders", "orders", natstower.UserOptions{
+		Role:    "orders",
+		Publish: []string{"orders.team-a.created"},
+	}, "test")
+	if err != nil {
+		t.Errorf("expected a role with permission annotations to be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package application
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+	"github.com/nats-tower/nats-tower-operator/utils/subject"
+)
+
+// Annotations with the permissions of a role besides publish and subscribe
+const (
+	natsTowerPublishDenyAnnotationKey       = "nats-tower.com/nats-tower-publish-deny"
+	natsTowerSubscribeDenyAnnotationKey     = "nats-tower.com/nats-tower-subscribe-deny"
+	natsTowerSubscribeQueueAnnotationKey    = "nats-tower.com/nats-tower-subscribe-queue"
+	natsTowerAllowResponsesAnnotationKey    = "nats-tower.com/nats-tower-allow-responses"
+	natsTowerAllowResponsesTTLAnnotationKey = "nats-tower.com/nats-tower-allow-responses-ttl"
+	natsTowerGeneratedRoleAnnotationKey     = "nats-tower.com/nats-tower-generated-role"
+)
+
+// subjectTemplateData is available to the templates in permission
+// annotations of pods with their own user.
+type subjectTemplateData struct {
+	Namespace string
+	PodName   string
+	Labels    map[string]string
+	ClusterID string
+}
+
+// sharedSubjectTemplateData is available to the templates in permission
+// annotations of pods sharing a user, whose role must not differ per pod.
+type sharedSubjectTemplateData struct {
+	Namespace string
+	Labels    map[string]string
+	ClusterID string
+}
+
+// getSubjectTemplateData returns the data for the templates in the
+// permission annotations of the pod. Templates using the pod name are only
+// valid for pods with their own user.
+func getSubjectTemplateData(pod *corev1.Pod, clusterID, userScope string) any {
+	if userScope == userScopePod {
+		return subjectTemplateData{
+			Namespace: pod.Namespace,
+			PodName:   pod.Name,
+			Labels:    pod.Labels,
+			ClusterID: clusterID,
+		}
+	}
+	return sharedSubjectTemplateData{
+		Namespace: pod.Namespace,
+		Labels:    pod.Labels,
+		ClusterID: clusterID,
+	}
+}
+
+// getRolePermissions resolves the permission annotations of the requesting
+// object into the options the role is created with.
+func getRolePermissions(annotations map[string]string, data any, opts *natstower.UserOptions) error {
+	for key, subjects := range map[string]*[]string{
+		natsTowerPublishAnnotationKey:       &opts.Publish,
+		natsTowerSubscribeAnnotationKey:     &opts.Subscribe,
+		natsTowerPublishDenyAnnotationKey:   &opts.PublishDeny,
+		natsTowerSubscribeDenyAnnotationKey: &opts.SubscribeDeny,
+	} {
+		var err error
+		*subjects, err = parseSubjects(annotations[key], data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	queueEntries, err := parseSubjects(annotations[natsTowerSubscribeQueueAnnotationKey], data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", natsTowerSubscribeQueueAnnotationKey, err)
+	}
+	opts.QueueSubscribe = nil
+	for _, entry := range queueEntries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: '%s' must be a subject followed by a queue group",
+				natsTowerSubscribeQueueAnnotationKey, entry)
+		}
+		opts.QueueSubscribe = append(opts.QueueSubscribe, natstower.QueueSubscription{
+			Subject: fields[0],
+			Queue:   fields[1],
+		})
+	}
+
+	opts.AllowResponses = nil
+	allowResponses := strings.TrimSpace(annotations[natsTowerAllowResponsesAnnotationKey])
+	ttl := strings.TrimSpace(annotations[natsTowerAllowResponsesTTLAnnotationKey])
+	switch allowResponses {
+	case "", "false":
+		if ttl != "" {
+			return fmt.Errorf("%s requires %s", natsTowerAllowResponsesTTLAnnotationKey, natsTowerAllowResponsesAnnotationKey)
+		}
+		return nil
+	case "true":
+		// Like in NATS, a single reply per request
+		opts.AllowResponses = &natstower.ResponsePermission{MaxMsgs: 1}
+	default:
+		maxMsgs, err := strconv.Atoi(allowResponses)
+		if err != nil || maxMsgs < 1 {
+			return fmt.Errorf("%s must be 'true' or a positive number of replies, got '%s'",
+				natsTowerAllowResponsesAnnotationKey, allowResponses)
+		}
+		opts.AllowResponses = &natstower.ResponsePermission{MaxMsgs: maxMsgs}
+	}
+
+	if ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("%s must be a positive duration like 5s, got '%s'",
+				natsTowerAllowResponsesTTLAnnotationKey, ttl)
+		}
+		opts.AllowResponses.TTL = duration
+	}
+	return nil
+}
+
+// validateRoleSubjects checks the syntax of all subjects and queue groups of
+// the role, so mistakes are reported per subject instead of being refused by
+// NATS Tower.
+func validateRoleSubjects(opts natstower.UserOptions) []string {
+	var invalid []string
+	for key, subjects := range map[string][]string{
+		natsTowerPublishAnnotationKey:       opts.Publish,
+		natsTowerSubscribeAnnotationKey:     opts.Subscribe,
+		natsTowerPublishDenyAnnotationKey:   opts.PublishDeny,
+		natsTowerSubscribeDenyAnnotationKey: opts.SubscribeDeny,
+	} {
+		for _, s := range subjects {
+			if err := subject.Validate(s); err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s: %v", key, err))
+			}
+		}
+	}
+	for _, queueSubscription := range opts.QueueSubscribe {
+		if err := subject.Validate(queueSubscription.Subject); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", natsTowerSubscribeQueueAnnotationKey, err))
+		}
+		if err := subject.ValidateQueue(queueSubscription.Queue); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", natsTowerSubscribeQueueAnnotationKey, err))
+		}
+	}
+	// Map iteration is random, keep the event stable
+	slices.Sort(invalid)
+	return invalid
+}
+
+// hasRolePermissions reports whether any permissions for the role are set.
+func hasRolePermissions(opts natstower.UserOptions) bool {
+	return len(opts.Publish) > 0 ||
+		len(opts.Subscribe) > 0 ||
+		len(opts.PublishDeny) > 0 ||
+		len(opts.SubscribeDeny) > 0 ||
+		len(opts.QueueSubscribe) > 0 ||
+		opts.AllowResponses != nil
+}
+
+// getRoleName derives the name of the role on NATS Tower from the role label
+// and the expanded permissions, so the same manifest creates a role per
+// namespace instead of reusing the role of another one. Roles without
+// permissions are managed on NATS Tower and keep their name.
+func getRoleName(opts natstower.UserOptions) string {
+	if opts.Role == "" || !hasRolePermissions(opts) {
+		return opts.Role
+	}
+
+	h := sha256.New()
+	for _, permission := range []struct {
+		name     string
+		subjects []string
+	}{
+		{"publish", opts.Publish},
+		{"subscribe", opts.Subscribe},
+		{"publish-deny", opts.PublishDeny},
+		{"subscribe-deny", opts.SubscribeDeny},
+	} {
+		fmt.Fprintf(h, "%s:%s\n", permission.name, strings.Join(permission.subjects, ","))
+	}
+	for _, queueSubscription := range opts.QueueSubscribe {
+		fmt.Fprintf(h, "subscribe-queue:%s %s\n", queueSubscription.Subject, queueSubscription.Queue)
+	}
+	if opts.AllowResponses != nil {
+		fmt.Fprintf(h, "allow-responses:%d %s\n", opts.AllowResponses.MaxMsgs, opts.AllowResponses.TTL)
+	}
+
+	return opts.Role + "-" + hex.EncodeToString(h.Sum(nil))[:10]
+}
+
+// secretHasRole reports whether the secret was written for the requested
+// role.
+func secretHasRole(secret *corev1.Secret, request secretRequest) bool {
+	return secret.Annotations[natsTowerRoleLabelKey] == request.Role
+}
+
+// removeGeneratedRole removes the role recorded on the secret from NATS Tower
+// if the operator generated it from permission annotations and no user is
+// bound to it anymore. Roles managed on NATS Tower are left alone.
+func (c *NATSTowerOperator) removeGeneratedRole(ctx context.Context, secret *corev1.Secret) error {
+	role := secret.Annotations[natsTowerRoleLabelKey]
+	if role == "" || secret.Annotations[natsTowerGeneratedRoleAnnotationKey] != "true" {
+		return nil
+	}
+
+	return c.removeUnusedRole(ctx, secret.Namespace,
+		secret.Annotations[natsTowerInstallationLabelKey],
+		secret.Annotations[natsTowerAccountLabelKey],
+		role)
+}
+
+// removePodRole removes the role generated from the permission annotations of
+// a pod with its own user once no user is bound to it anymore.
+func (c *NATSTowerOperator) removePodRole(ctx context.Context, pod *corev1.Pod, installationPublicKey, account string) error {
+	opts := natstower.UserOptions{Role: pod.Labels[natsTowerRoleLabelKey]}
+	data := getSubjectTemplateData(pod, c.towerOperatorConfig.ClusterID, userScopePod)
+	if opts.Role == "" || getRolePermissions(pod.Annotations, data, &opts) != nil || !hasRolePermissions(opts) {
+		return nil
+	}
+
+	return c.removeUnusedRole(ctx, pod.Namespace, installationPublicKey, account, getRoleName(opts))
+}
+
+func (c *NATSTowerOperator) removeUnusedRole(ctx context.Context, namespace, installationPublicKey, account, role string) error {
+	err := c.natsTowerClient.RemoveUnusedRole(ctx, namespace, installationPublicKey, account, role)
+	if err != nil {
+		klog.Errorf("could not remove role '%s' of account '%s' in namespace[%s]: %v",
+			role, account, namespace, err)
+		return err
+	}
+	return nil
+}
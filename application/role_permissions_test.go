@@ -0,0 +1,90 @@
+package application
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+func TestGetRolePermissions(t *testing.T) {
+	var opts natstower.UserOptions
+	err := getRolePermissions(map[string]string{
+		natsTowerPublishDenyAnnotationKey:       "orders.admin.>",
+		natsTowerSubscribeQueueAnnotationKey:    "orders.created workers\norders.updated workers",
+		natsTowerAllowResponsesAnnotationKey:    "3",
+		natsTowerAllowResponsesTTLAnnotationKey: "5s",
+	}, subjectTemplateData{}, &opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(opts.PublishDeny) != 1 || len(opts.QueueSubscribe) != 2 || opts.QueueSubscribe[1].Queue != "workers" {
+		t.Errorf("unexpected permissions %+v", opts)
+	}
+	if opts.AllowResponses == nil || opts.AllowResponses.MaxMsgs != 3 || opts.AllowResponses.TTL != 5*time.Second {
+		t.Errorf("unexpected response permission %+v", opts.AllowResponses)
+	}
+	if !hasRolePermissions(opts) {
+		t.Error("expected role permissions")
+	}
+
+	for _, annotations := range []map[string]string{
+		{natsTowerSubscribeQueueAnnotationKey: "orders.created"},
+		{natsTowerAllowResponsesAnnotationKey: "0"},
+		{natsTowerAllowResponsesTTLAnnotationKey: "5s"},
+	} {
+		if err := getRolePermissions(annotations, subjectTemplateData{}, &natstower.UserOptions{}); err == nil {
+			t.Errorf("expected error for %v", annotations)
+		}
+	}
+}
+
+func TestSubjectTemplates(t *testing.T) {
+	data := subjectTemplateData{
+		Namespace: "team-a",
+		PodName:   "orders-0",
+		Labels:    map[string]string{"app": "orders"},
+		ClusterID: "prod",
+	}
+
+	subjects, err := parseSubjects("{{ .ClusterID }}.{{ .Namespace }}.{{ .Labels.app }}.>, inbox.{{ .PodName }}", data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(subjects) != 2 || subjects[0] != "prod.team-a.orders.>" || subjects[1] != "inbox.orders-0" {
+		t.Errorf("unexpected subjects %v", subjects)
+	}
+
+	_, err = parseSubjects("orders.{{ .Labels.team }}.>", subjectTemplateData{Labels: map[string]string{}})
+	if err == nil {
+		t.Error("expected error for missing label")
+	}
+
+	var teamA, teamB natstower.UserOptions
+	annotations := map[string]string{natsTowerPublishAnnotationKey: "orders.{{ .Namespace }}.>"}
+	teamA.Role, teamB.Role = "orders", "orders"
+	if err := getRolePermissions(annotations, data, &teamA); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data.Namespace = "team-b"
+	if err := getRolePermissions(annotations, data, &teamB); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getRoleName(teamA) == getRoleName(teamB) {
+		t.Errorf("expected role names per namespace, got %s and %s", getRoleName(teamA), getRoleName(teamB))
+	}
+	if getRoleName(natstower.UserOptions{Role: "central"}) != "central" {
+		t.Error("expected roles without permissions to keep their name")
+	}
+}
+
+func TestValidateRoleSubjects(t *testing.T) {
+	invalid := validateRoleSubjects(natstower.UserOptions{
+		Publish:        []string{"orders.created", "orders..created"},
+		Subscribe:      []string{"orders.>.eu"},
+		QueueSubscribe: []natstower.QueueSubscription{{Subject: "orders.*", Queue: "workers"}},
+	})
+	if len(invalid) != 2 {
+		t.Errorf("expected 2 invalid subjects, got %v", invalid)
+	}
+}
@@ -0,0 +1,124 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// secretRequest holds the parameters a secret is requested with. They are
+// recorded on the secret, so requests of other objects for the same secret
+// name can be checked against them.
+type secretRequest struct {
+	Installation   string
+	Account        string
+	Role           string
+	CredentialType string
+	OutputFormat   string
+	OutputTemplate string
+	ConfigMap      string
+	// ConfigMapKeepKeys keeps the connection info in the secret although it
+	// is written to the companion ConfigMap
+	ConfigMapKeepKeys bool
+	Limits            string
+	UserScope         string
+	// GeneratedRole is set if the role was generated from permission
+	// annotations, so it is removed once no user is bound to it anymore
+	GeneratedRole bool
+}
+
+// getSecretConflicts compares the request with the parameters recorded on a
+// secret written by the operator. Parameters not recorded by older operator
+// versions are not compared. The sole owner of a secret may change its role,
+// output format, ConfigMap and limits.
+func getSecretConflicts(secret *corev1.Secret, request secretRequest, soleOwner bool) []string {
+	if !isManagedSecret(secret) {
+		return nil
+	}
+
+	var conflicts []string
+	compare := func(name, recorded string, ok bool, requested string) {
+		if ok && recorded != requested {
+			conflicts = append(conflicts, fmt.Sprintf("%s '%s' instead of '%s'", name, recorded, requested))
+		}
+	}
+
+	installation, ok := secret.Annotations[natsTowerInstallationLabelKey]
+	compare("installation", installation, ok, request.Installation)
+	account, ok := secret.Annotations[natsTowerAccountLabelKey]
+	compare("account", account, ok, request.Account)
+	credentialType, ok := secret.Labels[natsTowerCredentialTypeLabelKey]
+	compare("credential type", credentialType, ok, request.CredentialType)
+	if userScope := secret.Annotations[natsTowerUserScopeAnnotationKey]; userScope != request.UserScope {
+		conflicts = append(conflicts, "another user scope")
+	}
+	if !soleOwner {
+		role, ok := secret.Annotations[natsTowerRoleLabelKey]
+		compare("role", role, ok, request.Role)
+		outputFormat, ok := secret.Annotations[natsTowerOutputFormatAnnotationKey]
+		compare("output format", outputFormat, ok, request.OutputFormat)
+		if outputTemplate, ok := secret.Annotations[natsTowerOutputTemplateAnnotationKey]; ok && outputTemplate != request.OutputTemplate {
+			conflicts = append(conflicts, "another output template")
+		}
+		if configMap := secret.Annotations[natsTowerConfigMapAnnotationKey]; configMap != request.ConfigMap {
+			conflicts = append(conflicts, fmt.Sprintf("configmap '%s' instead of '%s'", configMap, request.ConfigMap))
+		}
+		if !secretHasConfigMapKeys(secret, request) {
+			conflicts = append(conflicts, "other secret keys for the configmap")
+		}
+		if limits := secret.Annotations[natsTowerUserLimitsAnnotationKey]; limits != request.Limits {
+			conflicts = append(conflicts, fmt.Sprintf("limits '%s' instead of '%s'", limits, request.Limits))
+		}
+	}
+
+	return conflicts
+}
+
+// hasSecretConflict reports whether the secret was requested with other
+// parameters and records a SecretConflict warning event on the source. The
+// owners of the secret are only resolved if a parameter differs.
+func (c *NATSTowerOperator) hasSecretConflict(ctx context.Context,
+	source runtime.Object,
+	secret *corev1.Secret,
+	request secretRequest) bool {
+	conflicts := getSecretConflicts(secret, request, false)
+	if len(conflicts) > 0 && c.isSoleSecretOwner(ctx, source, secret) {
+		conflicts = getSecretConflicts(secret, request, true)
+	}
+	if len(conflicts) == 0 {
+		return false
+	}
+
+	c.eventRecorder.Eventf(source,
+		corev1.EventTypeWarning,
+		"SecretConflict",
+		"Secret %s/%s was requested with %s, refusing to change it",
+		secret.Namespace, secret.Name, strings.Join(conflicts, ", "))
+	return true
+}
+
+// canManageSecret reports whether the operator may write to an existing
+// secret. Secrets not written by the operator are only taken over if they
+// carry the adopt annotation. Both outcomes are recorded as events on the
+// source and the secret.
+func (c *NATSTowerOperator) canManageSecret(source runtime.Object, secret *corev1.Secret) bool {
+	if isManagedSecret(secret) {
+		return true
+	}
+
+	if secret.Annotations[natsTowerAdoptAnnotationKey] == "true" {
+		message := fmt.Sprintf("Secret %s/%s is adopted by the operator", secret.Namespace, secret.Name)
+		c.eventRecorder.Event(source, corev1.EventTypeNormal, "SecretAdopted", message)
+		c.eventRecorder.Event(secret, corev1.EventTypeNormal, "SecretAdopted", message)
+		return true
+	}
+
+	message := fmt.Sprintf("Secret %s/%s is not managed by the operator, refusing to change it. Annotate it with %s=true to adopt it",
+		secret.Namespace, secret.Name, natsTowerAdoptAnnotationKey)
+	c.eventRecorder.Event(source, corev1.EventTypeWarning, "SecretNotManaged", message)
+	c.eventRecorder.Event(secret, corev1.EventTypeWarning, "SecretNotManaged", message)
+	return false
+}
@@ -0,0 +1,88 @@
+package application
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestForeignSecret(annotations map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "app-creds",
+			Namespace:   testNamespace,
+			UID:         "foreign-uid",
+			Annotations: annotations,
+		},
+		Data: map[string][]byte{"password": []byte("hunter2")},
+	}
+}
+
+func TestForeignSecretIsLeftUntouched(t *testing.T) {
+	o := newTestOperator(t)
+	o.createSecret(newTestForeignSecret(nil))
+
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if events := o.events(); !hasEvent(events, "SecretNotManaged") {
+		t.Errorf("expected a SecretNotManaged event, got %v", events)
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if len(secret.Data) != 1 || string(secret.Data["password"]) != "hunter2" || isManagedSecret(secret) {
+		t.Errorf("expected the foreign secret to be left untouched, got %v", secret)
+	}
+	if o.tower.countRequests("POST", "nats_auth_users") != 0 {
+		t.Error("expected no user to be created for a foreign secret")
+	}
+}
+
+func TestAdoptedSecretIsTakenOver(t *testing.T) {
+	o := newTestOperator(t)
+	o.createSecret(newTestForeignSecret(map[string]string{natsTowerAdoptAnnotationKey: "true"}))
+
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if events := o.events(); !hasEvent(events, "SecretAdopted") {
+		t.Errorf("expected a SecretAdopted event, got %v", events)
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if !isManagedSecret(secret) || len(secret.Data[secretCredentialsKey]) == 0 {
+		t.Errorf("expected the adopted secret to hold the credentials, got %v", secret)
+	}
+	if _, ok := secret.Data["password"]; ok {
+		t.Error("expected the previous data of the adopted secret to be replaced")
+	}
+}
+
+func TestConflictingRequestIsRefused(t *testing.T) {
+	o := newTestOperator(t)
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	original := o.getSecretOrNil(testNamespace, "app-creds")
+	o.cache(testSecretGVR, original)
+	o.events()
+
+	// Another pod requests the same secret in another output format
+	other := newTestPod("backend", nil, map[string]string{natsTowerOutputFormatAnnotationKey: outputFormatEnv})
+	if err := o.reconcilePod(other); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if events := o.events(); !hasEvent(events, "SecretConflict") {
+		t.Errorf("expected a SecretConflict event, got %v", events)
+	}
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if secret.Annotations[natsTowerOutputFormatAnnotationKey] != outputFormatCreds ||
+		string(secret.Data[secretCredentialsKey]) != string(original.Data[secretCredentialsKey]) {
+		t.Errorf("expected the secret to be left unchanged, got %v", secret)
+	}
+	if hasOwnerReference(secret.OwnerReferences, v1.OwnerReference{UID: other.UID}) {
+		t.Error("expected the conflicting pod not to become an owner")
+	}
+}
@@ -0,0 +1,258 @@
+package application
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// getSecretContentHash hashes the data of the secret together with the
+// labels and annotations the operator relies on. It is stored in the
+// content hash annotation to detect secrets that were changed by others.
+func getSecretContentHash(secret *corev1.Secret) string {
+	h := sha256.New()
+
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(h, "data:%s=%x\n", key, secret.Data[key])
+	}
+	for _, key := range []string{natsTowerSecretLabelKey, natsTowerCredentialTypeLabelKey} {
+		fmt.Fprintf(h, "label:%s=%s\n", key, secret.Labels[key])
+	}
+	for _, key := range []string{natsTowerInstallationLabelKey, natsTowerAccountLabelKey, natsTowerUserAnnotationKey} {
+		fmt.Fprintf(h, "annotation:%s=%s\n", key, secret.Annotations[key])
+	}
+	// Not recorded by older operator versions, whose hashes must stay valid
+	for _, key := range []string{natsTowerRoleLabelKey, natsTowerOutputFormatAnnotationKey, natsTowerOutputTemplateAnnotationKey, natsTowerConfigMapAnnotationKey, natsTowerUserLimitsAnnotationKey, natsTowerExpiresAnnotationKey, natsTowerUserScopeAnnotationKey, natsTowerGeneratedRoleAnnotationKey, natsTowerConfigMapKeepKeysAnnotationKey} {
+		if value, ok := secret.Annotations[key]; ok {
+			fmt.Fprintf(h, "annotation:%s=%s\n", key, value)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isManagedSecret reports whether the secret was written by the operator.
+// The content hash annotation identifies the secret even if its labels
+// were stripped.
+func isManagedSecret(secret *corev1.Secret) bool {
+	if secret.Labels[managedByLabelKey] == managedByLabelValue ||
+		secret.Annotations[natsTowerContentHashAnnotationKey] != "" {
+		return true
+	}
+	// Older operator versions only set the secret and credential type labels
+	return secret.Labels[natsTowerSecretLabelKey] == "true" &&
+		secret.Labels[natsTowerCredentialTypeLabelKey] != ""
+}
+
+// hasSecretDrifted reports whether a secret written by the operator was
+// changed since.
+func hasSecretDrifted(secret *corev1.Secret) bool {
+	contentHash := secret.Annotations[natsTowerContentHashAnnotationKey]
+	if contentHash == "" {
+		// Written by an older operator version, nothing to compare with
+		return false
+	}
+
+	return contentHash != getSecretContentHash(secret)
+}
+
+// repairSecret re-issues the credentials of a drifted secret from NATS Tower
+// and restores its content. The request is rebuilt from the objects owning the
+// secret, as its annotations may have been modified as well; if they disagree
+// with the owners the secret is not restored. A SecretDrift warning event is
+// recorded on the secret and on all of its owners.
+func (c *NATSTowerOperator) repairSecret(ctx context.Context, secret *corev1.Secret) error {
+	c.recordSecretEvent(secret,
+		corev1.EventTypeWarning,
+		"SecretDrift",
+		fmt.Sprintf("Secret %s/%s was modified outside of the operator, restoring it", secret.Namespace, secret.Name))
+
+	sources := c.getSecretSources(secret)
+	if len(sources) == 0 {
+		c.eventRecorder.Eventf(secret,
+			corev1.EventTypeWarning,
+			"ErrorRestoringSecret",
+			"Can not restore secret %s/%s, none of its owners requests it",
+			secret.Namespace, secret.Name)
+		return nil
+	}
+
+	for _, source := range sources {
+		conflicts := getSecretConflicts(secret, source.request, false)
+		if user, ok := secret.Annotations[natsTowerUserAnnotationKey]; ok && user != source.user {
+			conflicts = append(conflicts, fmt.Sprintf("user '%s' instead of '%s'", user, source.user))
+		}
+		if len(conflicts) > 0 {
+			c.recordSecretEvent(secret,
+				corev1.EventTypeWarning,
+				"ErrorRestoringSecret",
+				fmt.Sprintf("Refusing to restore secret %s/%s, it records %s",
+					secret.Namespace, secret.Name, strings.Join(conflicts, ", ")))
+			return nil
+		}
+	}
+
+	if sources[0].request.UserScope == userScopePod {
+		// The keys are rebuilt from the pods of the secret
+		secret.Data = nil
+	} else {
+		// All owners share the user
+		sources = sources[:1]
+	}
+
+	for _, source := range sources {
+		creds, err := c.getUserAuth(ctx,
+			secret.Namespace,
+			secret.Name,
+			source.user,
+			source.description,
+			source.request,
+			source.userOptions)
+		if err == natstower.ErrUserNotOwned {
+			c.recordSecretEvent(secret,
+				corev1.EventTypeWarning,
+				"UserNotOwned",
+				fmt.Sprintf("Refusing to restore secret %s/%s, its user belongs to another namespace on NATS Tower",
+					secret.Namespace, secret.Name))
+			return nil
+		}
+		if err != nil {
+
+			c.eventRecorder.Eventf(secret,
+				corev1.EventTypeWarning,
+				"ErrorCreatingUserAuth",
+				"Could not CreateOrGetUserAuth to restore secret:%v", err)
+
+			return err
+		}
+
+		err = setSecretContent(secret, source.object, source.user, source.request, creds)
+		if err != nil {
+			return c.recordOutputFormatError(secret, secret.Namespace, secret.Name, err)
+		}
+	}
+
+	_, err := c.k8sClient.ClientSet.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, v1.UpdateOptions{})
+	if err != nil {
+
+		c.eventRecorder.Eventf(secret,
+			corev1.EventTypeWarning,
+			"ErrorUpsertingSecret",
+			"Could not restore secret %s/%s: %v",
+			secret.Namespace, secret.Name, err)
+
+		return err
+	}
+
+	klog.Infof("Secret[%s] in namespace[%s]: restored after drift", secret.Name, secret.Namespace)
+	return c.RestartWorkloads(ctx, secret, "the secret was restored after it was modified")
+}
+
+// secretSource is an object requesting a secret, with the request resolved
+// from its labels and annotations.
+type secretSource struct {
+	object      runtime.Object
+	user        string
+	description string
+	request     secretRequest
+	userOptions natstower.UserOptions
+}
+
+// getSecretSources resolves the objects requesting the secret from its owner
+// references: NACK Accounts, pods, and the pods of owning workloads. Owners
+// that no longer request the secret are skipped.
+func (c *NATSTowerOperator) getSecretSources(secret *corev1.Secret) []secretSource {
+	var sources []secretSource
+	var pods []corev1.Pod
+	for _, ownerRef := range secret.OwnerReferences {
+		if ownerRef.Kind == "Account" {
+			acc, err := c.nackAccountController.Get(secret.Namespace, ownerRef.Name)
+			if err != nil || acc.UID != ownerRef.UID || acc.Labels[natsTowerSecretLabelKey] != secret.Name {
+				continue
+			}
+			request, ok := c.getNACKAccountSecretRequest(acc)
+			if !ok {
+				continue
+			}
+			sources = append(sources, secretSource{
+				object:      acc,
+				user:        secret.Name,
+				description: getNACKAccountUserDescription(c.towerOperatorConfig.ClusterID, acc),
+				request:     request,
+			})
+			continue
+		}
+
+		if pods == nil {
+			var err error
+			pods, err = c.podController.List(secret.Namespace,
+				labels.SelectorFromSet(labels.Set{natsTowerSecretLabelKey: secret.Name}))
+			if err != nil {
+				klog.Errorf("Secret[%s] in namespace[%s]: could not list pods: %v", secret.Name, secret.Namespace, err)
+				return nil
+			}
+		}
+		for i := range pods {
+			pod := &pods[i]
+			controllerRef := v1.GetControllerOf(pod)
+			if pod.UID != ownerRef.UID && (controllerRef == nil || controllerRef.UID != ownerRef.UID) {
+				continue
+			}
+			if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			request, ok := c.getPodSecretRequest(pod)
+			if !ok {
+				continue
+			}
+			userOptions, ok := c.completePodSecretRequest(pod, &request)
+			if !ok {
+				continue
+			}
+			user := secret.Name
+			if request.UserScope == userScopePod {
+				user = getPodUserName(secret.Name, pod)
+			}
+			sources = append(sources, secretSource{
+				object:      pod,
+				user:        user,
+				description: getPodUserDescription(c.towerOperatorConfig.ClusterID, pod),
+				request:     request,
+				userOptions: userOptions,
+			})
+		}
+	}
+	return sources
+}
+
+// recordSecretEvent records an event on the secret and all of its owners.
+func (c *NATSTowerOperator) recordSecretEvent(secret *corev1.Secret, eventType, reason, message string) {
+	c.eventRecorder.Event(secret, eventType, reason, message)
+
+	for _, ownerRef := range secret.OwnerReferences {
+		c.eventRecorder.Event(&corev1.ObjectReference{
+			APIVersion: ownerRef.APIVersion,
+			Kind:       ownerRef.Kind,
+			Name:       ownerRef.Name,
+			Namespace:  secret.Namespace,
+			UID:        ownerRef.UID,
+		}, eventType, reason, message)
+	}
+}
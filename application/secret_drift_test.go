@@ -0,0 +1,92 @@
+package application
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+// tamperSecret changes the secret on the fake API server and returns it as the
+// secret handler sees it.
+func (o *testOperator) tamperSecret(tamper func(secret *corev1.Secret)) *corev1.Secret {
+	o.t.Helper()
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if secret == nil {
+		o.t.Fatal("expected the secret to exist")
+	}
+	tamper(secret)
+	secret, err := o.clientset.CoreV1().Secrets(testNamespace).Update(context.Background(), secret, v1.UpdateOptions{})
+	if err != nil {
+		o.t.Fatalf("error updating secret: %v", err)
+	}
+	return secret
+}
+
+func TestRepairSecretRestoresFromOwner(t *testing.T) {
+	o := newTestOperator(t)
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	original := o.getSecretOrNil(testNamespace, "app-creds")
+
+	secret := o.tamperSecret(func(secret *corev1.Secret) {
+		secret.Data[secretCredentialsKey] = []byte("tampered")
+	})
+	err := getSecretHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/app-creds"}, *secret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored := o.getSecretOrNil(testNamespace, "app-creds")
+	if string(restored.Data[secretCredentialsKey]) != string(original.Data[secretCredentialsKey]) {
+		t.Errorf("expected the credentials to be restored, got %s", restored.Data[secretCredentialsKey])
+	}
+	if hasSecretDrifted(restored) {
+		t.Error("expected the restored secret to match its content hash")
+	}
+}
+
+func TestRepairSecretRefusesTamperedAnnotations(t *testing.T) {
+	o := newTestOperator(t)
+	operators := o.tower.find("nats_auth_operators", map[string]string{"public_key": testInstallation})
+	otherID := o.tower.add("nats_auth_accounts", map[string]any{
+		"operator":   operators[0]["id"],
+		"name":       "other",
+		"public_key": "OTHER",
+	})
+	o.tower.add("nats_auth_k8s_access", map[string]any{
+		"cluster":   testClusterID,
+		"namespace": testNamespace,
+		"account":   otherID,
+	})
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	o.events()
+
+	// Credentials of another account are requested through the annotations
+	secret := o.tamperSecret(func(secret *corev1.Secret) {
+		secret.Annotations[natsTowerAccountLabelKey] = "other"
+		secret.Data[secretCredentialsKey] = []byte("tampered")
+	})
+	err := getSecretHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: testNamespace + "/app-creds"}, *secret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if events := o.events(); !hasEvent(events, "ErrorRestoringSecret") {
+		t.Errorf("expected an ErrorRestoringSecret event, got %v", events)
+	}
+	if o.tower.countRequests("POST", "nats_auth_users") != 1 {
+		t.Error("expected no user to be created for the tampered annotations")
+	}
+	if string(o.getSecretOrNil(testNamespace, "app-creds").Data[secretCredentialsKey]) != "tampered" {
+		t.Error("expected the secret not to be restored")
+	}
+}
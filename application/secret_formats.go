@@ -0,0 +1,202 @@
+package application
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// Output formats of generated secrets
+const (
+	outputFormatCreds    = "creds"
+	outputFormatEnv      = "env"
+	outputFormatContext  = "context"
+	outputFormatJWT      = "jwt"
+	outputFormatTemplate = "template"
+)
+
+// natsContextCredsPath is where the context of the context output format
+// expects the secret to be mounted.
+const natsContextCredsPath = "/etc/nats-tower/" + secretCredentialsKey
+
+// secretTemplateData is available to the templates of the template output
+// format.
+type secretTemplateData struct {
+	Creds       string
+	JWT         string
+	Seed        string
+	URLs        string
+	AccountName string
+	User        string
+}
+
+// natsContext is a context of the nats CLI.
+type natsContext struct {
+	Description     string `json:"description"`
+	URL             string `json:"url"`
+	Creds           string `json:"creds"`
+	JetStreamDomain string `json:"jetstream_domain,omitempty"`
+}
+
+// getOutputFormat resolves the output format annotations of the requesting
+// object. The template is only returned for the template output format.
+func getOutputFormat(annotations map[string]string) (string, string, error) {
+	format := annotations[natsTowerOutputFormatAnnotationKey]
+	outputTemplate := annotations[natsTowerOutputTemplateAnnotationKey]
+
+	switch format {
+	case "":
+		format = outputFormatCreds
+	case outputFormatCreds, outputFormatEnv, outputFormatContext, outputFormatJWT:
+	case outputFormatTemplate:
+		if outputTemplate == "" {
+			return "", "", fmt.Errorf("annotation %s is required for output format '%s'",
+				natsTowerOutputTemplateAnnotationKey, outputFormatTemplate)
+		}
+		if _, err := parseOutputTemplate(outputTemplate); err != nil {
+			return "", "", err
+		}
+		return format, outputTemplate, nil
+	default:
+		return "", "", fmt.Errorf("output format '%s' must be one of %s",
+			format, strings.Join([]string{outputFormatCreds, outputFormatEnv, outputFormatContext, outputFormatJWT, outputFormatTemplate}, ", "))
+	}
+
+	return format, "", nil
+}
+
+// parseOutputTemplate parses a YAML map of secret keys to Go templates. The
+// keys must be valid secret keys.
+func parseOutputTemplate(outputTemplate string) (map[string]*template.Template, error) {
+	keyTemplates := map[string]string{}
+	err := yaml.Unmarshal([]byte(outputTemplate), &keyTemplates)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	if len(keyTemplates) == 0 {
+		return nil, fmt.Errorf("invalid output template: no keys defined")
+	}
+
+	templates := make(map[string]*template.Template, len(keyTemplates))
+	for key, text := range keyTemplates {
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid output template key '%s': %s", key, strings.Join(errs, ", "))
+		}
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output template of key '%s': %v", key, err)
+		}
+		templates[key] = tmpl
+	}
+	return templates, nil
+}
+
+// renderSecretData renders the data of a secret in the requested output
+// format.
+func renderSecretData(user string, request secretRequest, creds *natstower.ConnectionInfo) (map[string][]byte, error) {
+	jwt, seed := parseCreds(creds.Creds)
+
+	if request.OutputFormat != outputFormatTemplate {
+		if data, ok := renderCredentialTypeData(request.CredentialType, user, creds, jwt); ok {
+			return data, nil
+		}
+	}
+
+	switch request.OutputFormat {
+	case "", outputFormatCreds:
+		if request.ConfigMap != "" && !request.ConfigMapKeepKeys {
+			// The connection info is in the companion ConfigMap
+			return map[string][]byte{
+				secretCredentialsKey: []byte(creds.Creds),
+			}, nil
+		}
+		return map[string][]byte{
+			secretCredentialsKey: []byte(creds.Creds),
+			"URLS":               []byte(creds.URLs),
+			"ACCOUNT_NAME":       []byte(creds.AccountName),
+		}, nil
+	case outputFormatEnv:
+		var env bytes.Buffer
+		fmt.Fprintf(&env, "NATS_URL=%s\n", creds.URLs)
+		fmt.Fprintf(&env, "NATS_ACCOUNT_NAME=%s\n", creds.AccountName)
+		fmt.Fprintf(&env, "NATS_USER_JWT=%s\n", jwt)
+		fmt.Fprintf(&env, "NATS_USER_SEED=%s\n", seed)
+		return map[string][]byte{
+			".env": env.Bytes(),
+		}, nil
+	case outputFormatContext:
+		context, err := json.MarshalIndent(natsContext{
+			Description: fmt.Sprintf("NATS Tower user '%s' of account '%s'", user, creds.AccountName),
+			URL:         creds.URLs,
+			Creds:       natsContextCredsPath,
+		}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{
+			"context.json":       context,
+			secretCredentialsKey: []byte(creds.Creds),
+		}, nil
+	case outputFormatJWT:
+		return map[string][]byte{
+			"user.jwt": []byte(jwt),
+			"user.nk":  []byte(seed),
+		}, nil
+	case outputFormatTemplate:
+		templates, err := parseOutputTemplate(request.OutputTemplate)
+		if err != nil {
+			return nil, err
+		}
+		templateData := secretTemplateData{
+			Creds:       creds.Creds,
+			JWT:         jwt,
+			Seed:        seed,
+			URLs:        creds.URLs,
+			AccountName: creds.AccountName,
+			User:        user,
+		}
+		data := make(map[string][]byte, len(templates))
+		for key, tmpl := range templates {
+			var value bytes.Buffer
+			err := tmpl.Execute(&value, templateData)
+			if err != nil {
+				return nil, fmt.Errorf("error rendering output template of key '%s': %v", key, err)
+			}
+			data[key] = value.Bytes()
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unknown output format '%s'", request.OutputFormat)
+	}
+}
+
+// parseCreds splits a decorated creds file into the user JWT and the nkey
+// seed.
+func parseCreds(creds string) (string, string) {
+	var jwt, seed string
+	var current *string
+
+	scanner := bufio.NewScanner(strings.NewReader(creds))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.Contains(line, "BEGIN NATS USER JWT"):
+			current = &jwt
+		case strings.Contains(line, "BEGIN USER NKEY SEED"):
+			current = &seed
+		case strings.HasPrefix(line, "---"):
+			current = nil
+		case current != nil && line != "" && *current == "":
+			*current = line
+		}
+	}
+	return jwt, seed
+}
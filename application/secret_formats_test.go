@@ -0,0 +1,174 @@
+package application
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+const testCreds = `-----BEGIN NATS USER JWT-----
+eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.test
+------END NATS USER JWT------
+
+************************* IMPORTANT *************************
+NKEY Seed printed below can be used to sign and prove identity.
+
+-----BEGIN USER NKEY SEED-----
+SUAEXAMPLESEED
+------END USER NKEY SEED------
+`
+
+func TestParseCreds(t *testing.T) {
+	jwt, seed := parseCreds(testCreds)
+	if jwt != "eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.test" {
+		t.Errorf("unexpected jwt '%s'", jwt)
+	}
+	if seed != "SUAEXAMPLESEED" {
+		t.Errorf("unexpected seed '%s'", seed)
+	}
+}
+
+func TestRenderSecretData(t *testing.T) {
+	creds := &natstower.ConnectionInfo{
+		Creds:       testCreds,
+		URLs:        "nats://nats:4222",
+		AccountName: "app",
+	}
+
+	tests := []struct {
+		format   string
+		template string
+		keys     []string
+	}{
+		{format: outputFormatCreds, keys: []string{secretCredentialsKey, "URLS", "ACCOUNT_NAME"}},
+		{format: outputFormatEnv, keys: []string{".env"}},
+		{format: outputFormatContext, keys: []string{"context.json", secretCredentialsKey}},
+		{format: outputFormatJWT, keys: []string{"user.jwt", "user.nk"}},
+		{format: outputFormatTemplate, template: "url: '{{ .URLs }}'\nseed: '{{ .Seed }}'", keys: []string{"url", "seed"}},
+	}
+
+	for _, test := range tests {
+		data, err := renderSecretData("app-user", secretRequest{OutputFormat: test.format, OutputTemplate: test.template}, creds)
+		if err != nil {
+			t.Fatalf("format %s: unexpected error: %v", test.format, err)
+		}
+		if len(data) != len(test.keys) {
+			t.Errorf("format %s: expected keys %v, got %d keys", test.format, test.keys, len(data))
+		}
+		for _, key := range test.keys {
+			if len(data[key]) == 0 {
+				t.Errorf("format %s: expected key '%s' to be set", test.format, key)
+			}
+		}
+	}
+
+	data, _ := renderSecretData("app-user", secretRequest{OutputFormat: outputFormatEnv}, creds)
+	if !strings.Contains(string(data[".env"]), "NATS_USER_SEED=SUAEXAMPLESEED\n") {
+		t.Errorf("expected seed in env file, got %s", data[".env"])
+	}
+}
+
+func TestGetOutputFormat(t *testing.T) {
+	format, _, err := getOutputFormat(nil)
+	if err != nil || format != outputFormatCreds {
+		t.Errorf("expected default format %s, got %s (%v)", outputFormatCreds, format, err)
+	}
+
+	_, _, err = getOutputFormat(map[string]string{natsTowerOutputFormatAnnotationKey: "xml"})
+	if err == nil {
+		t.Error("expected error for unknown format")
+	}
+
+	_, _, err = getOutputFormat(map[string]string{
+		natsTowerOutputFormatAnnotationKey:   outputFormatTemplate,
+		natsTowerOutputTemplateAnnotationKey: "url: '{{ .URLs'",
+	})
+	if err == nil {
+		t.Error("expected error for invalid template")
+	}
+
+	for _, key := range []string{"my key", "a/b"} {
+		_, _, err = getOutputFormat(map[string]string{
+			natsTowerOutputFormatAnnotationKey:   outputFormatTemplate,
+			natsTowerOutputTemplateAnnotationKey: "'" + key + "': '{{ .URLs }}'",
+		})
+		if err == nil {
+			t.Errorf("expected error for invalid key '%s'", key)
+		}
+	}
+}
+
+func TestRenderLeafnodeSecretData(t *testing.T) {
+	creds := &natstower.ConnectionInfo{
+		Creds: testCreds,
+		URLs:  "nats-leaf://hub-0:7422, nats-leaf://hub-1:7422",
+	}
+
+	data, err := renderSecretData("leaf", secretRequest{
+		CredentialType: credentialTypeLeafnode,
+		OutputFormat:   outputFormatCreds,
+	}, creds)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conf := string(data[leafnodeConfigKey])
+	if !strings.Contains(conf, `urls: ["nats-leaf://hub-0:7422", "nats-leaf://hub-1:7422"]`) {
+		t.Errorf("expected hub urls in leafnode config, got %s", conf)
+	}
+	if !strings.Contains(conf, `credentials: "/etc/nats-tower/nats.creds"`) {
+		t.Errorf("expected creds path in leafnode config, got %s", conf)
+	}
+
+	if checkCredentialTypeOutputFormat(credentialTypeLeafnode, outputFormatEnv) == nil {
+		t.Error("expected error for env format of leafnode credentials")
+	}
+}
+
+func TestGetCredentialType(t *testing.T) {
+	credentialType, err := getCredentialType(nil, podCredentialTypes)
+	if err != nil || credentialType != credentialTypeUser {
+		t.Errorf("expected default type %s, got %s (%v)", credentialTypeUser, credentialType, err)
+	}
+
+	_, err = getCredentialType(map[string]string{natsTowerCredentialTypeLabelKey: "admin"}, podCredentialTypes)
+	if err == nil {
+		t.Error("expected error for unknown credential type")
+	}
+
+	_, err = getCredentialType(map[string]string{natsTowerCredentialTypeLabelKey: credentialTypeBearer},
+		[]string{credentialTypeUser})
+	if err == nil {
+		t.Error("expected error for credential type that is not allowed")
+	}
+}
+
+func TestRenderBearerSecretData(t *testing.T) {
+	data, err := renderSecretData("frontend", secretRequest{
+		CredentialType: credentialTypeBearer,
+		OutputFormat:   outputFormatCreds,
+	}, &natstower.ConnectionInfo{Creds: testCreds, URLs: "wss://nats.example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data[bearerTokenKey]) != "eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.test" {
+		t.Errorf("expected jwt as bearer token, got %s", data[bearerTokenKey])
+	}
+	if _, ok := data[secretCredentialsKey]; ok {
+		t.Error("expected no seed in bearer secret")
+	}
+}
+
+func TestGetMQTTHostPort(t *testing.T) {
+	tests := map[string][2]string{
+		"mqtts://mqtt.example.com:8883,mqtts://mqtt-1.example.com:8883": {"mqtt.example.com", "8883"},
+		"mqtt.example.com:1884":  {"mqtt.example.com", "1884"},
+		"tcp://mqtt.example.com": {"mqtt.example.com", mqttDefaultPort},
+	}
+	for urls, expected := range tests {
+		host, port := getMQTTHostPort(urls)
+		if host != expected[0] || port != expected[1] {
+			t.Errorf("%s: expected %s:%s, got %s:%s", urls, expected[0], expected[1], host, port)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package application
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// getSecretOwnerReference returns the non-controller owner reference a
+// generated secret gets for the object that requested it. Pods that are
+// managed by a workload (ReplicaSet, StatefulSet, Job, ...) hand the
+// ownership to that workload, so the secret outlives single pod restarts.
+func getSecretOwnerReference(source runtime.Object) (v1.OwnerReference, error) {
+	if pod, ok := source.(*corev1.Pod); ok {
+		if controllerRef := v1.GetControllerOf(pod); controllerRef != nil {
+			return v1.OwnerReference{
+				APIVersion: controllerRef.APIVersion,
+				Kind:       controllerRef.Kind,
+				Name:       controllerRef.Name,
+				UID:        controllerRef.UID,
+			}, nil
+		}
+	}
+
+	accessor, err := meta.Accessor(source)
+	if err != nil {
+		return v1.OwnerReference{}, fmt.Errorf("error getting owner of secret: %v", err)
+	}
+
+	gvk := source.GetObjectKind().GroupVersionKind()
+	if gvk.Kind == "" || accessor.GetUID() == "" {
+		return v1.OwnerReference{}, fmt.Errorf("error getting owner of secret: missing kind or uid of '%s'", accessor.GetName())
+	}
+
+	return v1.OwnerReference{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Name:       accessor.GetName(),
+		UID:        accessor.GetUID(),
+	}, nil
+}
+
+// isSoleSecretOwner reports whether all owners of the secret belong to the
+// workload of the source. The ReplicaSets of a Deployment count as the
+// Deployment, so a rollout does not turn its new pods into a second owner.
+func (c *NATSTowerOperator) isSoleSecretOwner(ctx context.Context, source runtime.Object, secret *corev1.Secret) bool {
+	ownerRef, err := getSecretOwnerReference(source)
+	if err != nil || len(secret.OwnerReferences) == 0 {
+		return false
+	}
+
+	workload := c.getWorkloadUID(ctx, secret.Namespace, ownerRef)
+	for _, ref := range secret.OwnerReferences {
+		if c.getWorkloadUID(ctx, secret.Namespace, ref) != workload {
+			return false
+		}
+	}
+	return true
+}
+
+// getWorkloadUID returns the UID of the top-level workload of an owner.
+// Owners that can not be resolved stand for themselves.
+func (c *NATSTowerOperator) getWorkloadUID(ctx context.Context, namespace string, ref v1.OwnerReference) types.UID {
+	if ref.Kind != "ReplicaSet" {
+		return ref.UID
+	}
+	replicaSet, err := c.k8sClient.ClientSet.AppsV1().ReplicaSets(namespace).Get(ctx, ref.Name, v1.GetOptions{})
+	if err != nil || replicaSet.UID != ref.UID {
+		return ref.UID
+	}
+	if deploymentRef := v1.GetControllerOf(replicaSet); deploymentRef != nil && deploymentRef.Kind == "Deployment" {
+		return deploymentRef.UID
+	}
+	return ref.UID
+}
+
+func hasOwnerReference(refs []v1.OwnerReference, ref v1.OwnerReference) bool {
+	for _, r := range refs {
+		if r.UID == ref.UID {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOwnerReferences(refs []v1.OwnerReference, others []v1.OwnerReference) bool {
+	for _, ref := range others {
+		if !hasOwnerReference(refs, ref) {
+			return false
+		}
+	}
+	return true
+}
+
+// addOwnerReference appends ref to refs unless an owner with the same UID is
+// already present.
+func addOwnerReference(refs []v1.OwnerReference, ref v1.OwnerReference) []v1.OwnerReference {
+	if hasOwnerReference(refs, ref) {
+		return refs
+	}
+	return append(refs, ref)
+}
+
+// addOwnerReferences appends the owners of others that are missing in refs.
+func addOwnerReferences(refs []v1.OwnerReference, others []v1.OwnerReference) []v1.OwnerReference {
+	for _, ref := range others {
+		refs = addOwnerReference(refs, ref)
+	}
+	return refs
+}
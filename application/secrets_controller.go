@@ -4,30 +4,88 @@ import (
 	"context"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
 	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
 )
 
-func getSecretHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, ev k8s.EventItem, obj corev1.Secret) error {
-	return func(ctx context.Context, informer cache.SharedIndexInformer, ev k8s.EventItem, obj corev1.Secret) error {
-		klog.Infof("secret[%s]: %s - %s", ev.ActionType, obj.Name, ev.Key)
+func getSecretHandler(natsTowerOperator *NATSTowerOperator) func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj corev1.Secret) error {
+	return func(ctx context.Context, informer cache.SharedIndexInformer, req k8s.Request, obj corev1.Secret) error {
+		klog.Infof("secret[deleted=%t]: %s - %s", req.Deleted, obj.Name, req.Key)
 
-		if obj.Labels == nil {
+		if !isManagedSecret(&obj) {
 			return nil
 		}
 
-		if obj.Labels[natsTowerSecretLabelKey] == "" {
+		if !req.Deleted {
+			if !hasSecretDrifted(&obj) {
+				return nil
+			}
+			return natsTowerOperator.repairSecret(ctx, &obj)
+		}
+
+		// The watch only sees labelled secrets, so a secret whose labels were
+		// removed looks deleted. Only revoke the user if it is really gone.
+		current, err := natsTowerOperator.k8sClient.ClientSet.CoreV1().Secrets(obj.Namespace).Get(ctx,
+			obj.Name, v1.GetOptions{})
+		if err == nil {
+			if current.UID == obj.UID && current.DeletionTimestamp == nil {
+				klog.Infof("secret[%s]: labels removed in namespace[%s], repair secret",
+					obj.Name, obj.Namespace)
+				return natsTowerOperator.repairSecret(ctx, current)
+			}
+		} else if !errors.IsNotFound(err) {
+			return err
+		}
+
+		natsTowerOperator.forgetRefreshed(obj.Namespace, obj.Name)
+
+		if obj.Annotations[natsTowerUserScopeAnnotationKey] == userScopePod {
+			// Users of single pods are revoked with their pod
 			return nil
 		}
 
-		if ev.ActionType != k8s.DeleteAction {
+		if hasSecretDrifted(&obj) {
+			// The annotations naming the user may have been changed
+			klog.Infof("secret[%s]: changed outside of the operator in namespace[%s], skip removing user auth",
+				obj.Name, obj.Namespace)
 			return nil
 		}
 
 		// Delete User Auth at NATS Tower
+		installationPublicKey := obj.Annotations[natsTowerInstallationLabelKey]
+		account := obj.Annotations[natsTowerAccountLabelKey]
+		user := obj.Annotations[natsTowerUserAnnotationKey]
+
+		if installationPublicKey == "" || account == "" || user == "" {
+			// Secrets of older operator versions do not record the user
+			klog.Infof("secret[%s]: no user recorded in namespace[%s], skip removing user auth",
+				obj.Name, obj.Namespace)
+			return nil
+		}
+
+		err = natsTowerOperator.natsTowerClient.RemoveUserAuth(ctx,
+			obj.Namespace,
+			installationPublicKey,
+			account,
+			user)
+		if err == natstower.ErrUserNotOwned {
+			klog.Infof("secret[%s]: user '%s' of account '%s' belongs to another namespace, skip removing it",
+				obj.Name, user, account)
+			return nil
+		}
+		if err != nil {
+			klog.Errorf("secret[%s]: could not remove user '%s' of account '%s' in namespace[%s]: %v",
+				obj.Name, user, account, obj.Namespace, err)
+			return err
+		}
 
-		return nil
+		klog.Infof("secret[%s]: removed user '%s' of account '%s' in namespace[%s]",
+			obj.Name, user, account, obj.Namespace)
+		return natsTowerOperator.removeGeneratedRole(ctx, &obj)
 	}
 }
@@ -0,0 +1,72 @@
+package application
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+// deleteSecret removes the secret from the fake API server and runs the
+// secret handler for its deletion.
+func (o *testOperator) deleteSecret(secret *corev1.Secret) {
+	o.t.Helper()
+	_ = o.clientset.CoreV1().Secrets(secret.Namespace).Delete(context.Background(), secret.Name, v1.DeleteOptions{})
+	err := getSecretHandler(o.NATSTowerOperator)(context.Background(), nil,
+		k8s.Request{Key: secret.Namespace + "/" + secret.Name, Deleted: true}, *secret)
+	if err != nil {
+		o.t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSecretDeletionRevokesUser(t *testing.T) {
+	o := newTestOperator(t)
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	o.deleteSecret(o.getSecretOrNil(testNamespace, "app-creds"))
+	if o.hasTowerUser("app-creds") {
+		t.Error("expected the user to be removed from NATS Tower")
+	}
+}
+
+func TestSecretDeletionKeepsUserOfOtherNamespace(t *testing.T) {
+	o := newTestOperator(t)
+	o.grantOtherNamespace()
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An equally named secret in another namespace is deleted
+	secret := o.getSecretOrNil(testNamespace, "app-creds").DeepCopy()
+	secret.Namespace = "other"
+	secret.ResourceVersion = ""
+	o.createSecret(secret)
+	o.deleteSecret(secret)
+
+	if !o.hasTowerUser("app-creds") {
+		t.Error("expected the user of the other namespace to be kept")
+	}
+}
+
+func TestDriftedSecretDeletionKeepsUser(t *testing.T) {
+	o := newTestOperator(t)
+	o.towerUser("victim")
+	if err := o.reconcilePod(newTestPod("frontend", nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The annotations are changed to name another user before the deletion
+	secret := o.tamperSecret(func(secret *corev1.Secret) {
+		secret.Annotations[natsTowerUserAnnotationKey] = "victim"
+	})
+	o.deleteSecret(secret)
+
+	if !o.hasTowerUser("victim") {
+		t.Error("expected the user named by the changed annotations to be kept")
+	}
+}
@@ -0,0 +1,132 @@
+package application
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+// Annotations limiting the generated user
+const (
+	natsTowerMaxSubscriptionsAnnotationKey       = "nats-tower.com/max-subscriptions"
+	natsTowerMaxPayloadAnnotationKey             = "nats-tower.com/max-payload"
+	natsTowerMaxDataAnnotationKey                = "nats-tower.com/max-data"
+	natsTowerAllowedConnectionTypesAnnotationKey = "nats-tower.com/allowed-connection-types"
+	// natsTowerUserLimitsAnnotationKey records the limits on the secret
+	natsTowerUserLimitsAnnotationKey = "nats-tower.com/nats-tower-user-limits"
+)
+
+// connectionTypes are the connection types known to NATS.
+var connectionTypes = []string{
+	"STANDARD",
+	"WEBSOCKET",
+	"LEAFNODE",
+	"LEAFNODE_WS",
+	"MQTT",
+	"MQTT_WS",
+	"IN_PROCESS",
+}
+
+// getUserLimits resolves the limit annotations of the requesting object. The
+// limits are nil if none of the annotations is set, otherwise missing limits
+// are unlimited.
+func getUserLimits(annotations map[string]string) (*natstower.UserLimits, []string, error) {
+	limits := &natstower.UserLimits{
+		MaxSubscriptions: natstower.NoLimit,
+		MaxPayload:       natstower.NoLimit,
+		MaxData:          natstower.NoLimit,
+	}
+	set := false
+
+	if value, ok := annotations[natsTowerMaxSubscriptionsAnnotationKey]; ok {
+		subscriptions, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || subscriptions < 0 {
+			return nil, nil, fmt.Errorf("%s must be a non-negative number, got '%s'",
+				natsTowerMaxSubscriptionsAnnotationKey, value)
+		}
+		limits.MaxSubscriptions = subscriptions
+		set = true
+	}
+
+	for key, limit := range map[string]*int64{
+		natsTowerMaxPayloadAnnotationKey: &limits.MaxPayload,
+		natsTowerMaxDataAnnotationKey:    &limits.MaxData,
+	} {
+		value, ok := annotations[key]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(strings.TrimSpace(value))
+		if err != nil || quantity.Sign() < 0 {
+			return nil, nil, fmt.Errorf("%s must be a non-negative size like 1Mi, got '%s'", key, value)
+		}
+		*limit = quantity.Value()
+		set = true
+	}
+
+	var allowed []string
+	if value, ok := annotations[natsTowerAllowedConnectionTypesAnnotationKey]; ok {
+		for _, connectionType := range strings.Split(value, ",") {
+			connectionType = strings.ToUpper(strings.TrimSpace(connectionType))
+			if connectionType == "" {
+				continue
+			}
+			if !slices.Contains(connectionTypes, connectionType) {
+				return nil, nil, fmt.Errorf("%s: connection type '%s' must be one of %s",
+					natsTowerAllowedConnectionTypesAnnotationKey, connectionType, strings.Join(connectionTypes, ", "))
+			}
+			allowed = append(allowed, connectionType)
+		}
+		if len(allowed) == 0 {
+			return nil, nil, fmt.Errorf("%s must list at least one connection type",
+				natsTowerAllowedConnectionTypesAnnotationKey)
+		}
+		slices.Sort(allowed)
+		allowed = slices.Compact(allowed)
+		set = true
+	}
+
+	if !set {
+		return nil, nil, nil
+	}
+	return limits, allowed, nil
+}
+
+// formatUserLimits records the limits of a user, so changes can be detected
+// on the secret. Unlimited values are left out.
+func formatUserLimits(limits *natstower.UserLimits, allowed []string) string {
+	if limits == nil {
+		return ""
+	}
+
+	var fields []string
+	for _, limit := range []struct {
+		key   string
+		value int64
+	}{
+		{natsTowerMaxSubscriptionsAnnotationKey, limits.MaxSubscriptions},
+		{natsTowerMaxPayloadAnnotationKey, limits.MaxPayload},
+		{natsTowerMaxDataAnnotationKey, limits.MaxData},
+	} {
+		if limit.value != natstower.NoLimit {
+			fields = append(fields, fmt.Sprintf("%s=%d", strings.TrimPrefix(limit.key, "nats-tower.com/"), limit.value))
+		}
+	}
+	if len(allowed) > 0 {
+		fields = append(fields, fmt.Sprintf("%s=%s",
+			strings.TrimPrefix(natsTowerAllowedConnectionTypesAnnotationKey, "nats-tower.com/"), strings.Join(allowed, ",")))
+	}
+	return strings.Join(fields, " ")
+}
+
+// secretHasLimits reports whether the secret was written with the requested
+// limits.
+func secretHasLimits(secret *corev1.Secret, request secretRequest) bool {
+	return secret.Annotations[natsTowerUserLimitsAnnotationKey] == request.Limits
+}
@@ -0,0 +1,42 @@
+package application
+
+import (
+	"testing"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
+)
+
+func TestGetUserLimits(t *testing.T) {
+	limits, allowed, err := getUserLimits(nil)
+	if err != nil || limits != nil || allowed != nil {
+		t.Errorf("expected no limits, got %v %v (%v)", limits, allowed, err)
+	}
+
+	limits, allowed, err = getUserLimits(map[string]string{
+		natsTowerMaxSubscriptionsAnnotationKey:       "100",
+		natsTowerMaxPayloadAnnotationKey:             "1Mi",
+		natsTowerAllowedConnectionTypesAnnotationKey: "websocket, standard",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := natstower.UserLimits{MaxSubscriptions: 100, MaxPayload: 1 << 20, MaxData: natstower.NoLimit}
+	if *limits != expected {
+		t.Errorf("expected limits %+v, got %+v", expected, *limits)
+	}
+
+	record := formatUserLimits(limits, allowed)
+	if record != "max-subscriptions=100 max-payload=1048576 allowed-connection-types=STANDARD,WEBSOCKET" {
+		t.Errorf("unexpected record '%s'", record)
+	}
+
+	for _, annotations := range []map[string]string{
+		{natsTowerMaxSubscriptionsAnnotationKey: "-1"},
+		{natsTowerMaxDataAnnotationKey: "lots"},
+		{natsTowerAllowedConnectionTypesAnnotationKey: "carrier-pigeon"},
+	} {
+		if _, _, err := getUserLimits(annotations); err == nil {
+			t.Errorf("expected error for %v", annotations)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+// RestartWorkloads triggers a rollout of the Deployments and StatefulSets
+// whose pods use the secret and opted in with the restart-on-change
+// annotation. The content hash of the secret is written as checksum into the
+// pod template, so every change results in exactly one rollout.
+func (c *NATSTowerOperator) RestartWorkloads(ctx context.Context, secret *corev1.Secret, reason string) error {
+	checksum := secret.Annotations[natsTowerContentHashAnnotationKey]
+
+	pods, err := c.podController.List(secret.Namespace, labels.SelectorFromSet(labels.Set{natsTowerSecretLabelKey: secret.Name}))
+	if err != nil {
+		return fmt.Errorf("error listing pods of secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+
+	restarted := map[types.UID]bool{}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Annotations[natsTowerRestartOnChangeAnnotationKey] != "true" {
+			continue
+		}
+		if pod.Annotations[natsTowerSecretChecksumAnnotationKey] == checksum {
+			// Already part of the rollout
+			continue
+		}
+
+		controllerRef := v1.GetControllerOf(pod)
+		if controllerRef == nil {
+			klog.Infof("pod[%s] in namespace[%s]: not managed by a workload, skip restart",
+				pod.Name, pod.Namespace)
+			continue
+		}
+		if restarted[controllerRef.UID] {
+			continue
+		}
+		restarted[controllerRef.UID] = true
+
+		err := c.restartWorkload(ctx, pod.Namespace, controllerRef, checksum, secret.Name, reason)
+		if err != nil {
+			c.eventRecorder.Eventf(pod,
+				corev1.EventTypeWarning,
+				"ErrorRestartingWorkload",
+				"Could not restart the workload of the pod to pick up secret %s: %v",
+				secret.Name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refreshDue reports whether the connection info of the secret of pods that
+// restart on change should be refreshed from NATS Tower. All pods of a
+// workload are reconciled with the same secret, so it is refreshed at most
+// once per restart check interval.
+func (c *NATSTowerOperator) refreshDue(secret *corev1.Secret) bool {
+	c.refreshedMu.Lock()
+	defer c.refreshedMu.Unlock()
+	refreshed, ok := c.refreshed[secret.Namespace+"/"+secret.Name]
+	interval := time.Minute * time.Duration(c.towerOperatorConfig.RestartCheckInterval)
+	return !ok || time.Since(refreshed) >= interval
+}
+
+// requeueForRefresh schedules the next refresh of the secret of objects that
+// restart on change, nothing else reconciles them without a resync interval.
+// An earlier requeue of err, e.g. to renew the credentials, is kept.
+func (c *NATSTowerOperator) requeueForRefresh(err error, annotations map[string]string, namespace, secretName string) error {
+	interval := time.Minute * time.Duration(c.towerOperatorConfig.RestartCheckInterval)
+	if annotations[natsTowerRestartOnChangeAnnotationKey] != "true" || interval <= 0 {
+		return err
+	}
+	var requeueErr *k8s.RequeueAfterError
+	if err != nil && (!errors.As(err, &requeueErr) || requeueErr.Err != nil) {
+		return err
+	}
+	c.refreshedMu.Lock()
+	refreshed, ok := c.refreshed[namespace+"/"+secretName]
+	c.refreshedMu.Unlock()
+	after := interval
+	if ok {
+		after = max(time.Until(refreshed.Add(interval)), time.Second)
+	}
+	if requeueErr != nil && requeueErr.After < after {
+		return err
+	}
+	return k8s.RequeueAfter(after, nil)
+}
+
+// markRefreshed records that the connection info of a secret was fetched
+// from NATS Tower.
+func (c *NATSTowerOperator) markRefreshed(namespace, secretName string) {
+	c.refreshedMu.Lock()
+	defer c.refreshedMu.Unlock()
+	if c.refreshed == nil {
+		c.refreshed = map[string]time.Time{}
+	}
+	c.refreshed[namespace+"/"+secretName] = time.Now()
+}
+
+// forgetRefreshed drops the refresh time of a deleted secret.
+func (c *NATSTowerOperator) forgetRefreshed(namespace, secretName string) {
+	c.refreshedMu.Lock()
+	defer c.refreshedMu.Unlock()
+	delete(c.refreshed, namespace+"/"+secretName)
+}
+
+// restartWorkload resolves the Deployment or StatefulSet of a pod owner and
+// writes the checksum into its pod template.
+func (c *NATSTowerOperator) restartWorkload(ctx context.Context,
+	namespace string,
+	controllerRef *v1.OwnerReference,
+	checksum, secretName, reason string) error {
+
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]string{
+						natsTowerSecretChecksumAnnotationKey: checksum,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var workload runtime.Object
+	switch controllerRef.Kind {
+	case "ReplicaSet":
+		replicaSet, err := c.k8sClient.ClientSet.AppsV1().ReplicaSets(namespace).Get(ctx, controllerRef.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		deploymentRef := v1.GetControllerOf(replicaSet)
+		if deploymentRef == nil || deploymentRef.Kind != "Deployment" {
+			klog.Infof("ReplicaSet[%s] in namespace[%s]: not managed by a deployment, skip restart",
+				replicaSet.Name, namespace)
+			return nil
+		}
+		workload, err = c.k8sClient.ClientSet.AppsV1().Deployments(namespace).Patch(ctx,
+			deploymentRef.Name, types.StrategicMergePatchType, patch, v1.PatchOptions{})
+		if err != nil {
+			return err
+		}
+	case "StatefulSet":
+		workload, err = c.k8sClient.ClientSet.AppsV1().StatefulSets(namespace).Patch(ctx,
+			controllerRef.Name, types.StrategicMergePatchType, patch, v1.PatchOptions{})
+		if err != nil {
+			return err
+		}
+	default:
+		klog.Infof("%s[%s] in namespace[%s]: restart not supported",
+			controllerRef.Kind, controllerRef.Name, namespace)
+		return nil
+	}
+
+	c.eventRecorder.Eventf(workload,
+		corev1.EventTypeNormal,
+		"RestartedOnSecretChange",
+		"Restarting to pick up secret %s, %s", secretName, reason)
+	return nil
+}
@@ -0,0 +1,159 @@
+package application
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+func TestRestartOnChangeRefreshesOncePerInterval(t *testing.T) {
+	o := newTestOperator(t)
+	pods := o.newTestDeploymentPods(map[string]string{natsTowerRestartOnChangeAnnotationKey: "true"},
+		"frontend-a", "frontend-b")
+	if err := o.reconcilePod(pods[0]); requeuedAfter(err) == 0 {
+		t.Fatalf("expected the next refresh to be scheduled, got %v", err)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	fetched := o.tower.countRequests("GET", "nats_auth_users")
+
+	// The other pods of the workload do not refresh the secret again
+	for _, pod := range pods {
+		if err := o.reconcilePod(pod); requeuedAfter(err) == 0 {
+			t.Fatalf("expected the next refresh to be scheduled, got %v", err)
+		}
+	}
+	if o.tower.countRequests("GET", "nats_auth_users") != fetched {
+		t.Error("expected the secret not to be refreshed within the interval")
+	}
+
+	// The interval passed
+	o.refreshed[testNamespace+"/app-creds"] = time.Now().Add(-6 * time.Minute)
+	if err := o.reconcilePod(pods[1]); requeuedAfter(err) == 0 {
+		t.Fatalf("expected the next refresh to be scheduled, got %v", err)
+	}
+	if o.tower.countRequests("GET", "nats_auth_users") == fetched {
+		t.Error("expected the secret to be refreshed after the interval")
+	}
+}
+
+func TestRestartOnChangeRequeuesForRefresh(t *testing.T) {
+	o := newTestOperator(t)
+	pod := newTestPod("frontend", nil, map[string]string{natsTowerRestartOnChangeAnnotationKey: "true"})
+	interval := 5 * time.Minute
+	if after := requeuedAfter(o.reconcilePod(pod)); after <= interval-time.Second || after > interval {
+		t.Fatalf("expected the pod to be reconciled again after the interval, got %s", after)
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+
+	// Reconciles within the interval schedule the remaining time
+	o.refreshed[testNamespace+"/app-creds"] = time.Now().Add(-3 * time.Minute)
+	if after := requeuedAfter(o.reconcilePod(pod)); after <= time.Minute || after > 2*time.Minute {
+		t.Fatalf("expected the pod to be reconciled again when the interval passed, got %s", after)
+	}
+
+	// No further events arrive, the scheduled reconcile refreshes the secret
+	o.refreshed[testNamespace+"/app-creds"] = time.Now().Add(-6 * time.Minute)
+	fetched := o.tower.countRequests("GET", "nats_auth_users")
+	if after := requeuedAfter(o.reconcilePod(pod)); after <= interval-time.Second {
+		t.Fatalf("expected the next refresh to be scheduled, got %s", after)
+	}
+	if o.tower.countRequests("GET", "nats_auth_users") == fetched {
+		t.Error("expected the scheduled reconcile to refresh the secret")
+	}
+
+	// Objects that do not restart on change are not requeued
+	if err := o.reconcilePod(newTestPod("backend", nil, nil)); err != nil {
+		t.Errorf("expected no requeue without restart-on-change, got %v", err)
+	}
+}
+
+func TestRestartOnChangeRequeuesNACKAccount(t *testing.T) {
+	o := newTestOperator(t)
+	acc := newTestNACKAccount()
+	acc.Annotations = map[string]string{natsTowerRestartOnChangeAnnotationKey: "true"}
+	o.createNACKAccount(acc)
+	handler := getNACKAccountHandler(o.NATSTowerOperator)
+	request := k8s.Request{Key: testNamespace + "/" + testAccount}
+
+	if after := requeuedAfter(handler(context.Background(), nil, request, *acc)); after == 0 {
+		t.Fatal("expected the account to be reconciled again after the interval")
+	}
+	o.cache(testSecretGVR, o.getSecretOrNil(testNamespace, "app-creds"))
+	if after := requeuedAfter(handler(context.Background(), nil, request, *acc)); after == 0 {
+		t.Fatal("expected an up-to-date account to be reconciled again after the interval")
+	}
+}
+
+func TestRestartWorkloads(t *testing.T) {
+	o := newTestOperator(t)
+	annotations := map[string]string{natsTowerRestartOnChangeAnnotationKey: "true"}
+	pods := o.newTestDeploymentPods(annotations, "frontend-a", "frontend-b")
+
+	controller := true
+	statefulSet, err := o.clientset.AppsV1().StatefulSets(testNamespace).Create(context.Background(), &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: "queue", Namespace: testNamespace, UID: "statefulset-uid"},
+	}, v1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newTestPod("queue-0", nil, annotations)
+	queue.OwnerReferences = []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet",
+		Name: statefulSet.Name, UID: statefulSet.UID, Controller: &controller}}
+	// Pods without the annotation and pods without a workload are not restarted
+	standalone := newTestPod("standalone", nil, annotations)
+	optedOut := newTestPod("opted-out", nil, nil)
+	optedOut.OwnerReferences = queue.OwnerReferences
+
+	for _, pod := range append(pods, queue, standalone, optedOut) {
+		if err := o.reconcilePod(pod); err != nil && requeuedAfter(err) == 0 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	o.clientset.ClearActions()
+	o.events()
+
+	secret := o.getSecretOrNil(testNamespace, "app-creds")
+	if err := o.RestartWorkloads(context.Background(), secret, "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	checksum := secret.Annotations[natsTowerContentHashAnnotationKey]
+	deployment, _ := o.clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "frontend", v1.GetOptions{})
+	if deployment.Spec.Template.Annotations[natsTowerSecretChecksumAnnotationKey] != checksum {
+		t.Errorf("expected the Deployment to be restarted, got %v", deployment.Spec.Template.Annotations)
+	}
+	statefulSet, _ = o.clientset.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "queue", v1.GetOptions{})
+	if statefulSet.Spec.Template.Annotations[natsTowerSecretChecksumAnnotationKey] != checksum {
+		t.Errorf("expected the StatefulSet to be restarted, got %v", statefulSet.Spec.Template.Annotations)
+	}
+	patches := 0
+	for _, action := range o.clientset.Actions() {
+		if action.GetVerb() == "patch" {
+			patches++
+		}
+	}
+	if patches != 2 {
+		t.Errorf("expected each workload to be restarted once, got %d patches", patches)
+	}
+	if !hasEvent(o.events(), "RestartedOnSecretChange") {
+		t.Error("expected a RestartedOnSecretChange event")
+	}
+
+	// Pods of the rollout already carry the checksum
+	for _, pod := range append(pods, queue) {
+		pod.Annotations[natsTowerSecretChecksumAnnotationKey] = checksum
+		o.cache(testPodGVR, pod)
+	}
+	o.clientset.ClearActions()
+	if err := o.RestartWorkloads(context.Background(), secret, "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(o.clientset.Actions()) != 0 {
+		t.Errorf("expected no restart of workloads already rolling out, got %v", o.clientset.Actions())
+	}
+}
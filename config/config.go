@@ -2,9 +2,14 @@ package config
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,19 +21,70 @@ type Selector struct {
 type Resource struct {
 	Kind     string
 	Selector Selector
+	Workers  uint
+}
+
+// Installation holds the settings of a NATS installation that are not
+// known to NATS Tower.
+type Installation struct {
+	JetStreamDomain string `yaml:"jetstream_domain"`
+	// LeafnodeURLs are the comma separated leafnode URLs of the hub
+	LeafnodeURLs string `yaml:"leafnode_urls"`
+	// WebsocketURLs are the comma separated websocket URLs of the installation
+	WebsocketURLs string `yaml:"websocket_urls"`
+	// MQTTURLs are the comma separated MQTT URLs of the installation
+	MQTTURLs string `yaml:"mqtt_urls"`
+}
+
+// Policy restricts the accounts, roles and subjects namespaces may request.
+// A request is allowed if any of the rules allows it.
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule allows the matching namespaces to use the listed accounts.
+// Namespaces, accounts and roles are glob patterns, subjects are NATS
+// subject patterns that may contain Go templates like the permission
+// annotations. An empty list of roles or subjects does not restrict them.
+type PolicyRule struct {
+	Namespaces []string `yaml:"namespaces"`
+	Accounts   []string `yaml:"accounts"`
+	Roles      []string `yaml:"roles"`
+	Subjects   []string `yaml:"subjects"`
+}
+
+// PolicySubjectData is available to the templates in policy subjects. Rules
+// apply to whole namespaces, so the pod name and labels, which the pod
+// controls itself, are not.
+type PolicySubjectData struct {
+	Namespace string
+	ClusterID string
 }
 
 type Config struct {
-	ClusterID           string
-	Namespace           string
-	ResyncInterval      uint
-	PodConfig           Resource
-	SecretConfig        Resource
-	NACKAccountConfig   Resource
-	DefaultInstallation string
-	ValidInstallations  map[string]any
-	TowerURL            string
-	TowerAPIToken       string
+	ClusterID            string
+	Namespace            string
+	ResyncInterval       uint
+	NamespaceQPS         float64
+	NamespaceBurst       uint
+	FinalizerTimeout     uint
+	JobCredentialsTTL    uint
+	BearerTokenTTL       uint
+	RestartCheckInterval uint
+	DeadLetterRetry      uint
+	AdminAddress         string
+	HealthAddress        string
+	PodConfig            Resource
+	SecretConfig         Resource
+	NACKAccountConfig    Resource
+	AccessGrantConfig    Resource
+	JobConfig            Resource
+	AccessGrantsEnabled  bool
+	DefaultInstallation  string
+	ValidInstallations   map[string]Installation
+	Policy               *Policy
+	TowerURL             string
+	TowerAPIToken        string
 }
 
 // Environment variable names
@@ -37,33 +93,67 @@ const (
 	EnvNamespace             = "NATS_TOWER_NAMESPACE"
 	EnvDefaultInstallation   = "NATS_TOWER_DEFAULT_INSTALLATION"
 	EnvInstallationsFilePath = "NATS_TOWER_INSTALLATIONS_FILE_PATH"
+	EnvPolicyFilePath        = "NATS_TOWER_POLICY_FILE_PATH"
 	EnvTowerURL              = "NATS_TOWER_URL"
 	EnvTowerAPITokenPath     = "NATS_TOWER_API_TOKEN_PATH"
 	EnvTowerAPIToken         = "NATS_TOWER_API_TOKEN"
 	EnvResyncInterval        = "NATS_TOWER_RESYNC_INTERVAL"
+	EnvFinalizerTimeout      = "NATS_TOWER_FINALIZER_TIMEOUT"
+	EnvJobCredentialsTTL     = "NATS_TOWER_JOB_CREDENTIALS_TTL"
+	EnvBearerTokenTTL        = "NATS_TOWER_BEARER_TOKEN_TTL"
+	EnvRestartCheckInterval  = "NATS_TOWER_RESTART_CHECK_INTERVAL"
+	EnvDeadLetterRetry       = "NATS_TOWER_DEAD_LETTER_RETRY_INTERVAL"
+	EnvAdminAddress          = "NATS_TOWER_ADMIN_ADDRESS"
+	EnvHealthAddress         = "NATS_TOWER_HEALTH_ADDRESS"
+	EnvNamespaceQPS          = "NATS_TOWER_NAMESPACE_QPS"
+	EnvNamespaceBurst        = "NATS_TOWER_NAMESPACE_BURST"
 
 	// Pod config
 	EnvPodConfigKind     = "NATS_TOWER_POD_CONFIG_KIND"
 	EnvPodConfigSelector = "NATS_TOWER_POD_CONFIG_SELECTOR"
+	EnvPodConfigWorkers  = "NATS_TOWER_POD_CONFIG_WORKERS"
 
 	// Secret config
 	EnvSecretConfigKind     = "NATS_TOWER_SECRET_CONFIG_KIND"
 	EnvSecretConfigSelector = "NATS_TOWER_SECRET_CONFIG_SELECTOR"
+	EnvSecretConfigWorkers  = "NATS_TOWER_SECRET_CONFIG_WORKERS"
 
 	// NACK account config
 	EnvNACKConfigKind     = "NATS_TOWER_NACK_CONFIG_KIND"
 	EnvNACKConfigSelector = "NATS_TOWER_NACK_CONFIG_SELECTOR"
+	EnvNACKConfigWorkers  = "NATS_TOWER_NACK_CONFIG_WORKERS"
+
+	// NatsAccessGrant config
+	EnvAccessGrantsEnabled       = "NATS_TOWER_ACCESS_GRANTS_ENABLED"
+	EnvAccessGrantConfigKind     = "NATS_TOWER_ACCESS_GRANT_CONFIG_KIND"
+	EnvAccessGrantConfigSelector = "NATS_TOWER_ACCESS_GRANT_CONFIG_SELECTOR"
+	EnvAccessGrantConfigWorkers  = "NATS_TOWER_ACCESS_GRANT_CONFIG_WORKERS"
+
+	// Job config
+	EnvJobConfigKind     = "NATS_TOWER_JOB_CONFIG_KIND"
+	EnvJobConfigSelector = "NATS_TOWER_JOB_CONFIG_SELECTOR"
+	EnvJobConfigWorkers  = "NATS_TOWER_JOB_CONFIG_WORKERS"
 )
 
 // Default values
 const (
 	DefaultTowerURL              = ""
 	DefaultInstallationsFilePath = "config/installations.yaml"
+	DefaultFinalizerTimeout      = "10"
+	DefaultJobCredentialsTTL     = "5"
+	DefaultBearerTokenTTL        = "60"
+	DefaultRestartCheckInterval  = "5"
+	DefaultDeadLetterRetry       = "5"
+	DefaultAdminAddress          = "127.0.0.1:8080"
+	DefaultHealthAddress         = ":8081"
+	DefaultWorkers               = "1"
+	DefaultNamespaceQPS          = "5"
+	DefaultNamespaceBurst        = "25"
 )
 
 // NewValidInstallationsFromFile reads and parses installations from a YAML file
-func NewValidInstallationsFromFile(filepath string) (map[string]any, error) {
-	validInstallations := make(map[string]any)
+func NewValidInstallationsFromFile(filepath string) (map[string]Installation, error) {
+	validInstallations := make(map[string]Installation)
 	config, err := os.ReadFile(filepath)
 	if err != nil {
 		return nil, err
@@ -77,6 +167,58 @@ func NewValidInstallationsFromFile(filepath string) (map[string]any, error) {
 	return validInstallations, nil
 }
 
+// NewPolicyFromFile reads and validates a policy from a YAML file
+func NewPolicyFromFile(filepath string) (*Policy, error) {
+	content, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	err = yaml.UnmarshalStrict(content, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range policy.Rules {
+		if len(rule.Namespaces) == 0 || len(rule.Accounts) == 0 {
+			return nil, fmt.Errorf("rule %d: namespaces and accounts are required", i)
+		}
+		for _, pattern := range slices.Concat(rule.Namespaces, rule.Accounts, rule.Roles) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern '%s': %s", i, pattern, err.Error())
+			}
+		}
+		for _, subject := range rule.Subjects {
+			if err := checkPolicySubject(subject); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid subject '%s': %s", i, subject, err.Error())
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// checkPolicySubject checks that the templates of a policy subject only use
+// the fields of PolicySubjectData.
+func checkPolicySubject(subject string) error {
+	tmpl, err := template.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(io.Discard, PolicySubjectData{})
+}
+
+// InstallationKeys returns the sorted public keys of the valid installations
+func (c *Config) InstallationKeys() []string {
+	keys := make([]string, 0, len(c.ValidInstallations))
+	for key := range c.ValidInstallations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // readFileContent reads content from a file path
 func readFileContent(path string) (string, error) {
 	if path == "" {
@@ -90,6 +232,27 @@ func readFileContent(path string) (string, error) {
 	return strings.TrimSpace(string(data)), nil
 }
 
+// getEnvUint gets an environment variable as unsigned integer or returns the fallback value
+func getEnvUint(key, fallback string) (uint, error) {
+	val, err := strconv.ParseUint(getEnv(key, fallback), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid format of %s: %s", key, err.Error())
+	}
+	return uint(val), nil
+}
+
+// getEnvWorkers gets the number of workers of a controller, which must be at least 1
+func getEnvWorkers(key string) (uint, error) {
+	workers, err := getEnvUint(key, DefaultWorkers)
+	if err != nil {
+		return 0, err
+	}
+	if workers == 0 {
+		return 0, fmt.Errorf("invalid format of %s: at least 1 worker is required", key)
+	}
+	return workers, nil
+}
+
 // getEnv gets an environment variable or returns the fallback value
 func getEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -106,6 +269,8 @@ func NewConfigFromEnv() (*Config, error) {
 	defaultInstallation := getEnv(EnvDefaultInstallation, "")
 	installationsFilePath := getEnv(EnvInstallationsFilePath, DefaultInstallationsFilePath)
 	towerURL := getEnv(EnvTowerURL, DefaultTowerURL)
+	adminAddress := getEnv(EnvAdminAddress, DefaultAdminAddress)
+	healthAddress := getEnv(EnvHealthAddress, DefaultHealthAddress)
 
 	// Parse resync interval
 	var resyncInterval uint
@@ -117,6 +282,55 @@ func NewConfigFromEnv() (*Config, error) {
 		}
 	}
 
+	// Parse finalizer timeout
+	finalizerTimeout, err := getEnvUint(EnvFinalizerTimeout, DefaultFinalizerTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse job credentials ttl
+	jobCredentialsTTL, err := getEnvUint(EnvJobCredentialsTTL, DefaultJobCredentialsTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse bearer token ttl
+	bearerTokenTTL, err := getEnvUint(EnvBearerTokenTTL, DefaultBearerTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	if bearerTokenTTL == 0 {
+		return nil, fmt.Errorf("invalid format of %s: bearer tokens must expire", EnvBearerTokenTTL)
+	}
+
+	// Parse restart check interval
+	restartCheckInterval, err := getEnvUint(EnvRestartCheckInterval, DefaultRestartCheckInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse dead letter retry interval
+	deadLetterRetry, err := getEnvUint(EnvDeadLetterRetry, DefaultDeadLetterRetry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse per-namespace rate limits
+	namespaceQPS, err := strconv.ParseFloat(getEnv(EnvNamespaceQPS, DefaultNamespaceQPS), 64)
+	if err != nil || namespaceQPS < 0 {
+		return nil, fmt.Errorf("invalid namespace qps format: %s", getEnv(EnvNamespaceQPS, DefaultNamespaceQPS))
+	}
+	namespaceBurst, err := getEnvUint(EnvNamespaceBurst, DefaultNamespaceBurst)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse access grants flag
+	accessGrantsEnabled, err := strconv.ParseBool(getEnv(EnvAccessGrantsEnabled, "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid access grants enabled format: %s", err.Error())
+	}
+
 	// Handle API token from file or environment
 	var towerAPIToken string
 	if tokenPath := getEnv(EnvTowerAPITokenPath, ""); tokenPath != "" {
@@ -145,38 +359,99 @@ func NewConfigFromEnv() (*Config, error) {
 		return nil, fmt.Errorf("error loading valid installations: %s", err.Error())
 	}
 
+	// Load the optional policy
+	var policy *Policy
+	if policyFilePath := getEnv(EnvPolicyFilePath, ""); policyFilePath != "" {
+		policy, err = NewPolicyFromFile(policyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading policy: %s", err.Error())
+		}
+	}
+
 	// Create resource configurations
+	podConfigWorkers, err := getEnvWorkers(EnvPodConfigWorkers)
+	if err != nil {
+		return nil, err
+	}
 	podConfig := Resource{
 		Kind: getEnv(EnvPodConfigKind, ""),
 		Selector: Selector{
 			Query: getEnv(EnvPodConfigSelector, ""),
 		},
+		Workers: podConfigWorkers,
 	}
 
+	secretConfigWorkers, err := getEnvWorkers(EnvSecretConfigWorkers)
+	if err != nil {
+		return nil, err
+	}
 	secretConfig := Resource{
 		Kind: getEnv(EnvSecretConfigKind, ""),
 		Selector: Selector{
 			Query: getEnv(EnvSecretConfigSelector, ""),
 		},
+		Workers: secretConfigWorkers,
 	}
 
+	nackAccountConfigWorkers, err := getEnvWorkers(EnvNACKConfigWorkers)
+	if err != nil {
+		return nil, err
+	}
 	nackAccountConfig := Resource{
 		Kind: getEnv(EnvNACKConfigKind, ""),
 		Selector: Selector{
 			Query: getEnv(EnvNACKConfigSelector, ""),
 		},
+		Workers: nackAccountConfigWorkers,
+	}
+
+	accessGrantConfigWorkers, err := getEnvWorkers(EnvAccessGrantConfigWorkers)
+	if err != nil {
+		return nil, err
+	}
+	accessGrantConfig := Resource{
+		Kind: getEnv(EnvAccessGrantConfigKind, ""),
+		Selector: Selector{
+			Query: getEnv(EnvAccessGrantConfigSelector, ""),
+		},
+		Workers: accessGrantConfigWorkers,
+	}
+
+	jobConfigWorkers, err := getEnvWorkers(EnvJobConfigWorkers)
+	if err != nil {
+		return nil, err
+	}
+	jobConfig := Resource{
+		Kind: getEnv(EnvJobConfigKind, ""),
+		Selector: Selector{
+			Query: getEnv(EnvJobConfigSelector, ""),
+		},
+		Workers: jobConfigWorkers,
 	}
 
 	return &Config{
-		ClusterID:           clusterID,
-		Namespace:           namespace,
-		DefaultInstallation: defaultInstallation,
-		ResyncInterval:      resyncInterval,
-		PodConfig:           podConfig,
-		SecretConfig:        secretConfig,
-		NACKAccountConfig:   nackAccountConfig,
-		ValidInstallations:  validInstallations,
-		TowerURL:            towerURL,
-		TowerAPIToken:       towerAPIToken,
+		ClusterID:            clusterID,
+		Namespace:            namespace,
+		DefaultInstallation:  defaultInstallation,
+		ResyncInterval:       resyncInterval,
+		NamespaceQPS:         namespaceQPS,
+		NamespaceBurst:       namespaceBurst,
+		FinalizerTimeout:     finalizerTimeout,
+		JobCredentialsTTL:    jobCredentialsTTL,
+		BearerTokenTTL:       bearerTokenTTL,
+		RestartCheckInterval: restartCheckInterval,
+		DeadLetterRetry:      deadLetterRetry,
+		AdminAddress:         adminAddress,
+		HealthAddress:        healthAddress,
+		PodConfig:            podConfig,
+		SecretConfig:         secretConfig,
+		NACKAccountConfig:    nackAccountConfig,
+		AccessGrantConfig:    accessGrantConfig,
+		JobConfig:            jobConfig,
+		AccessGrantsEnabled:  accessGrantsEnabled,
+		ValidInstallations:   validInstallations,
+		Policy:               policy,
+		TowerURL:             towerURL,
+		TowerAPIToken:        towerAPIToken,
 	}, nil
 }
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPolicyFromFileSubjectTemplates(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]bool{
+		`orders.{{ .Namespace }}.{{ .ClusterID }}.>`: true,
+		`orders.{{ .PodName }}.>`:                    false,
+		`orders.{{ .Labels.team }}.>`:                false,
+		`orders.{{ .Namespace`:                       false,
+	}
+
+	for subject, valid := range tests {
+		policyFile := filepath.Join(dir, "policy.yaml")
+		content := "rules:\n  - namespaces: [\"team-*\"]\n    accounts: [\"orders\"]\n    subjects: ['" + subject + "']\n"
+		if err := os.WriteFile(policyFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := NewPolicyFromFile(policyFile)
+		if (err == nil) != valid {
+			t.Errorf("%s: expected valid=%t, got %v", subject, valid, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
+)
+
+// Server exposes the dead letters of the controllers and metrics about them.
+// The liveness probe and the metrics are served on a separate address, so
+// the dead letters can stay bound to localhost while Prometheus and the
+// kubelet reach the pod.
+type Server struct {
+	address       string
+	healthAddress string
+	sources       []k8s.DeadLetterSource
+}
+
+// NewServer creates an admin server listening on address and a health and
+// metrics server listening on healthAddress. Empty addresses disable the
+// server.
+func NewServer(address, healthAddress string, sources ...k8s.DeadLetterSource) *Server {
+	return &Server{
+		address:       address,
+		healthAddress: healthAddress,
+		sources:       sources,
+	}
+}
+
+// Run serves the admin, health and metrics endpoints until stopCh is closed.
+func (s *Server) Run(stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+
+	if s.healthAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /healthz", s.handleHealthz)
+		mux.HandleFunc("GET /metrics", s.handleMetrics)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve("health", s.healthAddress, mux, stopCh)
+		}()
+	}
+
+	if s.address != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /healthz", s.handleHealthz)
+		mux.HandleFunc("GET /deadletters", s.handleDeadLetters)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve("admin", s.address, mux, stopCh)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func serve(name, address string, handler http.Handler, stopCh <-chan struct{}) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	klog.Infof("Starting %s server on '%s'", name, address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("Error running %s server: %s", name, err.Error())
+	}
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters := []k8s.DeadLetter{}
+	for _, source := range s.sources {
+		deadLetters = append(deadLetters, source.DeadLetters()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(deadLetters)
+	if err != nil {
+		klog.Errorf("Error encoding dead letters: %s", err.Error())
+	}
+}
+
+// handleMetrics writes the metrics in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP nats_tower_operator_dead_letters Number of objects whose reconciliation is paused.")
+	fmt.Fprintln(w, "# TYPE nats_tower_operator_dead_letters gauge")
+	for _, source := range s.sources {
+		fmt.Fprintf(w, "nats_tower_operator_dead_letters{resource=%q} %d\n",
+			source.Resource(), len(source.DeadLetters()))
+	}
+
+	fmt.Fprintln(w, "# HELP nats_tower_operator_dead_letters_total Number of objects moved to the dead-letter set.")
+	fmt.Fprintln(w, "# TYPE nats_tower_operator_dead_letters_total counter")
+	for _, source := range s.sources {
+		fmt.Fprintf(w, "nats_tower_operator_dead_letters_total{resource=%q} %d\n",
+			source.Resource(), source.DeadLettersTotal())
+	}
+}
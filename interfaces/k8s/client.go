@@ -13,7 +13,7 @@ type Client struct {
 	DiscoveryClient *discovery.DiscoveryClient
 	DynamicClient   dynamic.Interface
 	DiscoveryMapper *restmapper.DeferredDiscoveryRESTMapper
-	ClientSet       *kubernetes.Clientset
+	ClientSet       kubernetes.Interface
 }
 
 func NewClient(config *rest.Config) (*Client, error) {
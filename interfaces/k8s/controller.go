@@ -2,12 +2,17 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	nackapi "github.com/nats-io/nack/pkg/jetstream/apis/jetstream/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -16,83 +21,224 @@ import (
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
+	"github.com/nats-tower/nats-tower-operator/apis/v1alpha1"
 	"github.com/nats-tower/nats-tower-operator/config"
 	"github.com/nats-tower/nats-tower-operator/utils/jq"
 )
 
-type EventActionType string
+const MaxNumRequeues int = 4
 
-const (
-	CreateAction   EventActionType = "create"
-	UpdateAction   EventActionType = "update"
-	DeleteAction   EventActionType = "delete"
-	MaxNumRequeues int             = 4
-)
+// RequeueAfterError asks the controller to process an item again after the
+// given duration instead of retrying it with the rate limiter.
+type RequeueAfterError struct {
+	After time.Duration
+	Err   error
+}
+
+func (e *RequeueAfterError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("requeue after %s", e.After)
+	}
+	return fmt.Sprintf("%v, retry after %s", e.Err, e.After)
+}
 
-type EventItem struct {
-	Key        string
-	ActionType EventActionType
+func (e *RequeueAfterError) Unwrap() error {
+	return e.Err
+}
+
+// RequeueAfter wraps err into a RequeueAfterError. A nil err schedules the
+// next reconcile without reporting a failure, e.g. once a TTL expired.
+func RequeueAfter(after time.Duration, err error) error {
+	return &RequeueAfterError{After: after, Err: err}
+}
+
+// Request identifies the object to reconcile. Handlers are level-triggered:
+// they compute the desired state from the object alone, no matter which or
+// how many events led to the reconcile.
+type Request struct {
+	Key string
+	// Deleted reports that the object is gone. The handler gets the last
+	// known state of the object.
+	Deleted bool
 }
 
 type K8sAPIObject interface {
-	corev1.Pod | corev1.Secret | nackapi.Account
+	corev1.Pod | corev1.Secret | nackapi.Account | v1alpha1.NatsAccessGrant | batchv1.Job
+}
+
+// ControllerOptions configures the optional behaviour of a controller.
+type ControllerOptions[T K8sAPIObject] struct {
+	// DeadLetterRetryInterval is the interval in which items that failed
+	// MaxNumRequeues times are retried. Defaults to 5 minutes.
+	DeadLetterRetryInterval time.Duration
+	// OnDeadLetter is called when an item is moved to the dead-letter set.
+	OnDeadLetter func(obj T, err error)
+	// NamespaceQPS and NamespaceBurst limit the rate in which objects of a
+	// single namespace are reconciled. A NamespaceQPS of 0 disables the limit.
+	NamespaceQPS   float64
+	NamespaceBurst int
 }
 
 type Controller[T K8sAPIObject] struct {
 	resource  config.Resource
 	informer  cache.SharedIndexInformer
 	lister    cache.GenericLister
-	workqueue workqueue.RateLimitingInterface
-	cb        func(ctx context.Context, informer cache.SharedIndexInformer, ev EventItem, obj T) error
+	workqueue workqueue.TypedRateLimitingInterface[string]
+	cb        func(ctx context.Context, informer cache.SharedIndexInformer, req Request, obj T) error
+
+	// deletedObjects holds the last known state of deleted objects by key,
+	// as they are no longer in the informer cache once they are reconciled.
+	deletedObjectsMu sync.Mutex
+	deletedObjects   map[string]interface{}
+
+	options          ControllerOptions[T]
+	deadLettersMu    sync.Mutex
+	deadLetters      map[string]*DeadLetter
+	deadLettersTotal uint64
 }
 
 func NewController[T K8sAPIObject](resource config.Resource,
-	cb func(ctx context.Context, informer cache.SharedIndexInformer, ev EventItem, obj T) error,
-	informer informers.GenericInformer) *Controller[T] {
+	cb func(ctx context.Context, informer cache.SharedIndexInformer, req Request, obj T) error,
+	informer informers.GenericInformer,
+	options ControllerOptions[T]) *Controller[T] {
+	if options.DeadLetterRetryInterval <= 0 {
+		options.DeadLetterRetryInterval = 5 * time.Minute
+	}
+
 	controller := &Controller[T]{
-		resource:  resource,
-		informer:  informer.Informer(),
-		lister:    informer.Lister(),
-		workqueue: workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-		cb:        cb,
+		resource:       resource,
+		informer:       informer.Informer(),
+		lister:         informer.Lister(),
+		workqueue:      newFairQueue(workqueue.DefaultTypedControllerRateLimiter[string](), options.NamespaceQPS, options.NamespaceBurst),
+		cb:             cb,
+		deletedObjects: map[string]interface{}{},
+		options:        options,
+		deadLetters:    map[string]*DeadLetter{},
+	}
+
+	// The managed fields are never used and make up a large part of the cached objects
+	err := controller.informer.SetTransform(stripManagedFields)
+	if err != nil {
+		klog.Errorf("Error setting transform of informer for resource '%s': %s", resource.Kind, err.Error())
 	}
 
+	// All events are collapsed into the key of the object, so a burst of
+	// events results in a single reconcile.
 	controller.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			var err error
-			var item EventItem
-			item.ActionType = CreateAction
-			item.Key, err = cache.MetaNamespaceKeyFunc(obj)
-			if err == nil {
-				controller.workqueue.Add(item)
-			}
-		},
+		AddFunc: controller.enqueue,
 		UpdateFunc: func(old interface{}, new interface{}) {
-			var err error
-			var item EventItem
-			item.ActionType = UpdateAction
-			item.Key, err = cache.MetaNamespaceKeyFunc(new)
-			if err == nil {
-				controller.workqueue.Add(item)
-			}
-		},
-		DeleteFunc: func(obj interface{}) {
-			var err error
-			var item EventItem
-			item.ActionType = DeleteAction
-			item.Key, err = cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
-			if err == nil {
-				err = controller.objectHandler(obj, item)
-				if err != nil {
-					klog.Errorf("Error deleting item '%s' of resource '%s': %s", item.Key, resource.Kind, err.Error())
-				}
-			}
+			controller.enqueue(new)
 		},
+		DeleteFunc: controller.enqueueDelete,
 	})
 
 	return controller
 }
 
+// stripManagedFields drops the managed fields of objects before they are
+// stored in the informer cache.
+func stripManagedFields(obj interface{}) (interface{}, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+	}
+	return obj, nil
+}
+
+// Get returns the object with the given namespace and name from the informer
+// cache. A missing object results in a NotFound error.
+func (c *Controller[T]) Get(namespace, name string) (*T, error) {
+	var obj runtime.Object
+	var err error
+	if namespace == "" {
+		obj, err = c.lister.Get(name)
+	} else {
+		obj, err = c.lister.ByNamespace(namespace).Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return toStructured[T](obj)
+}
+
+// List returns the objects of the namespace from the informer cache that
+// match the selector.
+func (c *Controller[T]) List(namespace string, selector labels.Selector) ([]T, error) {
+	objs, err := c.lister.ByNamespace(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	structuredObjs := make([]T, 0, len(objs))
+	for _, obj := range objs {
+		structuredObj, err := toStructured[T](obj)
+		if err != nil {
+			return nil, err
+		}
+		structuredObjs = append(structuredObjs, *structuredObj)
+	}
+
+	return structuredObjs, nil
+}
+
+func toStructured[T K8sAPIObject](obj interface{}) (*T, error) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("error casting to unstructured")
+	}
+	var structuredObj T
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredObj.Object, &structuredObj)
+	if err != nil {
+		return nil, fmt.Errorf("error converting from unstructured: %v", err)
+	}
+	return &structuredObj, nil
+}
+
+func (c *Controller[T]) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error getting key of object of resource '%s': %v", c.resource.Kind, err))
+		return
+	}
+
+	// The object (re)appeared, its desired state is computed from the cache
+	c.forgetDeletedObject(key)
+	c.workqueue.Add(key)
+}
+
+// enqueueDelete queues the key of a deleted object and keeps its last known
+// state. Tombstones of deletes missed by the watch are unwrapped.
+func (c *Controller[T]) enqueueDelete(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("error getting key of deleted object of resource '%s': %v", c.resource.Kind, err))
+		return
+	}
+
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	c.deletedObjectsMu.Lock()
+	c.deletedObjects[key] = obj
+	c.deletedObjectsMu.Unlock()
+
+	c.workqueue.Add(key)
+}
+
+func (c *Controller[T]) getDeletedObject(key string) (interface{}, bool) {
+	c.deletedObjectsMu.Lock()
+	defer c.deletedObjectsMu.Unlock()
+	obj, ok := c.deletedObjects[key]
+	return obj, ok
+}
+
+func (c *Controller[T]) forgetDeletedObject(key string) {
+	c.deletedObjectsMu.Lock()
+	delete(c.deletedObjects, key)
+	c.deletedObjectsMu.Unlock()
+}
+
 func (c *Controller[T]) Shutdown() {
 	klog.Infof("Shutting down controller for resource '%s'", c.resource.Kind)
 	c.workqueue.ShutDown()
@@ -114,6 +260,7 @@ func (c *Controller[T]) Run(workers int, stopCh <-chan struct{}) {
 	for i := 0; i < workers; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
 	}
+	go wait.Until(c.retryDeadLetters, c.options.DeadLetterRetryInterval, stopCh)
 	klog.Infof("Started workers for resource '%s'", c.resource.Kind)
 }
 
@@ -123,36 +270,43 @@ func (c *Controller[T]) runWorker() {
 }
 
 func (c *Controller[T]) processNextWorkItem() bool {
-	obj, shutdown := c.workqueue.Get()
+	key, shutdown := c.workqueue.Get()
 
 	if shutdown {
 		return false
 	}
 
-	err := func(obj interface{}) error {
-		defer c.workqueue.Done(obj)
-
-		item, ok := obj.(EventItem)
-
-		if !ok {
-			c.workqueue.Forget(obj)
-			utilruntime.HandleError(fmt.Errorf("expected event item of resource '%s' in workqueue but got %#v", c.resource.Kind, obj))
-			return nil
-		}
+	err := func(key string) error {
+		defer c.workqueue.Done(key)
+
+		if err := c.syncHandler(key); err != nil {
+			var requeueErr *RequeueAfterError
+			if errors.As(err, &requeueErr) {
+				c.workqueue.Forget(key)
+				c.workqueue.AddAfter(key, requeueErr.After)
+				if requeueErr.Err == nil {
+					c.releaseDeadLetter(key)
+					return nil
+				}
+				return fmt.Errorf("error syncing '%s' of resource '%s': %s", key, c.resource.Kind, err.Error())
+			}
 
-		if err := c.syncHandler(item); err != nil {
-			if c.workqueue.NumRequeues(obj) >= MaxNumRequeues {
-				utilruntime.HandleError(fmt.Errorf("error syncing '%s' of resource '%s': %s, give up after %d requeues", item.Key, c.resource.Kind, err.Error(), MaxNumRequeues))
+			if c.workqueue.NumRequeues(key) >= MaxNumRequeues {
+				// Keep the last known state of deleted objects and the
+				// requeues for the retries, a failed retry parks the key again
+				c.parkDeadLetter(key, err)
+				utilruntime.HandleError(fmt.Errorf("error syncing '%s' of resource '%s': %s, paused after %d requeues, retry in %s", key, c.resource.Kind, err.Error(), MaxNumRequeues, c.options.DeadLetterRetryInterval))
 				return nil
 			}
 
-			c.workqueue.AddRateLimited(obj)
-			return fmt.Errorf("error syncing '%s' of resource '%s': %s, requeuing", item.Key, c.resource.Kind, err.Error())
+			c.workqueue.AddRateLimited(key)
+			return fmt.Errorf("error syncing '%s' of resource '%s': %s, requeuing", key, c.resource.Kind, err.Error())
 		}
 
-		c.workqueue.Forget(obj)
+		c.workqueue.Forget(key)
+		c.releaseDeadLetter(key)
 		return nil
-	}(obj)
+	}(key)
 
 	if err != nil {
 		utilruntime.HandleError(err)
@@ -162,25 +316,45 @@ func (c *Controller[T]) processNextWorkItem() bool {
 	return true
 }
 
-func (c *Controller[T]) syncHandler(item EventItem) error {
-	obj, exists, err := c.informer.GetIndexer().GetByKey(item.Key)
+// syncHandler reconciles the object with the given key. Objects that are no
+// longer in the informer cache are reconciled with their last known state.
+func (c *Controller[T]) syncHandler(key string) error {
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
 	if err != nil {
-		return fmt.Errorf("error fetching object with key '%s' from informer cache: %v", item.Key, err)
+		return fmt.Errorf("error fetching object with key '%s' from informer cache: %v", key, err)
 	}
+
+	req := Request{Key: key}
 	if !exists {
-		utilruntime.HandleError(fmt.Errorf("'%s' in work queue no longer exists", item.Key))
-		return nil
+		obj, exists = c.getDeletedObject(key)
+		if !exists {
+			// Nothing known about the object, e.g. it was already reconciled as deleted
+			return nil
+		}
+		req.Deleted = true
 	}
 
-	err = c.objectHandler(obj, item)
+	err = c.objectHandler(obj, req)
 	if err != nil {
-		return fmt.Errorf("error handling object with key '%s': %v", item.Key, err)
+		return fmt.Errorf("error handling object with key '%s': %w", key, err)
+	}
+
+	if req.Deleted {
+		// Keep the state of a newer delete that happened meanwhile
+		c.deletedObjectsMu.Lock()
+		if c.deletedObjects[key] == obj {
+			delete(c.deletedObjects, key)
+		}
+		c.deletedObjectsMu.Unlock()
 	}
 
 	return nil
 }
 
-func (c *Controller[T]) objectHandler(obj interface{}, item EventItem) error {
+func (c *Controller[T]) objectHandler(obj interface{}, req Request) error {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
 
 	unstructuredObj, ok := obj.(*unstructured.Unstructured)
 	if !ok {
@@ -203,9 +377,9 @@ func (c *Controller[T]) objectHandler(obj interface{}, item EventItem) error {
 		return nil
 	}
 
-	err = c.cb(context.Background(), c.informer, item, structuredObj)
+	err = c.cb(context.Background(), c.informer, req, structuredObj)
 	if err != nil {
-		return fmt.Errorf("error handling object with key '%s': %v", item.Key, err)
+		return fmt.Errorf("error handling object with key '%s': %w", req.Key, err)
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package k8s
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -83,10 +84,10 @@ func newController(resource config.Resource,
 	informer := k8sI.ForResource(gvr)
 	c := NewController[corev1.Pod](resource, func(ctx context.Context,
 		informer cache.SharedIndexInformer,
-		ev EventItem,
+		req Request,
 		obj corev1.Pod) error {
 		return nil
-	}, informer)
+	}, informer, ControllerOptions[corev1.Pod]{})
 
 	for _, d := range objects {
 		_ = informer.Informer().GetIndexer().Add(d)
@@ -95,8 +96,22 @@ func newController(resource config.Resource,
 	return c
 }
 
-func (f *fixture) runControllerSyncHandler(item EventItem, expectError bool) {
-	err := f.controller.syncHandler(item)
+// recordRequests replaces the handler of the controller with one that
+// records all requests it is called with.
+func (f *fixture) recordRequests() *[]Request {
+	var requests []Request
+	f.controller.cb = func(ctx context.Context,
+		informer cache.SharedIndexInformer,
+		req Request,
+		obj corev1.Pod) error {
+		requests = append(requests, req)
+		return nil
+	}
+	return &requests
+}
+
+func (f *fixture) runControllerSyncHandler(key string, expectError bool) {
+	err := f.controller.syncHandler(key)
 	if !expectError && err != nil {
 		f.t.Errorf("error syncing item: %v", err)
 	} else if expectError && err == nil {
@@ -118,38 +133,188 @@ func TestCreateDeployment(t *testing.T) {
 	d := newPod()
 	objects := []runtime.Object{newUnstructured(d)}
 	resource := newResource("")
-	item := EventItem{Key: getKey(d, t), ActionType: CreateAction}
 
 	f := newFixture(t, resource, objects)
-	f.runControllerSyncHandler(item, false)
+	requests := f.recordRequests()
+	f.runControllerSyncHandler(getKey(d, t), false)
+
+	if len(*requests) != 1 || (*requests)[0].Deleted {
+		t.Errorf("expected one reconcile of existing object, got %+v", *requests)
+	}
 }
 
 func TestUpdateDeployment(t *testing.T) {
 	d := newPod()
-	objects := []runtime.Object{newUnstructured(d)}
 	resource := newResource("")
-	item := EventItem{Key: getKey(d, t), ActionType: UpdateAction}
 
-	f := newFixture(t, resource, objects)
-	f.runControllerSyncHandler(item, false)
+	f := newFixture(t, resource, nil)
+	f.controller.enqueue(newUnstructured(d))
+	f.controller.enqueue(newUnstructured(d))
+	f.controller.enqueue(newUnstructured(d))
+
+	if f.controller.workqueue.Len() != 1 {
+		t.Errorf("expected burst of events to collapse into one item, got %d", f.controller.workqueue.Len())
+	}
 }
 
 func TestDeleteDeployment(t *testing.T) {
 	d := newPod()
-	objects := []runtime.Object{newUnstructured(d)}
 	resource := newResource("")
-	item := EventItem{Key: getKey(d, t), ActionType: DeleteAction}
 
-	f := newFixture(t, resource, objects)
-	f.runControllerSyncHandler(item, false)
+	f := newFixture(t, resource, nil)
+	requests := f.recordRequests()
+	f.controller.enqueueDelete(newUnstructured(d))
+
+	f.runControllerSyncHandler(getKey(d, t), false)
+	if len(*requests) != 1 || !(*requests)[0].Deleted {
+		t.Errorf("expected one reconcile of deleted object, got %+v", *requests)
+	}
+
+	// The last known state is dropped once the delete was reconciled
+	f.runControllerSyncHandler(getKey(d, t), false)
+	if len(*requests) != 1 {
+		t.Errorf("expected deleted object to be reconciled once, got %+v", *requests)
+	}
+}
+
+func TestDeleteTombstoneDeployment(t *testing.T) {
+	d := newPod()
+	resource := newResource("")
+
+	f := newFixture(t, resource, nil)
+	requests := f.recordRequests()
+
+	key := getKey(d, t)
+	f.controller.enqueueDelete(cache.DeletedFinalStateUnknown{Key: key, Obj: newUnstructured(d)})
+	if f.controller.workqueue.Len() != 1 {
+		t.Fatalf("expected delete to be queued, got %d items", f.controller.workqueue.Len())
+	}
+
+	f.runControllerSyncHandler(key, false)
+	if len(*requests) != 1 || !(*requests)[0].Deleted {
+		t.Errorf("expected one reconcile of deleted object, got %+v", *requests)
+	}
 }
 
 func TestSelectorQueryFilterDeployment(t *testing.T) {
 	d := newPod()
 	objects := []runtime.Object{newUnstructured(d)}
 	resource := newResource(".metadata.name != \"port-k8s-exporter\"")
-	item := EventItem{Key: getKey(d, t), ActionType: DeleteAction}
 
 	f := newFixture(t, resource, objects)
-	f.runControllerSyncHandler(item, false)
+	requests := f.recordRequests()
+	f.runControllerSyncHandler(getKey(d, t), false)
+
+	if len(*requests) != 1 {
+		t.Errorf("expected object to pass the selector, got %+v", *requests)
+	}
+}
+
+func TestSelectorQueryFilterOutDeployment(t *testing.T) {
+	d := newPod()
+	objects := []runtime.Object{newUnstructured(d)}
+	resource := newResource(".metadata.name == \"port-k8s-exporter\"")
+
+	f := newFixture(t, resource, objects)
+	requests := f.recordRequests()
+	f.runControllerSyncHandler(getKey(d, t), false)
+
+	if len(*requests) != 0 {
+		t.Errorf("expected object to be filtered by selector, got %+v", *requests)
+	}
+}
+
+func TestDeadLetterDeployment(t *testing.T) {
+	d := newPod()
+	objects := []runtime.Object{newUnstructured(d)}
+	resource := newResource("")
+
+	f := newFixture(t, resource, objects)
+	failing := true
+	f.controller.cb = func(ctx context.Context,
+		informer cache.SharedIndexInformer,
+		req Request,
+		obj corev1.Pod) error {
+		if failing {
+			return fmt.Errorf("tower unavailable")
+		}
+		return nil
+	}
+	var parked []string
+	f.controller.options.OnDeadLetter = func(obj corev1.Pod, err error) {
+		parked = append(parked, obj.Name)
+	}
+
+	key := getKey(d, t)
+	f.controller.workqueue.Add(key)
+	for i := 0; i <= MaxNumRequeues; i++ {
+		f.controller.processNextWorkItem()
+	}
+
+	if f.controller.workqueue.Len() != 0 {
+		t.Errorf("expected item to leave the workqueue, got %d items", f.controller.workqueue.Len())
+	}
+	deadLetters := f.controller.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Key != key {
+		t.Fatalf("expected %s in dead letters, got %+v", key, deadLetters)
+	}
+	if len(parked) != 1 || parked[0] != d.Name {
+		t.Errorf("expected dead letter handler to be called for %s, got %+v", d.Name, parked)
+	}
+
+	// A failed slow retry is parked again without another round of fast retries
+	f.controller.retryDeadLetters()
+	f.controller.processNextWorkItem()
+
+	if f.controller.workqueue.NumRequeues(key) != MaxNumRequeues {
+		t.Errorf("expected %d requeues to be kept, got %d", MaxNumRequeues, f.controller.workqueue.NumRequeues(key))
+	}
+	deadLetters = f.controller.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 2 {
+		t.Fatalf("expected %s to be parked again, got %+v", key, deadLetters)
+	}
+	if len(parked) != 1 {
+		t.Errorf("expected dead letter handler to be called once, got %+v", parked)
+	}
+
+	failing = false
+	f.controller.retryDeadLetters()
+	f.controller.processNextWorkItem()
+
+	if len(f.controller.DeadLetters()) != 0 {
+		t.Errorf("expected dead letter to be released, got %+v", f.controller.DeadLetters())
+	}
+	if f.controller.DeadLettersTotal() != 1 {
+		t.Errorf("expected 1 dead letter in total, got %d", f.controller.DeadLettersTotal())
+	}
+	if f.controller.workqueue.NumRequeues(key) != 0 {
+		t.Errorf("expected requeues to be forgotten, got %d", f.controller.workqueue.NumRequeues(key))
+	}
+}
+
+func TestRequeueAfterDeployment(t *testing.T) {
+	d := newPod()
+	objects := []runtime.Object{newUnstructured(d)}
+	resource := newResource("")
+
+	f := newFixture(t, resource, objects)
+	f.controller.cb = func(ctx context.Context,
+		informer cache.SharedIndexInformer,
+		req Request,
+		obj corev1.Pod) error {
+		return RequeueAfter(time.Hour, nil)
+	}
+
+	key := getKey(d, t)
+	for i := 0; i <= MaxNumRequeues; i++ {
+		f.controller.workqueue.Add(key)
+		f.controller.processNextWorkItem()
+	}
+
+	if f.controller.workqueue.NumRequeues(key) != 0 {
+		t.Errorf("expected scheduled reconcile not to count as failure, got %d requeues", f.controller.workqueue.NumRequeues(key))
+	}
+	if len(f.controller.DeadLetters()) != 0 {
+		t.Errorf("expected no dead letters, got %+v", f.controller.DeadLetters())
+	}
 }
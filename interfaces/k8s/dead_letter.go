@@ -0,0 +1,143 @@
+package k8s
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+)
+
+// DeadLetter is an item the controller gave up on after MaxNumRequeues. It
+// is retried on a slow timer until its reconciliation succeeds.
+type DeadLetter struct {
+	Resource    string    `json:"resource"`
+	Key         string    `json:"key"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	Since       time.Time `json:"since"`
+	LastAttempt time.Time `json:"lastAttempt"`
+}
+
+// DeadLetterSource is implemented by controllers that park items in a
+// dead-letter set.
+type DeadLetterSource interface {
+	Resource() string
+	DeadLetters() []DeadLetter
+	DeadLettersTotal() uint64
+}
+
+func (c *Controller[T]) Resource() string {
+	return c.resource.Kind
+}
+
+// DeadLetters returns the items whose reconciliation is paused, sorted by key.
+func (c *Controller[T]) DeadLetters() []DeadLetter {
+	c.deadLettersMu.Lock()
+	defer c.deadLettersMu.Unlock()
+
+	deadLetters := make([]DeadLetter, 0, len(c.deadLetters))
+	for _, deadLetter := range c.deadLetters {
+		deadLetters = append(deadLetters, *deadLetter)
+	}
+	slices.SortFunc(deadLetters, func(a, b DeadLetter) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return deadLetters
+}
+
+// DeadLettersTotal returns the number of items moved to the dead-letter set
+// since the controller started.
+func (c *Controller[T]) DeadLettersTotal() uint64 {
+	c.deadLettersMu.Lock()
+	defer c.deadLettersMu.Unlock()
+	return c.deadLettersTotal
+}
+
+// parkDeadLetter moves the key into the dead-letter set. The handler for
+// dead letters is only called when the key is parked for the first time.
+func (c *Controller[T]) parkDeadLetter(key string, err error) {
+	now := time.Now()
+
+	c.deadLettersMu.Lock()
+	deadLetter, exists := c.deadLetters[key]
+	if !exists {
+		deadLetter = &DeadLetter{
+			Resource: c.resource.Kind,
+			Key:      key,
+			Since:    now,
+		}
+		c.deadLetters[key] = deadLetter
+		c.deadLettersTotal++
+	}
+	deadLetter.Error = err.Error()
+	deadLetter.Attempts++
+	deadLetter.LastAttempt = now
+	c.deadLettersMu.Unlock()
+
+	if exists || c.options.OnDeadLetter == nil {
+		return
+	}
+
+	obj, ok := c.getObject(key)
+	if !ok {
+		return
+	}
+	c.options.OnDeadLetter(obj, err)
+}
+
+// releaseDeadLetter removes the key from the dead-letter set after it was
+// reconciled successfully.
+func (c *Controller[T]) releaseDeadLetter(key string) {
+	c.deadLettersMu.Lock()
+	_, exists := c.deadLetters[key]
+	delete(c.deadLetters, key)
+	c.deadLettersMu.Unlock()
+
+	if exists {
+		klog.Infof("Resumed reconciliation of '%s' of resource '%s'", key, c.resource.Kind)
+	}
+}
+
+// retryDeadLetters queues all dead letters for another attempt.
+func (c *Controller[T]) retryDeadLetters() {
+	c.deadLettersMu.Lock()
+	keys := make([]string, 0, len(c.deadLetters))
+	for key := range c.deadLetters {
+		keys = append(keys, key)
+	}
+	c.deadLettersMu.Unlock()
+
+	for _, key := range keys {
+		c.workqueue.Add(key)
+	}
+}
+
+// getObject returns the object of the key from the informer cache or the
+// last known state of a deleted object.
+func (c *Controller[T]) getObject(key string) (T, bool) {
+	var structuredObj T
+
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		obj, exists = c.getDeletedObject(key)
+		if !exists {
+			return structuredObj, false
+		}
+	}
+
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return structuredObj, false
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredObj.Object, &structuredObj)
+	if err != nil {
+		klog.Errorf("Error converting '%s' of resource '%s' from unstructured: %v", key, c.resource.Kind, err)
+		return structuredObj, false
+	}
+
+	return structuredObj, true
+}
@@ -0,0 +1,283 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// fairQueue is a rate limiting workqueue of object keys that hands out the
+// keys round-robin across namespaces, so a single namespace with many
+// objects can not delay the objects of all other namespaces. Each namespace
+// can additionally be limited to a rate of keys per second.
+//
+// Like the client-go workqueue, a key is never processed by several workers
+// at once and a key added while it is processed is queued again on Done.
+type fairQueue struct {
+	rateLimiter workqueue.TypedRateLimiter[string]
+	qps         rate.Limit
+	burst       int
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queues       map[string][]string
+	namespaces   []string
+	next         int
+	limiters     map[string]*rate.Limiter
+	waiting      map[string]*delayedAdd
+	dirty        map[string]bool
+	processing   map[string]bool
+	length       int
+	shuttingDown bool
+	drain        bool
+}
+
+var _ workqueue.TypedRateLimitingInterface[string] = &fairQueue{}
+
+// delayedAdd is the pending add of a key by AddAfter.
+type delayedAdd struct {
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// newFairQueue creates a fair queue. A qps of 0 disables the per-namespace
+// rate limits.
+func newFairQueue(rateLimiter workqueue.TypedRateLimiter[string], qps float64, burst int) *fairQueue {
+	if burst < 1 {
+		burst = 1
+	}
+	q := &fairQueue{
+		rateLimiter: rateLimiter,
+		qps:         rate.Limit(qps),
+		burst:       burst,
+		queues:      map[string][]string{},
+		limiters:    map[string]*rate.Limiter{},
+		waiting:     map[string]*delayedAdd{},
+		dirty:       map[string]bool{},
+		processing:  map[string]bool{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func namespaceOfKey(key string) string {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return ""
+	}
+	return namespace
+}
+
+func (q *fairQueue) Add(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.shuttingDown || q.dirty[key] {
+		return
+	}
+	q.dirty[key] = true
+	if q.processing[key] {
+		return
+	}
+	q.push(key)
+	q.cond.Signal()
+}
+
+func (q *fairQueue) push(key string) {
+	namespace := namespaceOfKey(key)
+	if len(q.queues[namespace]) == 0 {
+		q.namespaces = append(q.namespaces, namespace)
+	}
+	q.queues[namespace] = append(q.queues[namespace], key)
+	q.length++
+}
+
+func (q *fairQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length
+}
+
+// Get blocks until a key of a namespace within its rate limit is available
+// or the queue is shut down.
+func (q *fairQueue) Get() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.shuttingDown && (!q.drain || q.length == 0) {
+			return "", true
+		}
+
+		if q.length == 0 {
+			q.cond.Wait()
+			continue
+		}
+
+		key, wait := q.pop()
+		if wait == 0 {
+			return key, false
+		}
+
+		// All namespaces with queued keys exceeded their rate limit
+		timer := time.AfterFunc(wait, func() {
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		})
+		q.cond.Wait()
+		timer.Stop()
+	}
+}
+
+// pop takes the next key round-robin from the namespaces that are within
+// their rate limit. If there is none, it returns the time to wait for.
+func (q *fairQueue) pop() (string, time.Duration) {
+	now := time.Now()
+	var wait time.Duration
+
+	for i := 0; i < len(q.namespaces); i++ {
+		index := (q.next + i) % len(q.namespaces)
+		namespace := q.namespaces[index]
+
+		if q.qps > 0 {
+			limiter, ok := q.limiters[namespace]
+			if !ok {
+				limiter = rate.NewLimiter(q.qps, q.burst)
+				q.limiters[namespace] = limiter
+			}
+			if !limiter.AllowN(now, 1) {
+				delay := time.Duration((1 - limiter.TokensAt(now)) / float64(q.qps) * float64(time.Second))
+				if wait == 0 || delay < wait {
+					wait = delay
+				}
+				continue
+			}
+		}
+
+		key := q.queues[namespace][0]
+		q.queues[namespace] = q.queues[namespace][1:]
+		q.length--
+		if len(q.queues[namespace]) == 0 {
+			delete(q.queues, namespace)
+			q.namespaces = append(q.namespaces[:index], q.namespaces[index+1:]...)
+			q.next = index
+		} else {
+			q.next = index + 1
+		}
+		if q.next >= len(q.namespaces) {
+			q.next = 0
+		}
+
+		delete(q.dirty, key)
+		q.processing[key] = true
+		q.pruneLimiters(now)
+		return key, 0
+	}
+
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return "", wait
+}
+
+// pruneLimiters evicts the limiters of namespaces without queued keys. A
+// limiter is only evicted once it is full again, so emptying the queue does
+// not reset the rate limit of a namespace.
+func (q *fairQueue) pruneLimiters(now time.Time) {
+	for namespace, limiter := range q.limiters {
+		if len(q.queues[namespace]) == 0 && limiter.TokensAt(now) >= float64(q.burst) {
+			delete(q.limiters, namespace)
+		}
+	}
+}
+
+func (q *fairQueue) Done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.processing, key)
+	if q.dirty[key] {
+		q.push(key)
+		q.cond.Signal()
+	} else if len(q.processing) == 0 {
+		// Wake up a draining ShutDown
+		q.cond.Broadcast()
+	}
+}
+
+func (q *fairQueue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShutDownWithDrain shuts down the queue once all queued keys were
+// processed.
+func (q *fairQueue) ShutDownWithDrain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shuttingDown = true
+	q.drain = true
+	q.cond.Broadcast()
+	for q.length > 0 || len(q.processing) > 0 {
+		q.cond.Wait()
+	}
+}
+
+func (q *fairQueue) ShuttingDown() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.shuttingDown
+}
+
+// AddAfter adds the key once the duration passed. Like the client-go
+// delaying queue, only the earliest pending add of a key is kept.
+func (q *fairQueue) AddAfter(key string, duration time.Duration) {
+	if q.ShuttingDown() {
+		return
+	}
+	if duration <= 0 {
+		q.Add(key)
+		return
+	}
+
+	deadline := time.Now().Add(duration)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if pending, ok := q.waiting[key]; ok {
+		if !deadline.Before(pending.deadline) {
+			return
+		}
+		pending.timer.Stop()
+	}
+
+	pending := &delayedAdd{deadline: deadline}
+	pending.timer = time.AfterFunc(duration, func() {
+		q.mu.Lock()
+		if q.waiting[key] == pending {
+			delete(q.waiting, key)
+		}
+		q.mu.Unlock()
+		q.Add(key)
+	})
+	q.waiting[key] = pending
+}
+
+func (q *fairQueue) AddRateLimited(key string) {
+	q.AddAfter(key, q.rateLimiter.When(key))
+}
+
+func (q *fairQueue) Forget(key string) {
+	q.rateLimiter.Forget(key)
+}
+
+func (q *fairQueue) NumRequeues(key string) int {
+	return q.rateLimiter.NumRequeues(key)
+}
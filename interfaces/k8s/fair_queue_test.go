@@ -0,0 +1,140 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newTestFairQueue(qps float64, burst int) *fairQueue {
+	return newFairQueue(workqueue.DefaultTypedControllerRateLimiter[string](), qps, burst)
+}
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	q := newTestFairQueue(0, 0)
+	for _, key := range []string{"noisy/a", "noisy/b", "noisy/c", "quiet/a", "other/a"} {
+		q.Add(key)
+	}
+
+	var got []string
+	for q.Len() > 0 {
+		key, shutdown := q.Get()
+		if shutdown {
+			t.Fatal("unexpected shutdown")
+		}
+		got = append(got, key)
+		q.Done(key)
+	}
+
+	expected := []string{"noisy/a", "quiet/a", "other/a", "noisy/b", "noisy/c"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected order %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestFairQueueDedupesWhileProcessing(t *testing.T) {
+	q := newTestFairQueue(0, 0)
+	q.Add("ns/a")
+	q.Add("ns/a")
+	if q.Len() != 1 {
+		t.Fatalf("expected 1 queued key, got %d", q.Len())
+	}
+
+	key, _ := q.Get()
+	q.Add(key)
+	if q.Len() != 0 {
+		t.Fatalf("expected key in processing not to be queued, got %d", q.Len())
+	}
+
+	q.Done(key)
+	if q.Len() != 1 {
+		t.Fatalf("expected key added while processing to be queued on done, got %d", q.Len())
+	}
+}
+
+func TestFairQueueNamespaceRateLimit(t *testing.T) {
+	q := newTestFairQueue(20, 1)
+	q.Add("noisy/a")
+	q.Add("noisy/b")
+	q.Add("quiet/a")
+
+	first, _ := q.Get()
+	q.Done(first)
+	second, _ := q.Get()
+	q.Done(second)
+	if first != "noisy/a" || second != "quiet/a" {
+		t.Fatalf("expected noisy/a and quiet/a first, got %s and %s", first, second)
+	}
+
+	start := time.Now()
+	third, _ := q.Get()
+	q.Done(third)
+	if third != "noisy/b" {
+		t.Fatalf("expected noisy/b, got %s", third)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("expected noisy namespace to be rate limited, waited %s", waited)
+	}
+}
+
+func TestFairQueuePrunesLimiters(t *testing.T) {
+	q := newTestFairQueue(100, 1)
+	q.Add("first/a")
+	key, _ := q.Get()
+	q.Done(key)
+	if _, ok := q.limiters["first"]; !ok {
+		t.Fatal("expected the limiter to be kept until it is full again")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	q.Add("second/a")
+	key, _ = q.Get()
+	q.Done(key)
+	if _, ok := q.limiters["first"]; ok {
+		t.Error("expected the limiter of the empty namespace to be evicted")
+	}
+	if _, ok := q.limiters["second"]; !ok {
+		t.Error("expected the limiter of the second namespace to be kept")
+	}
+}
+
+func TestFairQueueKeepsEarliestDelayedAdd(t *testing.T) {
+	q := newTestFairQueue(0, 0)
+	q.AddAfter("ns/a", time.Hour)
+	q.AddAfter("ns/a", 10*time.Millisecond)
+	q.AddAfter("ns/a", time.Hour)
+
+	q.mu.Lock()
+	waiting := len(q.waiting)
+	deadline := q.waiting["ns/a"].deadline
+	q.mu.Unlock()
+	if waiting != 1 || time.Until(deadline) > time.Second {
+		t.Fatalf("expected only the earliest add to be pending, got %d until %s", waiting, deadline)
+	}
+
+	key, _ := q.Get()
+	q.Done(key)
+	if key != "ns/a" {
+		t.Fatalf("expected ns/a, got %s", key)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) != 0 {
+		t.Errorf("expected no pending adds, got %d", len(q.waiting))
+	}
+}
+
+func TestFairQueueShutDown(t *testing.T) {
+	q := newTestFairQueue(0, 0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.ShutDown()
+	}()
+
+	if _, shutdown := q.Get(); !shutdown {
+		t.Error("expected shutdown")
+	}
+}
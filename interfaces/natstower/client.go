@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"k8s.io/klog/v2"
@@ -40,9 +42,10 @@ func CreateNATSTowerClient(ctx context.Context,
 }
 
 type ConnectionInfo struct {
-	Creds       string
-	URLs        string
-	AccountName string
+	Creds            string
+	URLs             string
+	AccountName      string
+	AccountPublicKey string
 }
 
 type listResponse[T listItems] struct {
@@ -70,10 +73,20 @@ type account struct {
 }
 
 type user struct {
-	ID    string `json:"id"`
-	Creds string `json:"creds"`
+	ID                     string   `json:"id"`
+	Creds                  string   `json:"creds"`
+	MaxSubscriptions       *int64   `json:"max_subscriptions"`
+	MaxPayload             *int64   `json:"max_payload"`
+	MaxData                *int64   `json:"max_data"`
+	AllowedConnectionTypes []string `json:"allowed_connection_types"`
+	Expires                string   `json:"expires"`
+	SigningKey             string   `json:"signing_key"`
+	Description            string   `json:"description"`
 }
 
+// userFields are the fields of users read from NATS Tower
+const userFields = "creds,id,max_subscriptions,max_payload,max_data,allowed_connection_types,expires,signing_key,description"
+
 type role struct {
 	ID   string `json:"id"`
 	Role string `json:"role"`
@@ -81,16 +94,115 @@ type role struct {
 
 // UserOptions holds the optional role assignment for a generated user.
 type UserOptions struct {
-	// Role is the name of the NATS Tower role to bind the user to.
-	// When empty, the user gets the full permissions of the account.
+	// Role is the name of the NATS Tower role to bind the user to. Existing
+	// users bound to another role are re-bound. When empty, the user gets the
+	// full permissions of the account.
 	Role string
 	// Publish and Subscribe are the permissions used to create the role
 	// if it does not exist yet on NATS Tower.
 	Publish   []string
 	Subscribe []string
+	// PublishDeny and SubscribeDeny are denied even if allowed above.
+	PublishDeny   []string
+	SubscribeDeny []string
+	// QueueSubscribe allows subscribing to a subject only in a queue group.
+	QueueSubscribe []QueueSubscription
+	// AllowResponses lets the role publish replies to the requests it
+	// received. When nil, responses need explicit publish permissions.
+	AllowResponses *ResponsePermission
+	// Expires limits the validity of the JWT of a newly created user.
+	// When zero, the JWT does not expire.
+	Expires time.Time
+	// RenewBefore re-issues the JWT of an existing user with Expires once it
+	// expires within this duration. When zero, the JWT is never renewed.
+	RenewBefore time.Duration
+	// AllowedConnectionTypes restricts how the user may connect, e.g.
+	// LEAFNODE. Existing users are restricted to match. When empty, all
+	// connection types are allowed and existing users are left unchanged
+	// unless Limits are set.
+	AllowedConnectionTypes []string
+	// BearerToken creates a user whose JWT can be used without the nkey seed.
+	BearerToken bool
+	// Limits are the connection limits of the user. When set, the limits and
+	// the allowed connection types of an existing user are updated to match.
+	// When nil, new users get the defaults of NATS Tower and existing users
+	// are left unchanged.
+	Limits *UserLimits
+}
+
+// QueueSubscription is a subscribe permission limited to a queue group.
+type QueueSubscription struct {
+	Subject string
+	Queue   string
+}
+
+// ResponsePermission limits the replies a role may publish.
+type ResponsePermission struct {
+	// MaxMsgs is the number of replies per request, NoLimit if unlimited.
+	MaxMsgs int
+	// TTL is how long replies are allowed, zero if unlimited.
+	TTL time.Duration
+}
+
+// NoLimit disables a limit of a user.
+const NoLimit int64 = -1
+
+// UserLimits are the connection limits of a user, NoLimit if unlimited.
+type UserLimits struct {
+	MaxSubscriptions int64
+	MaxPayload       int64
+	MaxData          int64
+}
+
+// hasLimits reports whether the user on NATS Tower matches the limits and
+// allowed connection types of the options. Missing limits are unlimited.
+func (u *user) hasLimits(opts UserOptions) bool {
+	limit := func(value *int64) int64 {
+		if value == nil {
+			return NoLimit
+		}
+		return *value
+	}
+	return limit(u.MaxSubscriptions) == opts.Limits.MaxSubscriptions &&
+		limit(u.MaxPayload) == opts.Limits.MaxPayload &&
+		limit(u.MaxData) == opts.Limits.MaxData &&
+		u.hasConnectionTypes(opts.AllowedConnectionTypes)
+}
+
+// hasConnectionTypes reports whether the user on NATS Tower is allowed the
+// same connection types, in any order.
+func (u *user) hasConnectionTypes(connectionTypes []string) bool {
+	return slices.Equal(slices.Sorted(slices.Values(u.AllowedConnectionTypes)),
+		slices.Sorted(slices.Values(connectionTypes)))
+}
+
+// expiresWithin reports whether the JWT of the user expires within the
+// duration. Users without an expiry are treated as expired, so they get one.
+// userOwner is the end of the description of users created for a namespace.
+// Users are looked up by account and name only, so it tells apart the users of
+// equally named secrets in other namespaces.
+func userOwner(clusterID, namespace string) string {
+	return fmt.Sprintf("in namespace '%s' on cluster '%s'", namespace, clusterID)
 }
 
+// ownedBy reports whether the user was created for the namespace.
+func (u *user) ownedBy(clusterID, namespace string) bool {
+	return strings.HasSuffix(u.Description, userOwner(clusterID, namespace))
+}
+
+func (u *user) expiresWithin(d time.Duration) bool {
+	expires, err := time.Parse(dateTimeLayout, u.Expires)
+	if err != nil {
+		return true
+	}
+	return time.Until(expires) < d
+}
+
+// dateTimeLayout is the format of date fields on NATS Tower
+const dateTimeLayout = "2006-01-02 15:04:05.000Z"
+
 type k8sAccess struct {
+	ID string `json:"id"`
 }
 
 func (c *NATSTowerClient) doJSONRequest(ctx context.Context,
@@ -129,8 +241,10 @@ var (
 	ErrAccountNotFound     = fmt.Errorf("account not found")
 	ErrAccountTierNotFound = fmt.Errorf("account tier not found")
 	ErrUserNotFound        = fmt.Errorf("user not found")
+	ErrUserNotOwned        = fmt.Errorf("user belongs to another namespace")
 	ErrRoleNotFound        = fmt.Errorf("role not found")
 	ErrK8sAccessNotAllowed = fmt.Errorf("k8s access not allowed")
+	ErrK8sAccessNotFound   = fmt.Errorf("k8s access not found")
 )
 
 func (c *NATSTowerClient) getOperator(ctx context.Context,
@@ -199,7 +313,7 @@ func (c *NATSTowerClient) getUser(ctx context.Context,
 	q := req.URL.Query()
 	q.Add("filter", fmt.Sprintf("(account='%s' && name='%s')", accountID, username))
 	q.Add("perPage", "1")
-	q.Add("fields", "creds,id")
+	q.Add("fields", userFields)
 	req.URL.RawQuery = q.Encode()
 
 	var resp listResponse[user]
@@ -217,18 +331,35 @@ func (c *NATSTowerClient) getUser(ctx context.Context,
 }
 
 func (c *NATSTowerClient) createUser(ctx context.Context,
-	accountID, username, description, signingKeyID string) (*user, error) {
+	accountID, username, description, signingKeyID string,
+	opts UserOptions) (*user, error) {
 
 	body := struct {
-		Account     string `json:"account"`
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		SigningKey  string `json:"signing_key,omitempty"`
+		Account                string   `json:"account"`
+		Name                   string   `json:"name"`
+		Description            string   `json:"description"`
+		SigningKey             string   `json:"signing_key,omitempty"`
+		Expires                string   `json:"expires,omitempty"`
+		AllowedConnectionTypes []string `json:"allowed_connection_types,omitempty"`
+		BearerToken            bool     `json:"bearer_token,omitempty"`
+		MaxSubscriptions       *int64   `json:"max_subscriptions,omitempty"`
+		MaxPayload             *int64   `json:"max_payload,omitempty"`
+		MaxData                *int64   `json:"max_data,omitempty"`
 	}{
-		Account:     accountID,
-		Name:        username,
-		Description: description,
-		SigningKey:  signingKeyID,
+		Account:                accountID,
+		Name:                   username,
+		Description:            description,
+		SigningKey:             signingKeyID,
+		AllowedConnectionTypes: opts.AllowedConnectionTypes,
+		BearerToken:            opts.BearerToken,
+	}
+	if !opts.Expires.IsZero() {
+		body.Expires = opts.Expires.UTC().Format(dateTimeLayout)
+	}
+	if opts.Limits != nil {
+		body.MaxSubscriptions = &opts.Limits.MaxSubscriptions
+		body.MaxPayload = &opts.Limits.MaxPayload
+		body.MaxData = &opts.Limits.MaxData
 	}
 
 	payload, err := json.Marshal(body)
@@ -245,7 +376,41 @@ func (c *NATSTowerClient) createUser(ctx context.Context,
 	}
 
 	q := req.URL.Query()
-	q.Add("fields", "creds,id")
+	q.Add("fields", userFields)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp user
+
+	err = c.doJSONRequest(ctx, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// patchUser updates the fields of the body on the user. NATS Tower re-issues
+// the JWT of the user with the changed fields.
+func (c *NATSTowerClient) patchUser(ctx context.Context,
+	userID string,
+	body any) (*user, error) {
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx,
+		"PATCH",
+		c.cfg.NATSTowerURL+"/api/collections/nats_auth_users/records/"+userID,
+		bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	q := req.URL.Query()
+	q.Add("fields", userFields)
 	req.URL.RawQuery = q.Encode()
 	req.Header.Set("Content-Type", "application/json")
 
@@ -259,6 +424,30 @@ func (c *NATSTowerClient) createUser(ctx context.Context,
 	return &resp, nil
 }
 
+// hasRoleUsers reports whether any user is bound to the role.
+func (c *NATSTowerClient) hasRoleUsers(ctx context.Context,
+	roleID string) (bool, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.cfg.NATSTowerURL+"/api/collections/nats_auth_users/records", nil)
+	if err != nil {
+		return false, err
+	}
+	q := req.URL.Query()
+	q.Add("filter", fmt.Sprintf("(signing_key='%s')", roleID))
+	q.Add("perPage", "1")
+	q.Add("fields", "id")
+	req.URL.RawQuery = q.Encode()
+
+	var resp listResponse[user]
+
+	err = c.doJSONRequest(ctx, req, &resp)
+	if err != nil {
+		return false, err
+	}
+
+	return len(resp.Items) > 0, nil
+}
+
 func (c *NATSTowerClient) getRole(ctx context.Context,
 	accountID, roleName string) (*role, error) {
 
@@ -287,25 +476,41 @@ func (c *NATSTowerClient) getRole(ctx context.Context,
 }
 
 func (c *NATSTowerClient) createRole(ctx context.Context,
-	accountID, roleName string, publish, subscribe []string) (*role, error) {
+	accountID string, opts UserOptions) (*role, error) {
 
-	if publish == nil {
-		publish = []string{}
+	publish := append([]string{}, opts.Publish...)
+	subscribe := append([]string{}, opts.Subscribe...)
+	for _, queueSubscription := range opts.QueueSubscribe {
+		// NATS permissions qualify the subject with the queue group
+		subscribe = append(subscribe, queueSubscription.Subject+" "+queueSubscription.Queue)
 	}
-	if subscribe == nil {
-		subscribe = []string{}
+
+	type responsePermission struct {
+		Max int    `json:"max"`
+		TTL string `json:"ttl,omitempty"`
 	}
 
 	body := struct {
-		Account   string   `json:"account"`
-		Role      string   `json:"role"`
-		Publish   []string `json:"publish"`
-		Subscribe []string `json:"subscribe"`
+		Account        string              `json:"account"`
+		Role           string              `json:"role"`
+		Publish        []string            `json:"publish"`
+		Subscribe      []string            `json:"subscribe"`
+		PublishDeny    []string            `json:"publish_deny,omitempty"`
+		SubscribeDeny  []string            `json:"subscribe_deny,omitempty"`
+		AllowResponses *responsePermission `json:"allow_responses,omitempty"`
 	}{
-		Account:   accountID,
-		Role:      roleName,
-		Publish:   publish,
-		Subscribe: subscribe,
+		Account:       accountID,
+		Role:          opts.Role,
+		Publish:       publish,
+		Subscribe:     subscribe,
+		PublishDeny:   opts.PublishDeny,
+		SubscribeDeny: opts.SubscribeDeny,
+	}
+	if opts.AllowResponses != nil {
+		body.AllowResponses = &responsePermission{Max: opts.AllowResponses.MaxMsgs}
+		if opts.AllowResponses.TTL > 0 {
+			body.AllowResponses.TTL = opts.AllowResponses.TTL.String()
+		}
 	}
 
 	payload, err := json.Marshal(body)
@@ -346,7 +551,7 @@ func (c *NATSTowerClient) createOrGetRole(ctx context.Context,
 		return nil, err
 	}
 	if err == ErrRoleNotFound {
-		role, err = c.createRole(ctx, accountID, opts.Role, opts.Publish, opts.Subscribe)
+		role, err = c.createRole(ctx, accountID, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -396,17 +601,91 @@ func (c *NATSTowerClient) CreateOrGetUserAuth(ctx context.Context,
 			signingKeyID = role.ID
 		}
 
-		// Create new user
-		user, err = c.createUser(ctx, account.ID, name, description, signingKeyID)
+		// Create new user, recording the namespace it belongs to
+		owner := userOwner(c.cfg.ClusterID, namespace)
+		if !strings.HasSuffix(description, owner) {
+			description = strings.TrimSpace(description + " " + owner)
+		}
+		user, err = c.createUser(ctx, account.ID, name, description, signingKeyID, opts)
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		if !user.ownedBy(c.cfg.ClusterID, namespace) {
+			// Neither hand out nor change the user of another namespace
+			return nil, ErrUserNotOwned
+		}
+		var signingKeyID string
+		if opts.Role != "" {
+			role, err := c.createOrGetRole(ctx, account.ID, opts)
+			if err != nil {
+				return nil, err
+			}
+			signingKeyID = role.ID
+		}
+		if user.SigningKey != signingKeyID {
+			// The JWT is re-issued with the permissions of the other role, or
+			// without a role if the signing key is empty
+			user, err = c.patchUser(ctx, user.ID, struct {
+				SigningKey string `json:"signing_key"`
+			}{
+				SigningKey: signingKeyID,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if opts.Limits != nil && !user.hasLimits(opts) {
+			allowedConnectionTypes := opts.AllowedConnectionTypes
+			if allowedConnectionTypes == nil {
+				allowedConnectionTypes = []string{}
+			}
+			// The JWT is re-issued with the changed limits
+			user, err = c.patchUser(ctx, user.ID, struct {
+				AllowedConnectionTypes []string `json:"allowed_connection_types"`
+				MaxSubscriptions       int64    `json:"max_subscriptions"`
+				MaxPayload             int64    `json:"max_payload"`
+				MaxData                int64    `json:"max_data"`
+			}{
+				AllowedConnectionTypes: allowedConnectionTypes,
+				MaxSubscriptions:       opts.Limits.MaxSubscriptions,
+				MaxPayload:             opts.Limits.MaxPayload,
+				MaxData:                opts.Limits.MaxData,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if opts.Limits == nil && len(opts.AllowedConnectionTypes) > 0 &&
+			!user.hasConnectionTypes(opts.AllowedConnectionTypes) {
+			// The JWT is re-issued with the restricted connection types
+			user, err = c.patchUser(ctx, user.ID, struct {
+				AllowedConnectionTypes []string `json:"allowed_connection_types"`
+			}{
+				AllowedConnectionTypes: opts.AllowedConnectionTypes,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if opts.RenewBefore > 0 && !opts.Expires.IsZero() && user.expiresWithin(opts.RenewBefore) {
+			// The JWT is re-issued with the new expiry
+			user, err = c.patchUser(ctx, user.ID, struct {
+				Expires string `json:"expires"`
+			}{
+				Expires: opts.Expires.UTC().Format(dateTimeLayout),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return &ConnectionInfo{
-		Creds:       user.Creds,
-		URLs:        operator.URLs,
-		AccountName: account.Name,
+		Creds:            user.Creds,
+		URLs:             operator.URLs,
+		AccountName:      account.Name,
+		AccountPublicKey: account.PublicKey,
 	}, nil
 }
 
@@ -447,10 +726,69 @@ func (c *NATSTowerClient) RemoveUserAuth(ctx context.Context,
 	if err != nil {
 		return err
 	}
+	if !user.ownedBy(c.cfg.ClusterID, namespace) {
+		return ErrUserNotOwned
+	}
+
+	return c.deleteRecord(ctx, "nats_auth_users", user.ID)
+}
+
+// RemoveUnusedRole removes a role from NATS Tower once no user is bound to it
+// anymore. Roles that are gone are not treated as an error.
+func (c *NATSTowerClient) RemoveUnusedRole(ctx context.Context,
+	namespace,
+	installationPublicKey,
+	accountName,
+	roleName string) error {
+
+	operator, err := c.getOperator(ctx, installationPublicKey)
+	if err != nil {
+		if err == ErrOperatorNotFound {
+			return nil
+		}
+		return err
+	}
+
+	account, err := c.getAccount(ctx, operator.ID, accountName)
+	if ErrAccountNotFound == err {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	allowed, err := c.accessAllowed(ctx, c.cfg.ClusterID, namespace, account.ID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrK8sAccessNotAllowed
+	}
+
+	role, err := c.getRole(ctx, account.ID, roleName)
+	if ErrRoleNotFound == err {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	used, err := c.hasRoleUsers(ctx, role.ID)
+	if err != nil || used {
+		return err
+	}
+
+	return c.deleteRecord(ctx, "nats_auth_signing_keys", role.ID)
+}
+
+// deleteRecord deletes a record of the given collection. Records that are
+// already gone are not treated as an error.
+func (c *NATSTowerClient) deleteRecord(ctx context.Context,
+	collection, id string) error {
 
 	req, err := http.NewRequestWithContext(ctx,
 		"DELETE",
-		c.cfg.NATSTowerURL+"/api/collections/nats_auth_users/records/"+user.ID,
+		c.cfg.NATSTowerURL+"/api/collections/"+collection+"/records/"+id,
 		nil)
 	if err != nil {
 		return err
@@ -472,29 +810,171 @@ func (c *NATSTowerClient) RemoveUserAuth(ctx context.Context,
 }
 
 func (c *NATSTowerClient) accessAllowed(ctx context.Context, clusterID, namespace, accountID string) (bool, error) {
+	_, err := c.getK8sAccess(ctx, clusterID, namespace, accountID)
+	if err == ErrK8sAccessNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c *NATSTowerClient) getK8sAccess(ctx context.Context,
+	clusterID, namespace, accountID string) (*k8sAccess, error) {
+
 	req, err := http.NewRequestWithContext(ctx,
 		"GET",
 		c.cfg.NATSTowerURL+"/api/collections/nats_auth_k8s_access/records",
 		nil)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	q := req.URL.Query()
 	q.Add("filter", fmt.Sprintf("(cluster='%s' && namespace='%s' && account='%s')", clusterID, namespace, accountID))
 	q.Add("perPage", "1")
+	q.Add("fields", "id")
 	req.URL.RawQuery = q.Encode()
 
 	var resp listResponse[k8sAccess]
 
 	err = c.doJSONRequest(ctx, req, &resp)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	if len(resp.Items) == 0 {
+		return nil, ErrK8sAccessNotFound
+	}
+
+	return &resp.Items[0], nil
+}
+
+func (c *NATSTowerClient) createK8sAccess(ctx context.Context,
+	clusterID, namespace, accountID string) (*k8sAccess, error) {
+
+	body := struct {
+		Cluster   string `json:"cluster"`
+		Namespace string `json:"namespace"`
+		Account   string `json:"account"`
+	}{
+		Cluster:   clusterID,
+		Namespace: namespace,
+		Account:   accountID,
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx,
+		"POST",
+		c.cfg.NATSTowerURL+"/api/collections/nats_auth_k8s_access/records",
+		bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	q := req.URL.Query()
+	q.Add("fields", "id")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp k8sAccess
+
+	err = c.doJSONRequest(ctx, req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// HasK8sAccess reports whether the namespace of this cluster is on the k8s
+// access list of the account.
+func (c *NATSTowerClient) HasK8sAccess(ctx context.Context,
+	namespace,
+	installationPublicKey,
+	accountName string) (bool, error) {
+
+	operator, err := c.getOperator(ctx, installationPublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	account, err := c.getAccount(ctx, operator.ID, accountName)
+	if err != nil {
+		return false, err
+	}
+
+	return c.accessAllowed(ctx, c.cfg.ClusterID, namespace, account.ID)
+}
+
+// GrantK8sAccess adds the namespace of this cluster to the k8s access list of
+// the account. It reports whether a new access record was created.
+func (c *NATSTowerClient) GrantK8sAccess(ctx context.Context,
+	namespace,
+	installationPublicKey,
+	accountName string) (bool, error) {
+
+	operator, err := c.getOperator(ctx, installationPublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	account, err := c.getAccount(ctx, operator.ID, accountName)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.getK8sAccess(ctx, c.cfg.ClusterID, namespace, account.ID)
+	if err == nil {
 		return false, nil
 	}
+	if err != ErrK8sAccessNotFound {
+		return false, err
+	}
+
+	_, err = c.createK8sAccess(ctx, c.cfg.ClusterID, namespace, account.ID)
+	if err != nil {
+		return false, err
+	}
 
 	return true, nil
+}
+
+// RevokeK8sAccess removes the namespace of this cluster from the k8s access
+// list of the account. Missing operators, accounts or records are ignored.
+func (c *NATSTowerClient) RevokeK8sAccess(ctx context.Context,
+	namespace,
+	installationPublicKey,
+	accountName string) error {
+
+	operator, err := c.getOperator(ctx, installationPublicKey)
+	if err != nil {
+		if err == ErrOperatorNotFound {
+			return nil
+		}
+		return err
+	}
+
+	account, err := c.getAccount(ctx, operator.ID, accountName)
+	if ErrAccountNotFound == err {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	access, err := c.getK8sAccess(ctx, c.cfg.ClusterID, namespace, account.ID)
+	if ErrK8sAccessNotFound == err {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
+	return c.deleteRecord(ctx, "nats_auth_k8s_access", access.ID)
 }
@@ -37,3 +37,18 @@ func TestNATSTowerClient(t *testing.T) {
 		t.Fatalf("error removing user auth: %v", err)
 	}
 }
+
+func TestUserHasConnectionTypes(t *testing.T) {
+	u := &user{AllowedConnectionTypes: []string{"WEBSOCKET", "STANDARD"}}
+	if !u.hasConnectionTypes([]string{"STANDARD", "WEBSOCKET"}) {
+		t.Error("expected the connection types to match in any order")
+	}
+	if u.hasConnectionTypes([]string{"STANDARD"}) {
+		t.Error("expected different connection types not to match")
+	}
+
+	limits := &UserLimits{MaxSubscriptions: NoLimit, MaxPayload: NoLimit, MaxData: NoLimit}
+	if !u.hasLimits(UserOptions{Limits: limits, AllowedConnectionTypes: []string{"STANDARD", "WEBSOCKET"}}) {
+		t.Error("expected the limits to match with the connection types in another order")
+	}
+}
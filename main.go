@@ -8,6 +8,7 @@ import (
 
 	"github.com/nats-tower/nats-tower-operator/application"
 	"github.com/nats-tower/nats-tower-operator/config"
+	"github.com/nats-tower/nats-tower-operator/interfaces/admin"
 	"github.com/nats-tower/nats-tower-operator/interfaces/k8s"
 	"github.com/nats-tower/nats-tower-operator/interfaces/natstower"
 	"github.com/nats-tower/nats-tower-operator/utils"
@@ -50,13 +51,16 @@ func main() {
 		klog.Fatalf("Error creating NATSTowerClient: %s", err.Error())
 	}
 
-	klog.Infof("Valid NATS installations: %+v", cfg.ValidInstallations)
+	klog.Infof("Valid NATS installations: %+v", cfg.InstallationKeys())
 	klog.Info("Starting NATS Tower Operator")
 
 	operator, err := application.CreateNATSTowerOperator(cfg, k8sClient, natsTowerClient)
 	if err != nil {
 		klog.Fatalf("Error CreateNATSTowerOperator: %s", err.Error())
 	}
+	if cfg.AdminAddress != "" || cfg.HealthAddress != "" {
+		go admin.NewServer(cfg.AdminAddress, cfg.HealthAddress, operator.DeadLetterSources()...).Run(stopCh)
+	}
 	operator.Handle(stopCh)
 	klog.Info("Started NATS Tower Operator")
 }
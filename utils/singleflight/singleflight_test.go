@@ -0,0 +1,79 @@
+package singleflight
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoCoalescesConcurrentCalls(t *testing.T) {
+	var g Group[string]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, _ = g.Do("ns/secret", func() (string, error) {
+			calls.Add(1)
+			close(started)
+			<-release
+			return "creds", nil
+		})
+	}()
+	<-started
+
+	var joining sync.WaitGroup
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		joining.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			joining.Done()
+			var shared bool
+			results[i], _, shared = g.Do("ns/secret", func() (string, error) {
+				calls.Add(1)
+				return "other", nil
+			})
+			if !shared {
+				t.Errorf("expected caller %d to share the running call", i)
+			}
+		}(i)
+	}
+
+	// Give the started followers time to join the call before releasing it
+	joining.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call, got %d", calls.Load())
+	}
+	for i, result := range results {
+		if result != "creds" {
+			t.Errorf("expected caller %d to get 'creds', got '%s'", i, result)
+		}
+	}
+}
+
+func TestDoRunsAgainAfterCompletion(t *testing.T) {
+	var g Group[int]
+	calls := 0
+	for i := 0; i < 2; i++ {
+		_, _, shared := g.Do("ns/secret", func() (int, error) {
+			calls++
+			return calls, nil
+		})
+		if shared {
+			t.Errorf("expected sequential calls not to be shared")
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
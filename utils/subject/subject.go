@@ -0,0 +1,109 @@
+// Package subject implements checks of NATS subjects and their wildcards.
+// It has no dependencies on the operator, so the same validation can be used
+// by admission webhooks or command line tools.
+package subject
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// TokenSeparator separates the tokens of a subject
+	TokenSeparator = "."
+	// SingleWildcard matches exactly one token
+	SingleWildcard = "*"
+	// FullWildcard matches one or more trailing tokens
+	FullWildcard = ">"
+)
+
+// IsSubsetOf reports whether every subject matched by subject is also matched
+// by pattern. Both may contain wildcards, e.g. "orders.*.created" is a
+// subset of "orders.>", but "orders.>" is not a subset of "orders.*".
+func IsSubsetOf(subject, pattern string) bool {
+	subjectTokens := strings.Split(subject, TokenSeparator)
+	patternTokens := strings.Split(pattern, TokenSeparator)
+
+	for i, patternToken := range patternTokens {
+		if patternToken == FullWildcard {
+			// Matches the remaining tokens, of which there must be at least one
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		subjectToken := subjectTokens[i]
+		switch {
+		case subjectToken == FullWildcard:
+			// Only a full wildcard covers a full wildcard
+			return false
+		case patternToken == SingleWildcard:
+		case patternToken != subjectToken:
+			return false
+		}
+	}
+
+	return len(subjectTokens) == len(patternTokens)
+}
+
+// Error describes why a subject is invalid.
+type Error struct {
+	Subject string
+	Reason  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid subject '%s': %s", e.Subject, e.Reason)
+}
+
+// Validate checks the syntax of a subject, which may contain wildcards.
+// Tokens must not be empty or contain whitespace, wildcards must be whole
+// tokens and the full wildcard must be the last token.
+func Validate(subject string) error {
+	if subject == "" {
+		return &Error{Subject: subject, Reason: "subject is empty"}
+	}
+	if reason := invalidCharacter(subject); reason != "" {
+		return &Error{Subject: subject, Reason: reason}
+	}
+
+	tokens := strings.Split(subject, TokenSeparator)
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return &Error{Subject: subject, Reason: fmt.Sprintf("token %d is empty", i+1)}
+		case token == FullWildcard && i != len(tokens)-1:
+			return &Error{Subject: subject, Reason: fmt.Sprintf("'%s' must be the last token", FullWildcard)}
+		case token != FullWildcard && token != SingleWildcard &&
+			strings.ContainsAny(token, SingleWildcard+FullWildcard):
+			return &Error{Subject: subject, Reason: fmt.Sprintf("wildcards must be whole tokens, got '%s'", token)}
+		}
+	}
+	return nil
+}
+
+// ValidateQueue checks the name of a queue group.
+func ValidateQueue(queue string) error {
+	if queue == "" {
+		return fmt.Errorf("invalid queue group '': queue group is empty")
+	}
+	if reason := invalidCharacter(queue); reason != "" {
+		return fmt.Errorf("invalid queue group '%s': %s", queue, reason)
+	}
+	return nil
+}
+
+// invalidCharacter returns why a character of the value is not allowed in a
+// subject, or an empty string.
+func invalidCharacter(value string) string {
+	for _, r := range value {
+		switch {
+		case unicode.IsSpace(r):
+			return fmt.Sprintf("whitespace %q is not allowed", r)
+		case !unicode.IsPrint(r):
+			return fmt.Sprintf("character %q is not allowed", r)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package subject
+
+import "testing"
+
+func TestIsSubsetOf(t *testing.T) {
+	tests := []struct {
+		subject, pattern string
+		subset           bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.*", true},
+		{"orders.*.created", "orders.>", true},
+		{"orders.>", "orders.>", true},
+		{"orders", "orders.>", false},
+		{"orders.>", "orders.*", false},
+		{"orders.*", "orders.created", false},
+		{"orders.created.eu", "orders.*", false},
+		{"billing.created", "orders.>", false},
+		{"orders.team-a.>", ">", true},
+	}
+
+	for _, test := range tests {
+		if subset := IsSubsetOf(test.subject, test.pattern); subset != test.subset {
+			t.Errorf("IsSubsetOf(%s, %s) = %t, expected %t", test.subject, test.pattern, subset, test.subset)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, valid := range []string{"orders", "orders.created", "orders.*.created", "orders.>", ">", "*", "orders.team-a_1"} {
+		if err := Validate(valid); err != nil {
+			t.Errorf("expected '%s' to be valid, got %v", valid, err)
+		}
+	}
+
+	for _, invalid := range []string{"", "orders created", "orders..created", ".orders", "orders.", "orders.>.created", "orders.a*", "orders.>x", "orders.\x00"} {
+		if err := Validate(invalid); err == nil {
+			t.Errorf("expected '%s' to be invalid", invalid)
+		}
+	}
+
+	if err := ValidateQueue("workers"); err != nil {
+		t.Errorf("expected queue to be valid, got %v", err)
+	}
+	if err := ValidateQueue("work ers"); err == nil {
+		t.Error("expected queue with whitespace to be invalid")
+	}
+}